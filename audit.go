@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// actions recorded in the audit log
+const (
+	auditDeviceCreate  = "device.create"
+	auditDeviceUpdate  = "device.update"
+	auditPipelineStart = "pipeline.start"
+	auditPipelineStop  = "pipeline.stop"
+	auditGroupStart    = "group.start"
+	auditGroupStop     = "group.stop"
+)
+
+// actors of the changes nobody has requested, like the ones made on startup
+const (
+	auditSystem    = "system"
+	auditAnonymous = "anonymous"
+)
+
+const (
+	requestIdHeader = "X-Request-ID"
+	// how many audit events GET /audit returns at most
+	maxAuditLimit = 1000
+)
+
+// the request ids sent by the clients are kept when they look like this, otherwise the service makes up its own
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// AuditEvent is a single change of a device or of the pipeline, the snapshots are what it was like
+// before and after the change. There's no before for a device which was created
+type AuditEvent struct {
+	Id        primitive.ObjectID  `json:"id" bson:"_id"`
+	Timestamp time.Time           `json:"timestamp" bson:"timestamp"`
+	Actor     string              `json:"actor" bson:"actor"`
+	RequestId string              `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	Action    string              `json:"action" bson:"action"`
+	DeviceId  *primitive.ObjectID `json:"deviceId,omitempty" bson:"deviceId,omitempty"`
+	Group     string              `json:"group,omitempty" bson:"group,omitempty"`
+	Before    *AuditSnapshot      `json:"before,omitempty" bson:"before,omitempty"`
+	After     *AuditSnapshot      `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// AuditSnapshot holds either the device or the pipeline
+type AuditSnapshot struct {
+	Device   *Device           `json:"device,omitempty" bson:"device,omitempty"`
+	Pipeline *PipelineSnapshot `json:"pipeline,omitempty" bson:"pipeline,omitempty"`
+}
+
+type PipelineSnapshot struct {
+	DesiredState string `json:"desiredState,omitempty" bson:"desiredState,omitempty"`
+	Running      bool   `json:"running" bson:"running"`
+	Starting     bool   `json:"starting,omitempty" bson:"starting,omitempty"`
+	// how many devices are ticking
+	Ticking int `json:"ticking" bson:"ticking"`
+}
+
+// AuditQuery narrows down the listed events, empty fields match everything
+type AuditQuery struct {
+	DeviceId *primitive.ObjectID
+	Actor    string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+type AuditDao interface {
+	AddAuditEvents(events []AuditEvent, ctx context.Context) error
+	// GetAuditEvents returns the latest events first
+	GetAuditEvents(query *AuditQuery, ctx context.Context) ([]AuditEvent, error)
+}
+
+// AuditSource is who has asked for a change and with which request, it is taken from the request
+// before the change is made so that changes made in the background are still put down to the right actor
+type AuditSource struct {
+	Actor     string
+	RequestId string
+}
+
+// auditSourceFrom tells the anonymous requests, when there's no authentication, from what the service does by itself
+func auditSourceFrom(ctx context.Context) AuditSource {
+	requestId := requestIdFrom(ctx)
+	if principal := principalFrom(ctx); principal != nil {
+		return AuditSource{Actor: principal.Name, RequestId: requestId}
+	}
+	if requestId != "" {
+		return AuditSource{Actor: auditAnonymous, RequestId: requestId}
+	}
+	return AuditSource{Actor: auditSystem}
+}
+
+// AuditLog writes down the changes, a change which couldn't be written down is logged but isn't undone
+type AuditLog struct {
+	dao AuditDao
+}
+
+func NewAuditLog(dao AuditDao) *AuditLog {
+	return &AuditLog{dao: dao}
+}
+
+// Record saves the event, a nil log records nothing
+func (l *AuditLog) Record(source AuditSource, action string, deviceId *primitive.ObjectID, before, after *AuditSnapshot) {
+	if l == nil {
+		return
+	}
+	l.save([]AuditEvent{newAuditEvent(source, action, deviceId, before, after)})
+}
+
+// RecordGroup saves an event about the devices of the group, the snapshots are the ones of the pipeline
+func (l *AuditLog) RecordGroup(source AuditSource, action, group string, before, after *AuditSnapshot) {
+	if l == nil {
+		return
+	}
+	event := newAuditEvent(source, action, nil, before, after)
+	event.Group = group
+	l.save([]AuditEvent{event})
+}
+
+// RecordCreated saves a creation event for every device
+func (l *AuditLog) RecordCreated(source AuditSource, devices []*Device) {
+	if l == nil || len(devices) == 0 {
+		return
+	}
+	events := make([]AuditEvent, len(devices))
+	for i, device := range devices {
+		events[i] = newAuditEvent(source, auditDeviceCreate, &device.Id, nil, deviceSnapshot(device))
+	}
+	l.save(events)
+}
+
+func (l *AuditLog) save(events []AuditEvent) {
+	// the change is made already, the request going away mustn't keep it from being recorded
+	if err := l.dao.AddAuditEvents(events, context.Background()); err != nil {
+		log.Printf("could not record %d audit events (%s by %s): %s", len(events), events[0].Action, events[0].Actor, err.Error())
+	}
+}
+
+func (l *AuditLog) Query(query *AuditQuery, ctx context.Context) ([]AuditEvent, error) {
+	return l.dao.GetAuditEvents(query, ctx)
+}
+
+// parseAuditQuery reads device, actor, from and to (RFC3339) and limit
+func parseAuditQuery(values url.Values) (*AuditQuery, error) {
+	query := &AuditQuery{Actor: values.Get("actor"), Limit: 100}
+	if deviceStr := values.Get("device"); deviceStr != "" {
+		deviceId, err := stringIDToObjectID(deviceStr)
+		if err != nil {
+			return nil, ErrValidation("invalid device id: " + deviceStr)
+		}
+		query.DeviceId = &deviceId
+	}
+
+	var err error
+	if query.From, err = readOptionalTime(values, "from"); err != nil {
+		return nil, err
+	}
+	if query.To, err = readOptionalTime(values, "to"); err != nil {
+		return nil, err
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && query.To.Before(query.From) {
+		return nil, ErrValidation("to must not be before from")
+	}
+
+	limit, err := readOptionalInt(values, "limit")
+	if err != nil {
+		return nil, err
+	}
+	if limit != nil {
+		query.Limit = *limit
+	}
+	if query.Limit <= 0 || query.Limit > maxAuditLimit {
+		return nil, ErrValidation(fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit))
+	}
+	return query, nil
+}
+
+func newAuditEvent(source AuditSource, action string, deviceId *primitive.ObjectID, before, after *AuditSnapshot) AuditEvent {
+	return AuditEvent{
+		Id:        primitive.NewObjectID(),
+		Timestamp: time.Now(),
+		Actor:     source.Actor,
+		RequestId: source.RequestId,
+		Action:    action,
+		DeviceId:  deviceId,
+		Before:    before,
+		After:     after,
+	}
+}
+
+// deviceSnapshot copies the device so that the snapshot stays as it is when the device changes afterwards
+func deviceSnapshot(device *Device) *AuditSnapshot {
+	if device == nil {
+		return nil
+	}
+	snapshot := *device
+	return &AuditSnapshot{Device: &snapshot}
+}
+
+type requestIdKey struct{}
+
+func withRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// requestIdFrom returns an empty id for what doesn't come from a request
+func requestIdFrom(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// RequestIdMiddleware gives every request an id, it is sent back in X-Request-ID and kept in the audit log
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if !requestIdPattern.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(withRequestId(r.Context(), requestId)))
+	})
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// the id only has to tell the requests apart
+		return primitive.NewObjectID().Hex()
+	}
+	return hex.EncodeToString(id)
+}
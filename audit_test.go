@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockAuditDao struct {
+	mutex  sync.Mutex
+	events []AuditEvent
+	query  *AuditQuery
+}
+
+func (m *mockAuditDao) AddAuditEvents(events []AuditEvent, ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *mockAuditDao) GetAuditEvents(query *AuditQuery, ctx context.Context) ([]AuditEvent, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.query = query
+	return append([]AuditEvent{}, m.events...), nil
+}
+
+func (m *mockAuditDao) recorded() []AuditEvent {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]AuditEvent{}, m.events...)
+}
+
+func TestController_AddDevice_GivenAuthenticatedRequest_CreationIsRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	c := &Controller{mainService: NewService(&mockDao{}), audit: NewAuditLog(audit), auth: NewAuthenticator(&mockApiKeyDao{}, testAdminKey)}
+	mockServer := httptest.NewServer(newRouter(c))
+	defer mockServer.Close()
+
+	request, _ := http.NewRequest("POST", mockServer.URL+"/devices", strings.NewReader(`{"name": "thermometer", "interval": "1000"}`))
+	request.Header.Set(apiKeyHeader, testAdminKey)
+	request.Header.Set(requestIdHeader, "req-1")
+	resp, err := http.DefaultClient.Do(request)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "req-1", resp.Header.Get(requestIdHeader))
+	events := audit.recorded()
+	assert.Len(t, events, 1)
+	assert.Equal(t, auditDeviceCreate, events[0].Action)
+	assert.Equal(t, "admin", events[0].Actor)
+	assert.Equal(t, "req-1", events[0].RequestId)
+	assert.Nil(t, events[0].Before)
+	assert.Equal(t, "thermometer", events[0].After.Device.Name)
+}
+
+func TestController_SetDeviceValue_GivenDevice_BeforeAndAfterAreRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	id := primitive.NewObjectID()
+	c := &Controller{mainService: NewService(&mockDao{device: &Device{Id: id, Value: 1}}), tickerService: NewTickerService(SystemClock{}), audit: NewAuditLog(audit)}
+	ctx := withPrincipal(withRequestId(context.Background(), "req-2"), &Principal{Name: "key:ops:1"})
+
+	_, err := c.SetDeviceValue(id.Hex(), 2, ctx)
+
+	assert.NoError(t, err)
+	events := audit.recorded()
+	assert.Len(t, events, 1)
+	assert.Equal(t, auditDeviceUpdate, events[0].Action)
+	assert.Equal(t, &id, events[0].DeviceId)
+	assert.Equal(t, "key:ops:1", events[0].Actor)
+	assert.Equal(t, 1.0, events[0].Before.Device.Value)
+	assert.Equal(t, 2.0, events[0].After.Device.Value)
+}
+
+func TestController_AddDevicesInBackground_GivenRequest_DevicesArePutDownToTheRequest(t *testing.T) {
+	audit := &mockAuditDao{}
+	c := &Controller{mainService: NewService(&mockDao{}), jobs: NewJobManager(newMockJobDao()), audit: NewAuditLog(audit)}
+	ctx := withRequestId(context.Background(), "req-3")
+
+	job, err := c.AddDevicesInBackground([]DevicePayload{{Name: "first", Interval: 1000}, {Name: "second", Interval: 1000}}, false, ctx)
+	assert.NoError(t, err)
+	c.jobs.wait(job.Id)
+
+	events := audit.recorded()
+	assert.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, auditAnonymous, event.Actor)
+		assert.Equal(t, "req-3", event.RequestId)
+	}
+}
+
+func TestController_StopPipeline_GivenRunningPipeline_StopIsRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	stateDao := &mockPipelineStateDao{state: pipelineRunning}
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID(), Interval: 1000}, stateDao, &mockInfluxClient{written: make(chan client.BatchPoints, 16)})
+	c.audit = NewAuditLog(audit)
+	defer c.Close()
+	assert.NoError(t, c.StartTickerService())
+
+	_, err := c.StopPipeline(context.Background())
+
+	assert.NoError(t, err)
+	events := audit.recorded()
+	assert.Len(t, events, 1)
+	assert.Equal(t, auditPipelineStop, events[0].Action)
+	assert.Equal(t, auditSystem, events[0].Actor)
+	assert.Equal(t, &PipelineSnapshot{DesiredState: pipelineRunning, Running: true, Ticking: 1}, events[0].Before.Pipeline)
+	assert.Equal(t, &PipelineSnapshot{DesiredState: pipelineStopped}, events[0].After.Pipeline)
+}
+
+func TestController_StartPipeline_GivenRepeatedStarts_OnlyTheSucceededStartIsRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID(), Interval: 1000}, &mockPipelineStateDao{}, &mockInfluxClient{written: make(chan client.BatchPoints, 16)})
+	c.audit = NewAuditLog(audit)
+	defer c.Close()
+	ctx := withRequestId(context.Background(), "req-6")
+
+	_, err := c.StartPipeline(ctx)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(audit.recorded()) == 1 }, time.Second, time.Millisecond)
+	_, err = c.StartPipeline(ctx)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	events := audit.recorded()
+	assert.Len(t, events, 1)
+	assert.Equal(t, auditPipelineStart, events[0].Action)
+	assert.Equal(t, "req-6", events[0].RequestId)
+	assert.False(t, events[0].Before.Pipeline.Running)
+	assert.True(t, events[0].After.Pipeline.Running)
+}
+
+func TestController_StartPipeline_GivenFailingStart_NothingIsRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID()}, &mockPipelineStateDao{}, &mockInfluxClient{})
+	c.audit = NewAuditLog(audit)
+	defer c.Close()
+	c.writerService.precision = "d"
+
+	_, err := c.StartPipeline(context.Background())
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return c.Status().Error != "" }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Empty(t, audit.recorded())
+}
+
+func TestController_StopPipeline_GivenStoppedPipeline_NothingIsRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID()}, &mockPipelineStateDao{}, &mockInfluxClient{})
+	c.audit = NewAuditLog(audit)
+	defer c.Close()
+
+	_, err := c.StopPipeline(context.Background())
+
+	assert.NoError(t, err)
+	assert.Empty(t, audit.recorded())
+}
+
+func TestController_RunScenario_GivenRequest_TimelineIsPutDownToTheRequest(t *testing.T) {
+	audit := &mockAuditDao{}
+	clock := NewFakeClock(schedulerEpoch)
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID(), Interval: 1000}}
+	c := Controller{mainService: NewService(dao), tickerService: NewTickerService(clock), clock: clock,
+		jobs: NewJobManager(newMockJobDao()), audit: NewAuditLog(audit), running: true}
+	c.tickerService.Start(nil, NewMeasurementQueue(1, DropNewest))
+	scenario, err := LoadScenario(strings.NewReader(testScenario))
+	assert.NoError(t, err)
+	ctx := withPrincipal(withRequestId(context.Background(), "req-4"), &Principal{Name: "key:ci:1"})
+
+	run, err := c.RunScenario(scenario, ctx)
+	assert.NoError(t, err)
+	// the scheduler ticking the devices and the runner waiting for the fault
+	clock.BlockUntil(2)
+	clock.Advance(5 * time.Minute)
+	clock.BlockUntil(2)
+	_, err = c.CancelJob(run.JobId, context.TODO())
+	assert.NoError(t, err)
+	id, _ := primitive.ObjectIDFromHex(run.JobId)
+	c.jobs.wait(id)
+
+	updates := 0
+	for _, event := range audit.recorded() {
+		assert.Equal(t, "key:ci:1", event.Actor)
+		assert.Equal(t, "req-4", event.RequestId)
+		if event.Action == auditDeviceUpdate {
+			updates++
+		}
+	}
+	assert.Equal(t, 1, updates)
+}
+
+func TestController_StartGroupAndStopGroup_GivenRequest_BothAreRecorded(t *testing.T) {
+	audit := &mockAuditDao{}
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000, Groups: []string{"floor-1"}}
+	c := Controller{mainService: NewService(&mockDao{data: []Device{device}}), tickerService: NewTickerService(SystemClock{}),
+		stateDao: &mockPipelineStateDao{state: pipelineRunning}, audit: NewAuditLog(audit)}
+	c.tickerService.Start(nil, NewMeasurementQueue(1, Block))
+	defer c.tickerService.Stop()
+	ctx := withRequestId(context.Background(), "req-5")
+
+	_, err := c.StartGroup("floor-1", ctx)
+	assert.NoError(t, err)
+	_, err = c.StopGroup("floor-1", ctx)
+	assert.NoError(t, err)
+
+	events := audit.recorded()
+	assert.Len(t, events, 2)
+	assert.Equal(t, auditGroupStart, events[0].Action)
+	assert.Equal(t, auditGroupStop, events[1].Action)
+	for _, event := range events {
+		assert.Equal(t, "floor-1", event.Group)
+		assert.Equal(t, auditAnonymous, event.Actor)
+		assert.Equal(t, "req-5", event.RequestId)
+	}
+	assert.Equal(t, 0, events[0].Before.Pipeline.Ticking)
+	assert.Equal(t, 1, events[0].After.Pipeline.Ticking)
+	assert.Equal(t, 0, events[1].After.Pipeline.Ticking)
+}
+
+func TestController_FinishSimulation_GivenTickingDevices_StopIsPutDownToTheSystem(t *testing.T) {
+	audit := &mockAuditDao{}
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID(), Interval: 1000}, &mockPipelineStateDao{state: pipelineRunning}, &mockInfluxClient{written: make(chan client.BatchPoints, 16)})
+	c.audit = NewAuditLog(audit)
+	defer c.Close()
+	assert.NoError(t, c.StartTickerService())
+
+	c.finishSimulation()
+
+	events := audit.recorded()
+	assert.Len(t, events, 1)
+	assert.Equal(t, auditPipelineStop, events[0].Action)
+	assert.Equal(t, auditSystem, events[0].Actor)
+	assert.Equal(t, 1, events[0].Before.Pipeline.Ticking)
+	assert.Equal(t, 0, events[0].After.Pipeline.Ticking)
+}
+
+func Test_RequestIdMiddleware_GivenMalformedId_NewIdIsMadeUp(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+
+	kept := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/devices", nil)
+	request.Header.Set(requestIdHeader, "abc-123")
+	r.ServeHTTP(kept, request)
+	replaced := httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/devices", nil)
+	request.Header.Set(requestIdHeader, "bad id\n")
+	r.ServeHTTP(replaced, request)
+
+	assert.Equal(t, "abc-123", kept.Header().Get(requestIdHeader))
+	assert.Len(t, replaced.Header().Get(requestIdHeader), 32)
+}
+
+func Test_ParseAuditQuery_GivenInvalidValues_ReturnsErrValidation(t *testing.T) {
+	for _, values := range []string{"device=abc", "from=yesterday", "from=2020-01-02T00:00:00Z&to=2020-01-01T00:00:00Z", "limit=0", "limit=1001"} {
+		parsed, _ := url.ParseQuery(values)
+		_, err := parseAuditQuery(parsed)
+		assert.IsType(t, ErrValidation(""), err, values)
+	}
+}
+
+func Test_GetAuditHandler_GivenFilters_HandlerPassesQueryToDao(t *testing.T) {
+	audit := &mockAuditDao{events: []AuditEvent{{Id: primitive.NewObjectID(), Action: auditPipelineStart}}}
+	mockServer := httptest.NewServer(newRouter(&Controller{mainService: NewService(&mockDao{}), audit: NewAuditLog(audit)}))
+	defer mockServer.Close()
+	id := primitive.NewObjectID()
+
+	resp, err := http.Get(mockServer.URL + "/audit?device=" + id.Hex() + "&actor=admin&from=2020-01-01T00:00:00Z&limit=5")
+	assert.NoError(t, err)
+	var events []AuditEvent
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, &AuditQuery{DeviceId: &id, Actor: "admin", From: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Limit: 5}, audit.query)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// scopes granted to API keys
+const (
+	scopeDevicesRead     = "devices:read"
+	scopeDevicesWrite    = "devices:write"
+	scopePipelineControl = "pipeline:control"
+	scopeKeysAdmin       = "keys:admin"
+)
+
+var knownScopes = map[string]bool{
+	scopeDevicesRead:     true,
+	scopeDevicesWrite:    true,
+	scopePipelineControl: true,
+	scopeKeysAdmin:       true,
+}
+
+const (
+	apiKeyHeader = "X-API-Key"
+	authRealm    = "deviceService"
+	apiKeyPrefix = "dsk_"
+	// the part of the key kept in clear so that a key can be recognized in the list
+	apiKeyShownLength = len(apiKeyPrefix) + 6
+)
+
+// routeScopes tells which scope every route requires, routes missing from here are left to keys:admin
+var routeScopes = map[string]string{
+	"GET /status":                    scopeDevicesRead,
+	"GET /devices":                   scopeDevicesRead,
+	"GET /devices/export":            scopeDevicesRead,
+	"GET /devices/{id}":              scopeDevicesRead,
+	"GET /devices/{id}/backfill":     scopeDevicesRead,
+	"GET /devices/{id}/measurements": scopeDevicesRead,
+	"GET /devices/{id}/stream":       scopeDevicesRead,
+	"GET /stream":                    scopeDevicesRead,
+	"GET /ws":                        scopeDevicesRead,
+	"GET /jobs":                      scopeDevicesRead,
+	"GET /jobs/{id}":                 scopeDevicesRead,
+	"GET /jobs/{id}/file":            scopeDevicesRead,
+	"POST /devices":                  scopeDevicesWrite,
+	"POST /devices:bulk":             scopeDevicesWrite,
+	"POST /devices/export":           scopeDevicesWrite,
+	"PUT /devices/{id}/faults":       scopeDevicesWrite,
+	"DELETE /devices/{id}/faults":    scopeDevicesWrite,
+	"POST /devices/{id}/backfill":    scopeDevicesWrite,
+	"DELETE /devices/{id}/backfill":  scopeDevicesWrite,
+	"DELETE /jobs/{id}":              scopeDevicesWrite,
+	"POST /start":                    scopePipelineControl,
+	"POST /stop":                     scopePipelineControl,
+	"POST /scenarios":                scopePipelineControl,
+	"POST /groups/{group}/start":     scopePipelineControl,
+	"POST /groups/{group}/stop":      scopePipelineControl,
+	"GET /audit":                     scopeKeysAdmin,
+	"GET /keys":                      scopeKeysAdmin,
+	"POST /keys":                     scopeKeysAdmin,
+	"DELETE /keys/{id}":              scopeKeysAdmin,
+}
+
+// ApiKey is kept without the key itself, only its sha256 is stored
+type ApiKey struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Name      string             `json:"name" bson:"name"`
+	Prefix    string             `json:"prefix" bson:"prefix"`
+	Hash      string             `json:"-" bson:"hash"`
+	Scopes    []string           `json:"scopes" bson:"scopes"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	RevokedAt *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+type ApiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// NewApiKey is the reply to the creation of a key, it is the only time the key is shown
+type NewApiKey struct {
+	ApiKey
+	Key string `json:"key"`
+}
+
+type ApiKeyDao interface {
+	AddApiKey(key *ApiKey, ctx context.Context) error
+	// GetApiKeyByHash returns nil if there's no such key
+	GetApiKeyByHash(hash string, ctx context.Context) (*ApiKey, error)
+	GetApiKeys(ctx context.Context) ([]ApiKey, error)
+	RevokeApiKey(id primitive.ObjectID, at time.Time, ctx context.Context) (*ApiKey, error)
+}
+
+// Principal is whoever has made the request
+type Principal struct {
+	Name   string
+	Scopes []string
+}
+
+func (p *Principal) String() string {
+	return p.Name
+}
+
+// Can tells whether the principal has the scope, a nil principal means that there's no authentication
+func (p *Principal) Can(scope string) bool {
+	if p == nil {
+		return true
+	}
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom returns nil for requests which weren't authenticated
+func principalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+func (r *ApiKeyRequest) validate() error {
+	if r.Name == "" || len(r.Name) > 64 {
+		return ErrValidation("name is required and has at most 64 characters")
+	}
+	if len(r.Scopes) == 0 {
+		return ErrValidation("at least one scope is required")
+	}
+	for _, scope := range r.Scopes {
+		if !knownScopes[scope] {
+			return ErrValidation("unknown scope: " + scope)
+		}
+	}
+	return nil
+}
+
+// Authenticator checks the API keys, the bearer tokens or the client certificates of the requests, it is only there
+// when API_ADMIN_KEY, JWT_JWKS or TLS_CLIENT_CA_FILE is set. The admin key isn't stored anywhere, it has all the scopes and is used to create the other keys
+type Authenticator struct {
+	dao ApiKeyDao
+	// empty when there's no admin key
+	adminHash string
+	// nil when bearer tokens aren't accepted
+	tokens *JwtValidator
+	// whether the client certificates tell who has made the request
+	certificates bool
+}
+
+// newAuthenticatorFromEnv returns nil when none of API_ADMIN_KEY, JWT_JWKS and TLS_CLIENT_CA_FILE is set,
+// all the endpoints stay anonymous then
+func newAuthenticatorFromEnv(dao ApiKeyDao) *Authenticator {
+	adminKey := os.Getenv("API_ADMIN_KEY")
+	tokens := newJwtValidatorFromEnv()
+	certificates := tlsClientCAFromEnv() != ""
+	if adminKey == "" && tokens == nil && !certificates {
+		log.Printf("none of API_ADMIN_KEY, JWT_JWKS and TLS_CLIENT_CA_FILE is set, the API is not authenticated")
+		return nil
+	}
+	a := NewAuthenticator(dao, adminKey)
+	a.tokens = tokens
+	a.certificates = certificates
+	return a
+}
+
+func NewAuthenticator(dao ApiKeyDao, adminKey string) *Authenticator {
+	a := &Authenticator{dao: dao}
+	if adminKey != "" {
+		a.adminHash = hashApiKey(adminKey)
+	}
+	return a
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the principal of the key, ErrUnauthorized if the key is missing, unknown or revoked
+func (a *Authenticator) Authenticate(key string, ctx context.Context) (*Principal, error) {
+	if key == "" {
+		if a.tokens != nil {
+			return nil, ErrUnauthorized("missing bearer token or " + apiKeyHeader + " header")
+		}
+		return nil, ErrUnauthorized("missing " + apiKeyHeader + " header")
+	}
+	hash := hashApiKey(key)
+	if a.adminHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.adminHash)) == 1 {
+		scopes := make([]string, 0, len(knownScopes))
+		for scope := range knownScopes {
+			scopes = append(scopes, scope)
+		}
+		return &Principal{Name: "admin", Scopes: scopes}, nil
+	}
+	apiKey, err := a.dao.GetApiKeyByHash(hash, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == nil || apiKey.RevokedAt != nil {
+		return nil, ErrUnauthorized("invalid API key")
+	}
+	return &Principal{Name: "key:" + apiKey.Name + ":" + apiKey.Id.Hex(), Scopes: apiKey.Scopes}, nil
+}
+
+// Middleware lets through the requests whose key or token has the scope of the route, the calls changing something
+// are logged together with who has made them. That is only the request log, the changes themselves go to the audit log.
+// Rejected requests get a problem response
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, bearer, err := a.authenticate(r)
+		if err != nil {
+			status := errorStatusCode(err)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", a.challenge(bearer, err))
+			}
+			writeProblem(w, status, err.Error())
+			return
+		}
+		scope := requiredScope(r)
+		if !principal.Can(scope) {
+			if bearer {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+authRealm+`", error="insufficient_scope", scope="`+scope+`"`)
+			}
+			writeProblem(w, http.StatusForbidden, ErrForbidden(scope).Error())
+			return
+		}
+		r = r.WithContext(withPrincipal(r.Context(), principal))
+		if r.Method == http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		log.Printf("request: %s %s %s -> %d (request %s)", principal, r.Method, r.URL.Path, recorder.status, requestIdFrom(r.Context()))
+	})
+}
+
+// authenticate goes with the bearer token when there's one and tokens are accepted, with the API key otherwise.
+// The client certificate is only used when the request comes with neither
+func (a *Authenticator) authenticate(r *http.Request) (principal *Principal, bearer bool, err error) {
+	if token, ok := bearerToken(r.Header.Get("Authorization")); ok && a.tokens != nil {
+		principal, err = a.tokens.Validate(token)
+		return principal, true, err
+	}
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" && a.certificates {
+		if principal = certificatePrincipal(r.TLS); principal != nil {
+			return principal, false, nil
+		}
+	}
+	principal, err = a.Authenticate(key, r.Context())
+	return principal, false, err
+}
+
+func bearerToken(authorization string) (string, bool) {
+	const scheme = "bearer "
+	if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[len(scheme):]), true
+}
+
+// challenge is the WWW-Authenticate header of a 401, it tells the client which credentials to come with
+func (a *Authenticator) challenge(bearer bool, err error) string {
+	if a.tokens == nil {
+		return `ApiKey realm="` + authRealm + `"`
+	}
+	if !bearer {
+		return `Bearer realm="` + authRealm + `"`
+	}
+	return `Bearer realm="` + authRealm + `", error="invalid_token", error_description="` + strings.Replace(err.Error(), `"`, `'`, -1) + `"`
+}
+
+// Problem is the body of the responses to rejected requests, as described by RFC 7807
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	problem := Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail}
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		log.Printf("could not write the problem response: %s", err.Error())
+	}
+}
+
+func requiredScope(r *http.Request) string {
+	if scope, ok := routeScopes[r.Method+" "+routeTemplate(r)]; ok {
+		return scope
+	}
+	return scopeKeysAdmin
+}
+
+// routeTemplate is the path template of the route the request has matched, empty if there's none
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return template
+}
+
+// statusRecorder remembers the status sent by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush and Hijack let the streams and the websockets through the recorder
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// CreateApiKey generates a new key, the key is returned this once and only its hash is kept
+func (a *Authenticator) CreateApiKey(request *ApiKeyRequest, ctx context.Context) (*NewApiKey, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	apiKey := ApiKey{
+		Id:        primitive.NewObjectID(),
+		Name:      request.Name,
+		Prefix:    key[:apiKeyShownLength],
+		Hash:      hashApiKey(key),
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if err := a.dao.AddApiKey(&apiKey, ctx); err != nil {
+		return nil, err
+	}
+	return &NewApiKey{ApiKey: apiKey, Key: key}, nil
+}
+
+func (a *Authenticator) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	return a.dao.GetApiKeys(ctx)
+}
+
+// RevokeApiKey keeps the key around so that it still shows up in the list, it just can't be used anymore
+func (a *Authenticator) RevokeApiKey(id string, ctx context.Context) (*ApiKey, error) {
+	objectID, err := stringIDToObjectID(id)
+	if err != nil {
+		return nil, ErrValidation("invalid key id: " + id)
+	}
+	apiKey, err := a.dao.RevokeApiKey(objectID, time.Now(), ctx)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	return apiKey, nil
+}
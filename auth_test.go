@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminKey = "admin-secret"
+
+type mockApiKeyDao struct {
+	mutex sync.Mutex
+	keys  []ApiKey
+}
+
+func (m *mockApiKeyDao) AddApiKey(key *ApiKey, ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keys = append(m.keys, *key)
+	return nil
+}
+
+func (m *mockApiKeyDao) GetApiKeyByHash(hash string, ctx context.Context) (*ApiKey, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, key := range m.keys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockApiKeyDao) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]ApiKey{}, m.keys...), nil
+}
+
+func (m *mockApiKeyDao) RevokeApiKey(id primitive.ObjectID, at time.Time, ctx context.Context) (*ApiKey, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.keys {
+		if m.keys[i].Id == id {
+			if m.keys[i].RevokedAt == nil {
+				m.keys[i].RevokedAt = &at
+			}
+			key := m.keys[i]
+			return &key, nil
+		}
+	}
+	return nil, nil
+}
+
+func newAuthenticatedServer(dao ApiKeyDao) *httptest.Server {
+	c := &Controller{mainService: NewService(&mockDao{}), auth: NewAuthenticator(dao, testAdminKey)}
+	return httptest.NewServer(newRouter(c))
+}
+
+func doWithKey(t *testing.T, method, url, key, body string) *http.Response {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	if key != "" {
+		request.Header.Set(apiKeyHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	assert.NoError(t, err)
+	return resp
+}
+
+func createTestKey(t *testing.T, server *httptest.Server, scopes ...string) NewApiKey {
+	body, _ := json.Marshal(ApiKeyRequest{Name: "test", Scopes: scopes})
+	resp := doWithKey(t, "POST", server.URL+"/keys", testAdminKey, string(body))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var key NewApiKey
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&key))
+	return key
+}
+
+func TestAuthenticator_Middleware_GivenMissingOrUnknownKey_Returns401(t *testing.T) {
+	server := newAuthenticatedServer(&mockApiKeyDao{})
+
+	missing := doWithKey(t, "GET", server.URL+"/devices", "", "")
+	unknown := doWithKey(t, "GET", server.URL+"/devices", "dsk_unknown", "")
+
+	assert.Equal(t, http.StatusUnauthorized, missing.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, unknown.StatusCode)
+}
+
+func TestAuthenticator_Middleware_GivenKeyWithoutTheScope_Returns403(t *testing.T) {
+	dao := &mockApiKeyDao{}
+	server := newAuthenticatedServer(dao)
+	key := createTestKey(t, server, scopeDevicesRead)
+
+	read := doWithKey(t, "GET", server.URL+"/devices", key.Key, "")
+	write := doWithKey(t, "POST", server.URL+"/devices", key.Key, `{"name": "test"}`)
+	keys := doWithKey(t, "GET", server.URL+"/keys", key.Key, "")
+
+	assert.Equal(t, http.StatusOK, read.StatusCode)
+	assert.Equal(t, http.StatusForbidden, write.StatusCode)
+	assert.Equal(t, http.StatusForbidden, keys.StatusCode)
+}
+
+func TestAuthenticator_CreateApiKey_GivenRequest_OnlyTheHashIsStored(t *testing.T) {
+	dao := &mockApiKeyDao{}
+	server := newAuthenticatedServer(dao)
+
+	key := createTestKey(t, server, scopeDevicesWrite)
+
+	assert.True(t, strings.HasPrefix(key.Key, apiKeyPrefix))
+	assert.Equal(t, key.Key[:apiKeyShownLength], key.Prefix)
+	assert.Len(t, dao.keys, 1)
+	assert.Equal(t, hashApiKey(key.Key), dao.keys[0].Hash)
+	assert.NotContains(t, dao.keys[0].Hash, key.Key)
+}
+
+func TestAuthenticator_CreateApiKey_GivenUnknownScope_Returns400(t *testing.T) {
+	server := newAuthenticatedServer(&mockApiKeyDao{})
+
+	resp := doWithKey(t, "POST", server.URL+"/keys", testAdminKey, `{"name": "test", "scopes": ["devices:delete"]}`)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAuthenticator_RevokeApiKey_GivenRevokedKey_KeyIsRejected(t *testing.T) {
+	server := newAuthenticatedServer(&mockApiKeyDao{})
+	key := createTestKey(t, server, scopeDevicesRead)
+
+	revoke := doWithKey(t, "DELETE", server.URL+"/keys/"+key.Id.Hex(), testAdminKey, "")
+	resp := doWithKey(t, "GET", server.URL+"/devices", key.Key, "")
+	var list []ApiKey
+	listResp := doWithKey(t, "GET", server.URL+"/keys", testAdminKey, "")
+	assert.NoError(t, json.NewDecoder(listResp.Body).Decode(&list))
+
+	assert.Equal(t, http.StatusOK, revoke.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Len(t, list, 1)
+	assert.NotNil(t, list[0].RevokedAt)
+}
+
+func TestAuthenticator_RevokeApiKey_GivenUnknownKey_Returns404(t *testing.T) {
+	server := newAuthenticatedServer(&mockApiKeyDao{})
+
+	resp := doWithKey(t, "DELETE", server.URL+"/keys/"+primitive.NewObjectID().Hex(), testAdminKey, "")
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_NewRouter_GivenNoAuthenticator_KeysAreNotNeeded(t *testing.T) {
+	server := httptest.NewServer(newRouter(&Controller{mainService: NewService(&mockDao{})}))
+
+	devices := doWithKey(t, "POST", server.URL+"/devices", "", `{"name": "test"}`)
+	keys := doWithKey(t, "GET", server.URL+"/keys", "", "")
+
+	assert.Equal(t, http.StatusOK, devices.StatusCode)
+	assert.Equal(t, http.StatusNotFound, keys.StatusCode)
+}
+
+func Test_RouteScopes_GivenRouter_EveryRouteHasItsScope(t *testing.T) {
+	r := newRouter(&Controller{auth: NewAuthenticator(&mockApiKeyDao{}, testAdminKey)})
+
+	_ = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			_, ok := routeScopes[method+" "+template]
+			assert.True(t, ok, "%s %s has no scope", method, template)
+		}
+		return nil
+	})
+}
+
+func TestWebSocket_GivenReadOnlyKey_CommandsAreForbidden(t *testing.T) {
+	ctx := withPrincipal(context.Background(), &Principal{Name: "reader", Scopes: []string{scopeDevicesRead}})
+	wc := &wsConnection{controller: &Controller{mainService: NewService(&mockDao{})}}
+
+	response := wc.handle(&WsRequest{Type: wsStop, Id: primitive.NewObjectID().Hex()}, ctx)
+
+	assert.Equal(t, wsError, response.Type)
+	assert.Equal(t, ErrForbidden(scopeDevicesWrite).Error(), response.Error)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// the most measurements written with a single request by a backfill
+const backfillBatch = 5000
+
+type BackfillRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// BackfillResult is what a backfill reports back, it is there for cancelled and failed backfills as well
+type BackfillResult struct {
+	DeviceId string    `json:"deviceId"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Written  int64     `json:"written"`
+}
+
+func (r *BackfillRequest) validate() error {
+	if r.From.IsZero() || r.To.IsZero() {
+		return ErrValidation("from and to are required")
+	}
+	if !r.To.After(r.From) {
+		return ErrValidation("to has to be after from")
+	}
+	return nil
+}
+
+// runBackfill writes the measurements of the device in batches of backfillBatch, the progress is the part of the time range
+// which has been written
+func runBackfill(device Device, request BackfillRequest, writer *MeasurementsWriterService, progress *JobProgress, ctx context.Context) (*BackfillResult, error) {
+	result := &BackfillResult{DeviceId: device.Id.Hex(), From: request.From, To: request.To}
+	span := float64(request.To.Sub(request.From))
+	batch := make([]Measurement, 0, backfillBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := writer.WriteBatch(batch); err != nil {
+			return err
+		}
+		result.Written += int64(len(batch))
+		progress.Set(float64(batch[len(batch)-1].Timestamp.Sub(request.From)) / span)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := synthesizeMeasurements(device, request.From, request.To, func(measurement Measurement) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch = append(batch, measurement)
+		if len(batch) == backfillBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return result, err
+}
+
+// synthesizeMeasurements replays the device's schedule over the time range together with its generator and faults,
+// so that the measurements are the ones it would have produced. They are handed over to fn in order
+func synthesizeMeasurements(device Device, from, to time.Time, fn func(Measurement) error) error {
+	s := NewScheduler(nil, 1, NewFakeClock(from))
+	s.Add(device)
+
+	now := from
+	for {
+		due, wait := s.popDue(now)
+		for _, measurement := range due {
+			if err := fn(measurement); err != nil {
+				return err
+			}
+		}
+		if wait < 0 {
+			return nil
+		}
+		if now = now.Add(wait); now.After(to) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"github.com/influxdata/influxdb1-client/v2"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestSynthesizeMeasurements_GivenInterval_MeasurementsFallOnTheDeviceSchedule(t *testing.T) {
+	device := Device{Id: primitive.NewObjectID(), Interval: 60000, Value: 21.5}
+	var measurements []Measurement
+
+	err := synthesizeMeasurements(device, schedulerEpoch, schedulerEpoch.Add(time.Hour), func(measurement Measurement) error {
+		measurements = append(measurements, measurement)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, measurements, 60)
+	for i, measurement := range measurements {
+		assert.Equal(t, schedulerEpoch.Add(time.Duration(i+1)*time.Minute), measurement.Timestamp)
+		assert.Equal(t, device.Id, measurement.Id)
+		assert.Equal(t, 21.5, measurement.Value)
+	}
+}
+
+func TestSynthesizeMeasurements_GivenGeneratorAndFaults_BothAreApplied(t *testing.T) {
+	device := Device{
+		Id:        primitive.NewObjectID(),
+		Interval:  1000,
+		Value:     10,
+		Generator: &ValueGenerator{Type: "ramp", Step: 1},
+		Faults:    &DeviceFaults{Dropout: &DropoutFault{Period: 5000, Duration: 1000}},
+	}
+	var values []float64
+
+	err := synthesizeMeasurements(device, schedulerEpoch, schedulerEpoch.Add(10*time.Second), func(measurement Measurement) error {
+		values = append(values, measurement.Value)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{11, 12, 13, 14, 16, 17, 18, 19}, values)
+}
+
+func TestRunBackfill_GivenTimeRange_MeasurementsAreWrittenInBatches(t *testing.T) {
+	influx := &mockInfluxClient{written: make(chan client.BatchPoints, 16)}
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086", Database: "devices"}, NewFakeClock(schedulerEpoch))
+	mws.writerClient = influx
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	request := BackfillRequest{From: schedulerEpoch, To: schedulerEpoch.Add(3 * time.Hour)}
+
+	result, err := runBackfill(device, request, mws, nil, context.Background())
+	close(influx.written)
+	var sizes []int
+	for batch := range influx.written {
+		sizes = append(sizes, len(batch.Points()))
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{backfillBatch, backfillBatch, 3*60*60 - 2*backfillBatch}, sizes)
+	assert.Equal(t, &BackfillResult{DeviceId: device.Id.Hex(), From: request.From, To: request.To, Written: 3 * 60 * 60}, result)
+}
+
+func TestRunBackfill_GivenCancelledContext_NothingIsWritten(t *testing.T) {
+	influx := &mockInfluxClient{written: make(chan client.BatchPoints, 16)}
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086", Database: "devices"}, NewFakeClock(schedulerEpoch))
+	mws.writerClient = influx
+	request := BackfillRequest{From: schedulerEpoch, To: schedulerEpoch.Add(time.Hour)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := runBackfill(Device{Id: primitive.NewObjectID(), Interval: 1000}, request, mws, nil, ctx)
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, influx.written, 0)
+	assert.Equal(t, int64(0), result.Written)
+}
+
+func TestBackfillRequest_Validate_GivenWrongRange_ReturnsValidationError(t *testing.T) {
+	tests := map[string]BackfillRequest{
+		"missing from":     {To: schedulerEpoch},
+		"missing to":       {From: schedulerEpoch},
+		"to before from":   {From: schedulerEpoch, To: schedulerEpoch.Add(-time.Hour)},
+		"empty time range": {From: schedulerEpoch, To: schedulerEpoch},
+	}
+
+	for name, request := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := request.validate()
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
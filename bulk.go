@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+
+	maxBulkDevices = 10000
+	// how many devices a background import adds at once
+	bulkImportBatch = 500
+)
+
+type BulkItemResult struct {
+	Index  int     `json:"index"`
+	Device *Device `json:"device,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+type BulkResult struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Items   []BulkItemResult `json:"items"`
+}
+
+type ErrUnsupportedMediaType string
+
+func (e ErrUnsupportedMediaType) Error() string {
+	return "unsupported media type: " + string(e)
+}
+
+// parseBulkPayloads reads the devices from a JSON array, newline delimited JSON or CSV with a header row,
+// the format is picked based on the content type and defaults to JSON
+func parseBulkPayloads(body io.Reader, contentType string) ([]DevicePayload, error) {
+	mediaType := contentTypeJSON
+	if contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, ErrUnsupportedMediaType(contentType)
+		}
+	}
+
+	var payloads []DevicePayload
+	var err error
+	switch mediaType {
+	case contentTypeJSON:
+		err = json.NewDecoder(body).Decode(&payloads)
+	case contentTypeNDJSON:
+		payloads, err = parseNDJSONPayloads(body)
+	case contentTypeCSV:
+		payloads, err = parseCSVPayloads(body)
+	default:
+		return nil, ErrUnsupportedMediaType(mediaType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payloads) == 0 {
+		return nil, ErrValidation("no devices were provided")
+	}
+	if len(payloads) > maxBulkDevices {
+		return nil, ErrValidation(fmt.Sprintf("at most %d devices can be added at once", maxBulkDevices))
+	}
+	return payloads, nil
+}
+
+func parseNDJSONPayloads(body io.Reader) ([]DevicePayload, error) {
+	payloads := make([]DevicePayload, 0)
+	decoder := json.NewDecoder(body)
+	for {
+		var payload DevicePayload
+		err := decoder.Decode(&payload)
+		if err == io.EOF {
+			return payloads, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", len(payloads)+1, err.Error())
+		}
+		payloads = append(payloads, payload)
+	}
+}
+
+func parseCSVPayloads(body io.Reader) ([]DevicePayload, error) {
+	reader := csv.NewReader(body)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header row: %s", err.Error())
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+		if !isBulkCSVColumn(header[i]) {
+			return nil, fmt.Errorf("unknown column: %s", header[i])
+		}
+	}
+
+	payloads := make([]DevicePayload, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return payloads, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var payload DevicePayload
+		for i, column := range header {
+			if err = setBulkCSVColumn(&payload, column, strings.TrimSpace(record[i])); err != nil {
+				return nil, fmt.Errorf("row %d, column %s: %s", len(payloads)+1, column, err.Error())
+			}
+		}
+		payloads = append(payloads, payload)
+	}
+}
+
+// parseGenerator reads the JSON written by formatGenerator, an empty column means no generator
+func parseGenerator(value string) (*ValueGenerator, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var generator ValueGenerator
+	if err := json.Unmarshal([]byte(value), &generator); err != nil {
+		return nil, ErrValidation("invalid generator: " + err.Error())
+	}
+	return &generator, nil
+}
+
+func isBulkCSVColumn(column string) bool {
+	return setBulkCSVColumn(&DevicePayload{}, column, "") == nil
+}
+
+func setBulkCSVColumn(payload *DevicePayload, column, value string) error {
+	var err error
+	switch column {
+	case "id":
+		payload.Id = value
+	case "name":
+		payload.Name = value
+	case "value":
+		if value != "" {
+			payload.Value, err = strconv.ParseFloat(value, 64)
+		}
+	case "interval":
+		if value != "" {
+			payload.Interval, err = strconv.Atoi(value)
+		}
+	case "unit":
+		payload.Unit = value
+	case "labels":
+		payload.Labels, err = parseLabels(value)
+	case "groups":
+		payload.Groups = parseGroups(value)
+	case "jitter":
+		if value != "" {
+			payload.Jitter, err = strconv.Atoi(value)
+		}
+	case "phase":
+		if value != "" {
+			payload.Phase, err = strconv.Atoi(value)
+		}
+	case "cron":
+		payload.Cron = value
+	case "generator":
+		payload.Generator, err = parseGenerator(value)
+	default:
+		return fmt.Errorf("unknown column: %s", column)
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_ParseBulkPayloads_GivenDifferentFormats_FuncReturnsPayloads(t *testing.T) {
+	expected := []DevicePayload{{Name: "first", Value: 1.5, Interval: 100}, {Name: "second"}}
+	tests := map[string]struct {
+		body        string
+		contentType string
+	}{
+		"json array":    {body: `[{"name": "first", "value": "1.5", "interval": "100"}, {"name": "second"}]`, contentType: "application/json"},
+		"default json":  {body: `[{"name": "first", "value": "1.5", "interval": "100"}, {"name": "second"}]`, contentType: ""},
+		"ndjson":        {body: "{\"name\": \"first\", \"value\": \"1.5\", \"interval\": \"100\"}\n{\"name\": \"second\"}\n", contentType: "application/x-ndjson"},
+		"csv":           {body: "name,value,interval\nfirst,1.5,100\nsecond,,\n", contentType: "text/csv; charset=utf-8"},
+		"csv reordered": {body: "interval, name ,value\n100,first,1.5\n,second,\n", contentType: "text/csv"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			payloads, err := parseBulkPayloads(strings.NewReader(tc.body), tc.contentType)
+
+			assert.NoError(t, err)
+			assert.Equal(t, expected, payloads)
+		})
+	}
+}
+
+func Test_ParseBulkPayloads_GivenMalformedBody_FuncReturnsError(t *testing.T) {
+	tests := map[string]struct {
+		body        string
+		contentType string
+	}{
+		"json object":      {body: `{"name": "first"}`, contentType: "application/json"},
+		"empty array":      {body: `[]`, contentType: "application/json"},
+		"broken ndjson":    {body: "{\"name\": \"first\"}\n{\"name\"", contentType: "application/x-ndjson"},
+		"unknown column":   {body: "name,color\nfirst,red\n", contentType: "text/csv"},
+		"value not number": {body: "name,value\nfirst,abc\n", contentType: "text/csv"},
+		"missing column":   {body: "name,value\nfirst\n", contentType: "text/csv"},
+		"broken generator": {body: "name,generator\nfirst,{\"type\"\n", contentType: "text/csv"},
+		"empty csv":        {body: "", contentType: "text/csv"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseBulkPayloads(strings.NewReader(tc.body), tc.contentType)
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_ParseBulkPayloads_GivenUnknownContentType_FuncReturnsErrUnsupportedMediaType(t *testing.T) {
+	_, err := parseBulkPayloads(strings.NewReader("<devices/>"), "application/xml")
+
+	assert.IsType(t, ErrUnsupportedMediaType(""), err)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where the scheduler and the writer take the time from, tests swap it for a FakeClock
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer mirrors time.Timer, Stop and Reset follow the same rules
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// SystemClock is the real wall clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// FakeClock only moves when told to, timers fire from Advance in the order of their deadlines
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// signalled every time a timer gets armed so that BlockUntil can wait for it
+	armed *sync.Cond
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.armed = sync.NewCond(&c.mutex)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the time forward firing every timer whose deadline has been reached
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			due = append(due, t)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].deadline.Before(due[j].deadline) })
+	for _, t := range due {
+		t.active = false
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+}
+
+// NextDeadline tells when the earliest armed timer is going to fire
+func (c *FakeClock) NextDeadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var next time.Time
+	found := false
+	for _, t := range c.timers {
+		if t.active && (!found || t.deadline.Before(next)) {
+			next = t.deadline
+			found = true
+		}
+	}
+	return next, found
+}
+
+// BlockUntil waits until at least n timers are armed, which is how tests know
+// that the code under test has caught up and is waiting for the time to move
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.activeTimers() < n {
+		c.armed.Wait()
+	}
+}
+
+func (c *FakeClock) activeTimers() int {
+	active := 0
+	for _, t := range c.timers {
+		if t.active {
+			active++
+		}
+	}
+	return active
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	ch       chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wasActive := t.active
+	if d <= 0 {
+		// just like time.Timer, a timer which is already due fires right away
+		t.active = false
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		return wasActive
+	}
+
+	if !t.registered() {
+		c.timers = append(c.timers, t)
+	}
+	t.deadline = c.now.Add(d)
+	t.active = true
+	c.armed.Broadcast()
+	return wasActive
+}
+
+// registered has to be called with the clock's mutex held
+func (t *fakeTimer) registered() bool {
+	for _, other := range t.clock.timers {
+		if other == t {
+			return true
+		}
+	}
+	return false
+}
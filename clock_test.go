@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFakeClock_Advance_GivenTimers_OnlyDueTimersFire(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	due := clock.NewTimer(time.Second)
+	notDue := clock.NewTimer(2 * time.Second)
+
+	clock.Advance(time.Second)
+
+	assert.Equal(t, schedulerEpoch.Add(time.Second), clock.Now())
+	assert.Len(t, due.C(), 1)
+	assert.Len(t, notDue.C(), 0)
+	assert.False(t, due.Stop())
+	assert.True(t, notDue.Stop())
+}
+
+func TestFakeClock_Advance_GivenStoppedTimer_TimerDoesNotFire(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	timer := clock.NewTimer(time.Second)
+	timer.Stop()
+
+	clock.Advance(time.Hour)
+
+	assert.Len(t, timer.C(), 0)
+}
+
+func TestFakeClock_BlockUntil_GivenTimerArmedLater_FuncWaitsForIt(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	timer := clock.NewTimer(time.Second)
+	timer.Stop()
+
+	go timer.Reset(time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	assert.Equal(t, schedulerEpoch.Add(time.Second), <-timer.C())
+}
@@ -2,49 +2,263 @@ package main
 
 import (
 	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io/ioutil"
+	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 type Controller struct {
-	mainService   *Service
-	tickerService *TickerService
-	writerService *MeasurementsWriterService
-	startOnce     sync.Once
+	mainService       *Service
+	tickerService     *TickerService
+	writerService     *MeasurementsWriterService
+	measurementReader MeasurementReader
+	hub               *MeasurementHub
+	queue             *MeasurementQueue
+	clock             Clock
+	// nil unless the pipeline runs on virtual time
+	simulation *Simulation
+
+	jobs *JobManager
+	// where the jobs leave their files, like the exports
+	jobsDir  string
+	stateDao PipelineStateDao
+	// nil when the API isn't authenticated
+	auth *Authenticator
+	// nil when the requests aren't rate limited
+	limiter    *RateLimiter
+	bodyLimits BodyLimits
+	// nil when the changes aren't recorded
+	audit *AuditLog
+
+	// the pipeline lives as long as the application does, Close cancels it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// held for the whole start, so that the pipeline is started only once
+	startMutex sync.Mutex
+	// held from checking that a scenario isn't running until its job has started,
+	// so that a scenario losing the race doesn't leave its devices behind
+	scenarioMutex sync.Mutex
+
+	// counts the stops, a start asked for before the latest stop is given up
+	stops uint64
+
+	// the sinks keep reading the queue once started, a restart of the pipeline only restarts the devices
+	sinksStarted bool
+
+	mutex    sync.Mutex
+	running  bool
+	starting bool
+	// why the last start failed
+	startErr error
 }
 
-func NewController(mainService *Service) *Controller {
-	return &Controller{
-		mainService:   mainService,
-		tickerService: NewTickerService(),
-		writerService: NewMeasurementsWriterService(os.Getenv("INFLUXDB_URL"),
-			os.Getenv("INFLUXDB_NAME")),
-		startOnce: sync.Once{},
+type PipelineStatus struct {
+	Running      bool              `json:"running"`
+	Starting     bool              `json:"starting,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	SkippedTicks uint64            `json:"skippedTicks"`
+	Queue        *QueueStatus      `json:"queue,omitempty"`
+	Simulation   *SimulationStatus `json:"simulation,omitempty"`
+}
+
+func NewController(mainService *Service, jobDao JobDao, stateDao PipelineStateDao, keyDao ApiKeyDao, auditDao AuditDao) *Controller {
+	influxConfig := influxConfigFromEnv()
+	var clock Clock = SystemClock{}
+	var simulation *Simulation
+	if config := simulationConfigFromEnv(); config != nil {
+		simulation = NewSimulation(*config)
+		clock = simulation
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	retention := jobsRetentionFromEnv()
+	c := &Controller{
+		mainService:       mainService,
+		tickerService:     NewTickerService(clock),
+		writerService:     NewMeasurementsWriterService(influxConfig, clock),
+		measurementReader: NewInfluxMeasurementReader(influxConfig),
+		hub:               newMeasurementHubFromEnv(),
+		queue:             newMeasurementQueueFromEnv(),
+		clock:             clock,
+		simulation:        simulation,
+		jobs:              NewJobManager(jobDao),
+		jobsDir:           jobsDirFromEnv(),
+		stateDao:          stateDao,
+		auth:              newAuthenticatorFromEnv(keyDao),
+		limiter:           newRateLimiterFromEnv(),
+		bodyLimits:        bodyLimitsFromEnv(),
+		audit:             NewAuditLog(auditDao),
+		ctx:               ctx,
+		cancel:            cancel,
 	}
+	go c.sweepJobFiles(retention)
+	return c
 }
 
-func (c *Controller) StartTickerService(ctx context.Context) error {
-	var err error
-	c.startOnce.Do(func() {
-		err = c.startTickerService(ctx)
-		if err != nil {
+// sweepJobFiles removes the expired files of the jobs right away, which takes care of the ones left behind
+// by a restart, and then every jobFilesSweepInterval until the controller is closed
+func (c *Controller) sweepJobFiles(retention time.Duration) {
+	for {
+		if removed, err := c.jobs.RemoveExpiredFiles(retention, c.ctx); err != nil {
+			log.Printf("could not remove the expired job files: %s", err.Error())
+		} else if removed > 0 {
+			log.Printf("removed %d expired job files", removed)
+		}
+		select {
+		case <-time.After(jobFilesSweepInterval):
+		case <-c.ctx.Done():
 			return
 		}
-	})
+	}
+}
+
+// StartPipeline starts the pipeline in the background and returns right away with its status,
+// the start doesn't depend on the request which has triggered it. The pipeline is started again after a restart
+// when the autostart is on. The start is recorded once it has succeeded, asking for a pipeline which is running
+// or starting already records nothing
+func (c *Controller) StartPipeline(ctx context.Context) (PipelineStatus, error) {
+	before := c.pipelineSnapshot(ctx)
+	if err := c.stateDao.SetDesiredState(pipelineRunning, ctx); err != nil {
+		return PipelineStatus{}, err
+	}
+	source := auditSourceFrom(ctx)
+	c.mutex.Lock()
+	if !c.running && !c.starting {
+		c.starting = true
+		stops := c.stops
+		go func() {
+			if err := c.startUnlessStopped(stops); err != nil {
+				log.Printf("could not start the pipeline: %s", err.Error())
+				return
+			}
+			// the request is over by now
+			c.audit.Record(source, auditPipelineStart, nil, before, c.pipelineSnapshot(c.ctx))
+		}()
+	}
+	c.mutex.Unlock()
+	return c.Status(), nil
+}
+
+// StartTickerService starts the pipeline and waits until it is running, a pipeline which is running already is left as it is
+func (c *Controller) StartTickerService() error {
+	return c.startUnlessStopped(c.stopCount())
+}
+
+// startUnlessStopped starts the pipeline unless it has been stopped since there were as many stops as given,
+// a start which has waited for the lock doesn't undo a stop which got there first
+func (c *Controller) startUnlessStopped(stops uint64) error {
+	c.startMutex.Lock()
+	defer c.startMutex.Unlock()
+	c.mutex.Lock()
+	if c.running {
+		c.mutex.Unlock()
+		return nil
+	}
+	if c.stops != stops {
+		// the stop has already cleared the starting flag, it may belong to a later start by now
+		c.mutex.Unlock()
+		return ErrPipelineStopped("")
+	}
+	if err := c.ctx.Err(); err != nil {
+		// the application is shutting down
+		c.starting = false
+		c.mutex.Unlock()
+		return err
+	}
+	c.starting = true
+	c.mutex.Unlock()
+
+	err := c.startTickerService(c.ctx)
+
+	c.mutex.Lock()
+	c.starting = false
+	c.running = err == nil
+	c.startErr = err
+	c.mutex.Unlock()
 	return err
 }
 
+func (c *Controller) stopCount() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stops
+}
+
 func (c *Controller) startTickerService(ctx context.Context) error {
 	devices, err := c.mainService.GetAllDevices(ctx)
 	if err != nil {
 		return err
 	}
 
-	publish := make(chan Measurement)
-	c.tickerService.Start(devices, publish)
-	err = c.writerService.Start(publish)
+	if c.sinksStarted {
+		c.tickerService.Start(devices, c.queue)
+		return nil
+	}
+	// the queue is only read once the writer is there to take what comes out of it,
+	// the buffer lets the writer take the measurements in batches
+	forwarded := make(chan Measurement, maxWriteBatch)
+	if err = c.writerService.Start(forwarded); err != nil {
+		return err
+	}
+	c.hub.Forward(c.queue.C(), forwarded)
+	c.sinksStarted = true
+	c.tickerService.Start(devices, c.queue)
 
-	return err
+	if c.simulation != nil {
+		// the devices stop once the virtual time is over, whatever they have produced still gets written
+		c.simulation.Begin(c.finishSimulation)
+	}
+	return nil
+}
+
+// finishSimulation stops the devices at the end of the simulation, nobody has asked for it so it is put down to the system
+func (c *Controller) finishSimulation() {
+	before := c.pipelineSnapshot(c.ctx)
+	c.tickerService.Finish()
+	c.audit.Record(AuditSource{Actor: auditSystem}, auditPipelineStop, nil, before, c.pipelineSnapshot(c.ctx))
+}
+
+// Close stops the devices and releases what the pipeline holds, it is called once the application is shutting down
+func (c *Controller) Close() {
+	c.startMutex.Lock()
+	defer c.startMutex.Unlock()
+	c.cancel()
+	c.mutex.Lock()
+	running := c.running
+	c.running = false
+	c.mutex.Unlock()
+
+	if running {
+		c.tickerService.Stop()
+	}
+	if c.writerService != nil {
+		_ = c.writerService.Close()
+	}
+}
+
+func (c *Controller) Status() PipelineStatus {
+	c.mutex.Lock()
+	status := PipelineStatus{Running: c.running, Starting: c.starting}
+	if c.startErr != nil {
+		status.Error = c.startErr.Error()
+	}
+	c.mutex.Unlock()
+
+	if c.tickerService != nil {
+		status.SkippedTicks = c.tickerService.SkippedTicks()
+	}
+	if c.queue != nil {
+		queueStatus := c.queue.Status()
+		status.Queue = &queueStatus
+	}
+	if c.simulation != nil {
+		simulationStatus := c.simulation.Status()
+		status.Simulation = &simulationStatus
+	}
+	return status
 }
 
 func (c *Controller) GetDevice(id string, ctx context.Context) (*Device, error) {
@@ -52,9 +266,339 @@ func (c *Controller) GetDevice(id string, ctx context.Context) (*Device, error)
 }
 
 func (c *Controller) AddDevice(devPayload *DevicePayload, ctx context.Context) (*Device, error) {
-	return c.mainService.AddDevice(devPayload, ctx)
+	device, err := c.mainService.AddDevice(devPayload, ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.audit.RecordCreated(auditSourceFrom(ctx), []*Device{device})
+	return device, nil
+}
+
+func (c *Controller) AddDevices(payloads []DevicePayload, atomic bool, ctx context.Context) (*BulkResult, error) {
+	return c.addDevices(payloads, atomic, auditSourceFrom(ctx), ctx)
+}
+
+// addDevices records the devices which were created, whoever has asked for them
+func (c *Controller) addDevices(payloads []DevicePayload, atomic bool, source AuditSource, ctx context.Context) (*BulkResult, error) {
+	result, err := c.mainService.AddDevices(payloads, atomic, ctx)
+	if result != nil {
+		created := make([]*Device, 0, result.Created)
+		for _, item := range result.Items {
+			if item.Device != nil {
+				created = append(created, item.Device)
+			}
+		}
+		c.audit.RecordCreated(source, created)
+	}
+	return result, err
 }
 
-func (c *Controller) GetPaginatedDevices(limit, page int, ctx context.Context) ([]Device, error) {
-	return c.mainService.GetPaginatedDevices(limit, page, ctx)
+func (c *Controller) GetPaginatedDevices(limit, page int, query *DeviceQuery, ctx context.Context) ([]Device, int64, error) {
+	return c.mainService.GetPaginatedDevices(limit, page, query, ctx)
+}
+
+func (c *Controller) GetDevicesByCursor(query *DeviceQuery, token string, limit int, ctx context.Context) (*DeviceCursorPage, error) {
+	return c.mainService.GetDevicesByCursor(query, token, limit, ctx)
+}
+
+func (c *Controller) ExportDevices(query *DeviceQuery, fn func(*Device) error, ctx context.Context) error {
+	return c.mainService.ExportDevices(query, fn, ctx)
+}
+
+// StartGroup starts ticking for the devices of the group which aren't ticking yet, it requires the pipeline to be running
+func (c *Controller) StartGroup(group string, ctx context.Context) (int, error) {
+	devices, err := c.mainService.GetDevicesInGroup(group, ctx)
+	if err != nil {
+		return 0, err
+	}
+	before := c.pipelineSnapshot(ctx)
+	started, err := c.tickerService.StartDevices(devices)
+	if err != nil {
+		return 0, err
+	}
+	c.audit.RecordGroup(auditSourceFrom(ctx), auditGroupStart, group, before, c.pipelineSnapshot(ctx))
+	return started, nil
+}
+
+func (c *Controller) StopGroup(group string, ctx context.Context) (int, error) {
+	devices, err := c.mainService.GetDevicesInGroup(group, ctx)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]primitive.ObjectID, len(devices))
+	for i := range devices {
+		ids[i] = devices[i].Id
+	}
+	before := c.pipelineSnapshot(ctx)
+	stopped := c.tickerService.StopDevices(ids)
+	c.audit.RecordGroup(auditSourceFrom(ctx), auditGroupStop, group, before, c.pipelineSnapshot(ctx))
+	return stopped, nil
+}
+
+func (c *Controller) GetMeasurements(id string, query *MeasurementQuery, ctx context.Context) ([]MeasurementPoint, error) {
+	device, err := c.mainService.GetDevice(id, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	query.DeviceId = device.Id
+	return c.measurementReader.ReadMeasurements(query, ctx)
+}
+
+// StartDevice starts ticking for a single device, it requires the pipeline to be running
+func (c *Controller) StartDevice(id string, ctx context.Context) error {
+	device, err := c.mainService.GetDevice(id, ctx)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return mongo.ErrNoDocuments
+	}
+	_, err = c.tickerService.StartDevices([]Device{*device})
+	return err
+}
+
+func (c *Controller) StopDevice(id string) error {
+	objectID, err := stringIDToObjectID(id)
+	if err != nil {
+		return ErrValidation("")
+	}
+	c.tickerService.StopDevices([]primitive.ObjectID{objectID})
+	return nil
+}
+
+// SetDeviceValue stores the new value, a running device starts publishing it right away
+func (c *Controller) SetDeviceValue(id string, value float64, ctx context.Context) (*Device, error) {
+	return c.setDeviceValue(id, value, auditSourceFrom(ctx), ctx)
+}
+
+// setDeviceValue puts the change down to the given source, a change made in the background has its own
+func (c *Controller) setDeviceValue(id string, value float64, source AuditSource, ctx context.Context) (*Device, error) {
+	return c.updateDevice(id, func() (*Device, error) {
+		return c.mainService.SetDeviceValue(id, value, ctx)
+	}, source, ctx)
+}
+
+// SetDeviceFaults stores the faults, a running device starts misbehaving right away. Nil clears them
+func (c *Controller) SetDeviceFaults(id string, faults *DeviceFaults, ctx context.Context) (*Device, error) {
+	return c.setDeviceFaults(id, faults, auditSourceFrom(ctx), ctx)
+}
+
+func (c *Controller) setDeviceFaults(id string, faults *DeviceFaults, source AuditSource, ctx context.Context) (*Device, error) {
+	return c.updateDevice(id, func() (*Device, error) {
+		return c.mainService.SetDeviceFaults(id, faults, ctx)
+	}, source, ctx)
+}
+
+// updateDevice records the device as it was before the update and after it, then hands it over to the ticker
+func (c *Controller) updateDevice(id string, update func() (*Device, error), source AuditSource, ctx context.Context) (*Device, error) {
+	var before *AuditSnapshot
+	if c.audit != nil {
+		device, err := c.mainService.GetDevice(id, ctx)
+		if err != nil {
+			return nil, err
+		}
+		before = deviceSnapshot(device)
+	}
+	device, err := update()
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	c.audit.Record(source, auditDeviceUpdate, &device.Id, before, deviceSnapshot(device))
+	return device, c.tickerService.RestartDevice(*device)
+}
+
+// SubscribeDevice streams the measurements of a single device, the subscription has to be released with Unsubscribe
+func (c *Controller) SubscribeDevice(id string, ctx context.Context) (*Subscription, error) {
+	device, err := c.mainService.GetDevice(id, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	return c.hub.Subscribe(deviceFilter(device.Id)), nil
+}
+
+// Subscribe streams the measurements of all the devices having the labels from the selector
+func (c *Controller) Subscribe(selector map[string]string) *Subscription {
+	return c.hub.Subscribe(labelsFilter(selector))
+}
+
+func (c *Controller) Unsubscribe(sub *Subscription) {
+	c.hub.Unsubscribe(sub)
+}
+
+// RunScenario provisions the devices of the scenario and goes through its timeline as a job,
+// the pipeline has to be running already. A scenario runs once at a time
+func (c *Controller) RunScenario(scenario *Scenario, ctx context.Context) (*ScenarioRun, error) {
+	if !c.Status().Running {
+		return nil, ErrPipelineNotRunning("")
+	}
+	c.scenarioMutex.Lock()
+	defer c.scenarioMutex.Unlock()
+	if c.jobs.IsRunning(jobScenario, scenario.Name) {
+		return nil, ErrJobRunning("scenario " + scenario.Name)
+	}
+	runner := &scenarioRunner{controller: c, clock: c.clock, scenario: scenario, source: auditSourceFrom(ctx)}
+	if err := runner.provision(ctx); err != nil {
+		return nil, err
+	}
+
+	started := c.clock.Now()
+	run := &ScenarioRun{Name: scenario.Name, Devices: runner.ids, StartedAt: started, Events: len(scenario.Timeline)}
+	job, err := c.jobs.Start(jobScenario, scenario.Name, func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		return run, runner.run(started, progress, ctx)
+	}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	run.JobId = job.Id.Hex()
+	return run, nil
+}
+
+// AddDevicesInBackground adds the devices as a job, the job's result is the BulkResult
+func (c *Controller) AddDevicesInBackground(payloads []DevicePayload, atomic bool, ctx context.Context) (*Job, error) {
+	source := auditSourceFrom(ctx)
+	return c.jobs.Start(jobBulkImport, "", func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		return c.addDevicesInBatches(payloads, atomic, source, progress, ctx)
+	}, ctx)
+}
+
+// addDevicesInBatches reports the progress after every batch, the devices of the batches before a failure stay.
+// An atomic import is a single batch, it is rolled back as a whole
+func (c *Controller) addDevicesInBatches(payloads []DevicePayload, atomic bool, source AuditSource, progress *JobProgress, ctx context.Context) (*BulkResult, error) {
+	if atomic {
+		return c.addDevices(payloads, atomic, source, ctx)
+	}
+	merged := &BulkResult{Items: make([]BulkItemResult, 0, len(payloads))}
+	for start := 0; start < len(payloads); start += bulkImportBatch {
+		if err := ctx.Err(); err != nil {
+			return merged, err
+		}
+		end := start + bulkImportBatch
+		if end > len(payloads) {
+			end = len(payloads)
+		}
+		result, err := c.addDevices(payloads[start:end], false, source, ctx)
+		if err != nil {
+			return merged, err
+		}
+		for _, item := range result.Items {
+			item.Index += start
+			merged.Items = append(merged.Items, item)
+		}
+		merged.Created += result.Created
+		merged.Failed += result.Failed
+		progress.Set(float64(end) / float64(len(payloads)))
+	}
+	return merged, nil
+}
+
+// ExportDevicesInBackground writes the export into a file of the job, it can be downloaded once the job is done
+func (c *Controller) ExportDevicesInBackground(query *DeviceQuery, format string, withIds bool, ctx context.Context) (*Job, error) {
+	// the format is checked before there's a job
+	if _, err := newDeviceExporter(ioutil.Discard, format, withIds); err != nil {
+		return nil, err
+	}
+	return c.jobs.Start(jobExport, "", func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		return exportDevicesToFile(c.mainService, c.jobsDir, query, format, withIds, progress, ctx)
+	}, ctx)
+}
+
+// Backfill writes the measurements the device would have produced over the time range as a job,
+// a device has only one backfill running at a time
+func (c *Controller) Backfill(id string, request *BackfillRequest, ctx context.Context) (*Job, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	device, err := c.mainService.GetDevice(id, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return c.jobs.Start(jobBackfill, device.Id.Hex(), func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		return runBackfill(*device, *request, c.writerService, progress, ctx)
+	}, ctx)
+}
+
+// GetBackfill returns the latest backfill job of the device
+func (c *Controller) GetBackfill(id string, ctx context.Context) (*Job, error) {
+	objectID, err := stringIDToObjectID(id)
+	if err != nil {
+		return nil, ErrValidation("")
+	}
+	return c.jobs.Latest(jobBackfill, objectID.Hex(), ctx)
+}
+
+// CancelBackfill stops the running backfill of the device, whatever has been written so far stays
+func (c *Controller) CancelBackfill(id string, ctx context.Context) (*Job, error) {
+	job, err := c.GetBackfill(id, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.jobs.Cancel(job.Id.Hex(), ctx)
+}
+
+func (c *Controller) GetJobs(query *JobQuery, limit int, ctx context.Context) ([]Job, error) {
+	return c.jobs.List(query, limit, ctx)
+}
+
+func (c *Controller) GetJob(id string, ctx context.Context) (*Job, error) {
+	return c.jobs.Get(id, ctx)
+}
+
+func (c *Controller) CancelJob(id string, ctx context.Context) (*Job, error) {
+	return c.jobs.Cancel(id, ctx)
+}
+
+// OpenJobFile opens the file left by the job, the caller closes it
+func (c *Controller) OpenJobFile(id string, ctx context.Context) (*Job, *os.File, error) {
+	job, err := c.jobs.Get(id, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if job.State == jobRunning {
+		return nil, nil, ErrJobRunning(job.Type + " " + id)
+	}
+	// the file of a job which hasn't got done is only partly written
+	if job.File == "" || job.State != jobDone {
+		return nil, nil, mongo.ErrNoDocuments
+	}
+	file, err := os.Open(job.File)
+	if os.IsNotExist(err) {
+		return nil, nil, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return job, file, nil
+}
+
+func (c *Controller) CreateApiKey(request *ApiKeyRequest, ctx context.Context) (*NewApiKey, error) {
+	return c.auth.CreateApiKey(request, ctx)
+}
+
+func (c *Controller) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	return c.auth.GetApiKeys(ctx)
+}
+
+func (c *Controller) RevokeApiKey(id string, ctx context.Context) (*ApiKey, error) {
+	return c.auth.RevokeApiKey(id, ctx)
+}
+
+// GetAuditEvents returns the latest events first
+func (c *Controller) GetAuditEvents(query *AuditQuery, ctx context.Context) ([]AuditEvent, error) {
+	if c.audit == nil {
+		return []AuditEvent{}, nil
+	}
+	return c.audit.Query(query, ctx)
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/influxdata/influxdb1-client/v2"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
 	"testing"
 )
 
@@ -29,16 +32,142 @@ func TestController_GetPaginatedDevices_GivenDaoError_ControllerReturnsError(t *
 	out := NewService(&mockDao{returnErr: ErrDao("")})
 	c := Controller{mainService: out}
 
-	_, err := c.GetPaginatedDevices(0, 2, context.TODO())
+	_, _, err := c.GetPaginatedDevices(0, 2, &DeviceQuery{}, context.TODO())
 
 	assert.Equal(t, ErrDao(""), err)
 }
 
 func TestController_StartTickerService_GivenDaoError_ControllerReturnsError(t *testing.T) {
 	out := NewService(&mockDao{returnErr: ErrDao("")})
-	c := Controller{mainService: out}
+	c := Controller{mainService: out, ctx: context.Background()}
 
-	err := c.StartTickerService(context.TODO())
+	err := c.StartTickerService()
 
 	assert.Equal(t, ErrDao(""), err)
+	assert.False(t, c.Status().Running)
+	assert.Equal(t, ErrDao("").Error(), c.Status().Error)
+}
+
+func TestController_StartPipeline_GivenDevices_PipelineStartsInTheBackgroundOnce(t *testing.T) {
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086"}, SystemClock{})
+	mws.writerClient = &mockInfluxClient{written: make(chan client.BatchPoints, 16)}
+	c := &Controller{
+		mainService:   NewService(&mockDao{data: []Device{device}}),
+		tickerService: NewTickerService(SystemClock{}),
+		writerService: mws,
+		hub:           NewMeasurementHub(1, DropMeasurements),
+		queue:         NewMeasurementQueue(1, DropNewest),
+		stateDao:      &mockPipelineStateDao{},
+		ctx:           context.Background(),
+		cancel:        func() {},
+	}
+
+	first, err := c.StartPipeline(context.TODO())
+	assert.NoError(t, err)
+	assert.NoError(t, c.StartTickerService())
+	second, err := c.StartPipeline(context.TODO())
+	assert.NoError(t, err)
+	c.Close()
+
+	assert.True(t, first.Starting || first.Running)
+	assert.True(t, second.Running)
+	assert.False(t, c.Status().Running)
+	assert.False(t, c.tickerService.IsRunning(device.Id))
+}
+
+func TestController_StartGroup_GivenPipelineNotRunning_ControllerReturnsError(t *testing.T) {
+	c := Controller{mainService: NewService(&mockDao{data: []Device{{Id: primitive.NewObjectID()}}}), tickerService: NewTickerService(SystemClock{})}
+
+	_, err := c.StartGroup("floor-1", context.TODO())
+
+	assert.Equal(t, ErrPipelineNotRunning(""), err)
+}
+
+func TestController_StartGroupAndStopGroup_GivenRunningPipeline_ControllerControlsGroupTickers(t *testing.T) {
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000, Groups: []string{"floor-1"}}
+	c := Controller{mainService: NewService(&mockDao{data: []Device{device}}), tickerService: NewTickerService(SystemClock{})}
+	c.tickerService.Start(nil, NewMeasurementQueue(1, Block))
+
+	started, err := c.StartGroup("floor-1", context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, started)
+	assert.True(t, c.tickerService.IsRunning(device.Id))
+
+	stopped, err := c.StopGroup("floor-1", context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stopped)
+	assert.False(t, c.tickerService.IsRunning(device.Id))
+}
+
+func TestController_AddDevicesInBackground_GivenMoreThanABatch_DevicesAreAddedBatchByBatch(t *testing.T) {
+	dao := &mockDao{}
+	c := &Controller{mainService: NewService(dao), jobs: NewJobManager(newMockJobDao())}
+	payloads := make([]DevicePayload, 2*bulkImportBatch+1)
+	for i := range payloads {
+		payloads[i] = DevicePayload{Name: "device", Interval: 1000}
+	}
+
+	job, err := c.AddDevicesInBackground(payloads, false, context.Background())
+	assert.NoError(t, err)
+	c.jobs.wait(job.Id)
+	job, err = c.GetJob(job.Id.Hex(), context.Background())
+	assert.NoError(t, err)
+	var result BulkResult
+	assert.NoError(t, json.Unmarshal(job.Result, &result))
+
+	assert.Equal(t, 3, dao.calledTimes)
+	assert.Equal(t, 1.0, job.Progress)
+	assert.Equal(t, len(payloads), result.Created)
+	assert.Equal(t, len(payloads)-1, result.Items[len(payloads)-1].Index)
+}
+
+func TestController_RunScenario_GivenConcurrentRuns_DevicesAreProvisionedOnce(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID(), Interval: 1000}}
+	c := Controller{mainService: NewService(dao), tickerService: NewTickerService(clock), clock: clock, jobs: NewJobManager(newMockJobDao()), running: true}
+	c.tickerService.Start(nil, NewMeasurementQueue(1, DropNewest))
+	scenario, err := LoadScenario(strings.NewReader(testScenario))
+	assert.NoError(t, err)
+
+	runs := make(chan *ScenarioRun, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			run, _ := c.RunScenario(scenario, context.TODO())
+			runs <- run
+		}()
+	}
+	first, second := <-runs, <-runs
+	for _, run := range []*ScenarioRun{first, second} {
+		if run != nil {
+			_, _ = c.CancelJob(run.JobId, context.TODO())
+		}
+	}
+
+	assert.True(t, (first == nil) != (second == nil))
+	assert.Equal(t, 1, dao.calledTimes)
+}
+
+func TestController_RunScenario_GivenRunningPipeline_TimelineRunsAsAJobWhichCanBeCancelled(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID(), Interval: 1000}}
+	c := Controller{mainService: NewService(dao), tickerService: NewTickerService(clock), clock: clock, jobs: NewJobManager(newMockJobDao()), running: true}
+	c.tickerService.Start(nil, NewMeasurementQueue(1, DropNewest))
+	scenario, err := LoadScenario(strings.NewReader(testScenario))
+	assert.NoError(t, err)
+
+	run, err := c.RunScenario(scenario, context.TODO())
+	assert.NoError(t, err)
+	_, again := c.RunScenario(scenario, context.TODO())
+	_, err = c.CancelJob(run.JobId, context.TODO())
+	assert.NoError(t, err)
+	id, _ := primitive.ObjectIDFromHex(run.JobId)
+	c.jobs.wait(id)
+	job, err := c.GetJob(run.JobId, context.TODO())
+
+	assert.NoError(t, err)
+	assert.IsType(t, ErrJobRunning(""), again)
+	assert.Equal(t, jobScenario, job.Type)
+	assert.Equal(t, "cold-storage", job.Target)
+	assert.Equal(t, jobCancelled, job.State)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+)
+
+const (
+	cursorNext = "n"
+	cursorPrev = "p"
+)
+
+// DeviceCursor points right after (or right before, when Before is set) the device with the given id
+type DeviceCursor struct {
+	Id     primitive.ObjectID
+	Before bool
+}
+
+// DeviceCursorPage is the response envelope of cursor based pagination,
+// empty Next or Prev means there is nothing more in that direction
+type DeviceCursorPage struct {
+	Data  []Device          `json:"data"`
+	Next  string            `json:"next,omitempty"`
+	Prev  string            `json:"prev,omitempty"`
+	Links DeviceCursorLinks `json:"links"`
+}
+
+type DeviceCursorLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// tokens are opaque to the clients, they should only ever pass back what they got
+func encodeCursor(cursor DeviceCursor) string {
+	direction := cursorNext
+	if cursor.Before {
+		direction = cursorPrev
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(direction + ":" + cursor.Id.Hex()))
+}
+
+// decodeCursor returns nil for an empty token which stands for the first page
+func decodeCursor(token string) (*DeviceCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrValidation("malformed cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 || (parts[0] != cursorNext && parts[0] != cursorPrev) {
+		return nil, ErrValidation("malformed cursor")
+	}
+	id, err := stringIDToObjectID(parts[1])
+	if err != nil {
+		return nil, ErrValidation("malformed cursor")
+	}
+	return &DeviceCursor{Id: id, Before: parts[0] == cursorPrev}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func Test_DecodeCursor_GivenEncodedCursor_FuncReturnsTheSameCursor(t *testing.T) {
+	tests := map[string]DeviceCursor{
+		"next": {Id: primitive.NewObjectID()},
+		"prev": {Id: primitive.NewObjectID(), Before: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cursor, err := decodeCursor(encodeCursor(tc))
+
+			assert.NoError(t, err)
+			assert.Equal(t, &tc, cursor)
+		})
+	}
+}
+
+func Test_DecodeCursor_GivenEmptyToken_FuncReturnsNil(t *testing.T) {
+	cursor, err := decodeCursor("")
+
+	assert.NoError(t, err)
+	assert.Nil(t, cursor)
+}
+
+func Test_DecodeCursor_GivenMalformedToken_FuncReturnsErrValidation(t *testing.T) {
+	encode := base64.RawURLEncoding.EncodeToString
+	tests := map[string]string{
+		"not base64":        "!!!",
+		"no direction":      encode([]byte(primitive.NewObjectID().Hex())),
+		"unknown direction": encode([]byte("x:" + primitive.NewObjectID().Hex())),
+		"invalid id":        encode([]byte("n:abc")),
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeCursor(tc)
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
@@ -13,18 +13,30 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"time"
 )
 
 type Dao struct {
 	mongoClient *mongo.Client
 	collection  *mongo.Collection
+	jobs        *mongo.Collection
+	settings    *mongo.Collection
+	apiKeys     *mongo.Collection
+	audit       *mongo.Collection
 }
 
 type DeviceDao interface {
 	AddDevice(device *DevicePayload, ctx context.Context) (primitive.ObjectID, error)
+	AddDevices(devices []*DevicePayload, ordered bool, ctx context.Context) ([]primitive.ObjectID, error)
+	DeleteDevices(ids []primitive.ObjectID, ctx context.Context) error
 	GetDevice(id primitive.ObjectID, ctx context.Context) (*Device, error)
-	GetPaginatedDevices(limit, page int, ctx context.Context) ([]Device, error)
+	UpdateDeviceValue(id primitive.ObjectID, value float64, ctx context.Context) (*Device, error)
+	UpdateDeviceFaults(id primitive.ObjectID, faults *DeviceFaults, ctx context.Context) (*Device, error)
+	GetPaginatedDevices(limit, page int, query *DeviceQuery, ctx context.Context) ([]Device, error)
+	CountDevices(query *DeviceQuery, ctx context.Context) (int64, error)
+	GetDevicesByCursor(query *DeviceQuery, cursor *DeviceCursor, limit int, ctx context.Context) ([]Device, error)
 	GetAllDevices(ctx context.Context) ([]Device, error)
+	StreamDevices(query *DeviceQuery, fn func(*Device) error, ctx context.Context) error
 }
 
 func NewDao() *Dao {
@@ -41,8 +53,13 @@ func NewDao() *Dao {
 	dao := &Dao{
 		mongoClient: client,
 		collection:  collection,
+		jobs:        client.Database(mongodbNAME).Collection("jobs"),
+		settings:    client.Database(mongodbNAME).Collection("settings"),
+		apiKeys:     client.Database(mongodbNAME).Collection("apiKeys"),
+		audit:       client.Database(mongodbNAME).Collection("audit"),
 	}
 	dao.connect(context.Background())
+	dao.ensureIndexes(context.Background())
 	return dao
 }
 
@@ -57,13 +74,45 @@ func (db *Dao) connect(ctx context.Context) {
 	}
 }
 
-func (db *Dao) AddDevice(device *DevicePayload, ctx context.Context) (primitive.ObjectID, error) {
-	dev := Device{
-		Id:       primitive.NewObjectID(),
-		Name:     device.Name,
-		Value:    device.Value,
-		Interval: device.Interval,
+// indexes backing the filters and sort fields of DeviceQuery,
+// prefix searches on name use the name index as well
+func (db *Dao) ensureIndexes(ctx context.Context) {
+	_, err := db.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}}},
+		{Keys: bson.D{{Key: "interval", Value: 1}}},
+		{Keys: bson.D{{Key: "value", Value: 1}}},
+		{Keys: bson.D{{Key: "groups", Value: 1}}},
+	})
+	if err != nil {
+		log.Panicf("couldn't create indexes: %+v", err.Error())
+	}
+	_, err = db.jobs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "target", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+	})
+	if err != nil {
+		log.Panicf("couldn't create job indexes: %+v", err.Error())
+	}
+	opts := options.IndexOptions{}
+	_, err = db.apiKeys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: opts.SetUnique(true),
+	})
+	if err != nil {
+		log.Panicf("couldn't create api key indexes: %+v", err.Error())
 	}
+	_, err = db.audit.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "deviceId", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "timestamp", Value: -1}}},
+	})
+	if err != nil {
+		log.Panicf("couldn't create audit indexes: %+v", err.Error())
+	}
+}
+
+func (db *Dao) AddDevice(device *DevicePayload, ctx context.Context) (primitive.ObjectID, error) {
+	dev := newDeviceFromPayload(device)
 	result, err := db.collection.InsertOne(ctx, dev)
 	if err != nil {
 		log.Printf("%v was not added to db: %+v", dev, err.Error())
@@ -73,6 +122,52 @@ func (db *Dao) AddDevice(device *DevicePayload, ctx context.Context) (primitive.
 	return result.InsertedID.(primitive.ObjectID), nil
 }
 
+// AddDevices inserts all the devices with a single InsertMany, ids are returned for every device in the order given
+// regardless of whether it was written; the ones which weren't are reported through ErrBulkWrite.
+// An ordered insert stops at the first failure
+func (db *Dao) AddDevices(devices []*DevicePayload, ordered bool, ctx context.Context) ([]primitive.ObjectID, error) {
+	ids := make([]primitive.ObjectID, len(devices))
+	documents := make([]interface{}, len(devices))
+	for i, device := range devices {
+		dev := newDeviceFromPayload(device)
+		ids[i] = dev.Id
+		documents[i] = dev
+	}
+
+	opts := options.InsertManyOptions{}
+	_, err := db.collection.InsertMany(ctx, documents, opts.SetOrdered(ordered))
+	if bulkErr, ok := err.(mongo.BulkWriteException); ok {
+		failed := ErrBulkWrite{}
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr.Message
+		}
+		if ordered && len(failed) > 0 {
+			first := len(devices)
+			for index := range failed {
+				if index < first {
+					first = index
+				}
+			}
+			for i := first + 1; i < len(devices); i++ {
+				failed[i] = "not attempted after a preceding failure"
+			}
+		}
+		log.Printf("%d out of %d devices were not added to db: %+v", len(failed), len(devices), err.Error())
+		return ids, failed
+	}
+	if err != nil {
+		log.Printf("devices were not added to db: %+v", err.Error())
+		return ids, err
+	}
+
+	return ids, nil
+}
+
+func (db *Dao) DeleteDevices(ids []primitive.ObjectID, ctx context.Context) error {
+	_, err := db.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
 func (db *Dao) GetDevice(id primitive.ObjectID, ctx context.Context) (*Device, error) {
 	findResult := db.collection.FindOne(ctx, bson.M{"_id": id})
 	if err := findResult.Err(); err != nil {
@@ -85,6 +180,40 @@ func (db *Dao) GetDevice(id primitive.ObjectID, ctx context.Context) (*Device, e
 	return &dev, nil
 }
 
+// UpdateDeviceValue returns the device as it is after the update
+func (db *Dao) UpdateDeviceValue(id primitive.ObjectID, value float64, ctx context.Context) (*Device, error) {
+	opts := options.FindOneAndUpdateOptions{}
+	result := db.collection.FindOneAndUpdate(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"value": value}},
+		opts.SetReturnDocument(options.After))
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	var dev Device
+	if err := result.Decode(&dev); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// UpdateDeviceFaults clears the faults when given nil, it returns the device as it is after the update
+func (db *Dao) UpdateDeviceFaults(id primitive.ObjectID, faults *DeviceFaults, ctx context.Context) (*Device, error) {
+	update := bson.M{"$set": bson.M{"faults": faults}}
+	if faults == nil {
+		update = bson.M{"$unset": bson.M{"faults": ""}}
+	}
+	opts := options.FindOneAndUpdateOptions{}
+	result := db.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts.SetReturnDocument(options.After))
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	var dev Device
+	if err := result.Decode(&dev); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
 func (db *Dao) GetAllDevices(ctx context.Context) ([]Device, error) {
 	allDevices := make([]Device, 0)
 	cursor, err := db.collection.Find(ctx, bson.D{})
@@ -96,14 +225,37 @@ func (db *Dao) GetAllDevices(ctx context.Context) ([]Device, error) {
 	return allDevices, err
 }
 
-func (db *Dao) GetPaginatedDevices(limit, page int, ctx context.Context) ([]Device, error) {
+// StreamDevices walks through the devices with a cursor instead of loading them all into memory,
+// iteration stops at the first error returned by fn
+func (db *Dao) StreamDevices(query *DeviceQuery, fn func(*Device) error, ctx context.Context) error {
+	opts := options.FindOptions{}
+	cursor, err := db.collection.Find(ctx, deviceQueryFilter(query), opts.SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var dev Device
+		if err = cursor.Decode(&dev); err != nil {
+			return err
+		}
+		if err = fn(&dev); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (db *Dao) GetPaginatedDevices(limit, page int, query *DeviceQuery, ctx context.Context) ([]Device, error) {
 	lower, upper := setPageBoundsToInt64(limit, page)
 	paginatedDevices := make([]Device, 0)
 	opts := options.FindOptions{}
 
-	cursor, err := db.collection.Find(ctx, bson.D{},
+	cursor, err := db.collection.Find(ctx, deviceQueryFilter(query),
 		opts.SetSkip(lower),
-		opts.SetLimit(upper))
+		opts.SetLimit(upper-lower),
+		opts.SetSort(deviceQuerySort(query)))
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +264,330 @@ func (db *Dao) GetPaginatedDevices(limit, page int, ctx context.Context) ([]Devi
 	return paginatedDevices, err
 }
 
+func (db *Dao) CountDevices(query *DeviceQuery, ctx context.Context) (int64, error) {
+	return db.collection.CountDocuments(ctx, deviceQueryFilter(query))
+}
+
+// GetDevicesByCursor walks the collection by _id starting from the cursor, devices are returned
+// in the walking order, so when going backwards they come in descending order;
+// limit+1 documents are requested so that the caller can tell whether there is anything beyond the page
+func (db *Dao) GetDevicesByCursor(query *DeviceQuery, cursor *DeviceCursor, limit int, ctx context.Context) ([]Device, error) {
+	devices := make([]Device, 0)
+	filter := deviceQueryFilter(query)
+	direction := 1
+	if cursor != nil {
+		if cursor.Before {
+			direction = -1
+			filter["_id"] = bson.M{"$lt": cursor.Id}
+		} else {
+			filter["_id"] = bson.M{"$gt": cursor.Id}
+		}
+	}
+	opts := options.FindOptions{}
+
+	mongoCursor, err := db.collection.Find(ctx, filter,
+		opts.SetLimit(int64(limit+1)),
+		opts.SetSort(bson.D{{Key: "_id", Value: direction}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = mongoCursor.All(ctx, &devices)
+	return devices, err
+}
+
+// SaveJob replaces the whole job, inserting it the first time
+func (db *Dao) SaveJob(job *Job, ctx context.Context) error {
+	opts := options.ReplaceOptions{}
+	_, err := db.jobs.ReplaceOne(ctx, bson.M{"_id": job.Id}, job, opts.SetUpsert(true))
+	return err
+}
+
+// GetJob returns nil if there's no such job
+func (db *Dao) GetJob(id primitive.ObjectID, ctx context.Context) (*Job, error) {
+	findResult := db.jobs.FindOne(ctx, bson.M{"_id": id})
+	if err := findResult.Err(); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := findResult.Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (db *Dao) GetJobs(query *JobQuery, limit int, ctx context.Context) ([]Job, error) {
+	jobs := make([]Job, 0)
+	opts := options.FindOptions{}
+	cursor, err := db.jobs.Find(ctx, jobQueryFilter(query),
+		opts.SetLimit(int64(limit)),
+		opts.SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(ctx, &jobs)
+	return jobs, err
+}
+
+func (db *Dao) InterruptJobs(ctx context.Context) (int64, error) {
+	now := time.Now()
+	result, err := db.jobs.UpdateMany(ctx, bson.M{"state": jobRunning},
+		bson.M{"$set": bson.M{"state": jobInterrupted, "updatedAt": now, "finishedAt": now}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (db *Dao) GetExpiredJobFiles(finishedBefore time.Time, ctx context.Context) ([]Job, error) {
+	jobs := make([]Job, 0)
+	cursor, err := db.jobs.Find(ctx, expiredJobFilesFilter(finishedBefore))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &jobs)
+	return jobs, err
+}
+
+// the document in settings keeping the desired state of the pipeline
+const pipelineSettingsId = "pipeline"
+
+func (db *Dao) GetDesiredState(ctx context.Context) (string, error) {
+	var settings struct {
+		DesiredState string `bson:"desiredState"`
+	}
+	err := db.settings.FindOne(ctx, bson.M{"_id": pipelineSettingsId}).Decode(&settings)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	return settings.DesiredState, err
+}
+
+func (db *Dao) SetDesiredState(state string, ctx context.Context) error {
+	opts := options.UpdateOptions{}
+	_, err := db.settings.UpdateOne(ctx, bson.M{"_id": pipelineSettingsId},
+		bson.M{"$set": bson.M{"desiredState": state, "updatedAt": time.Now()}},
+		opts.SetUpsert(true))
+	return err
+}
+
+func (db *Dao) AddAuditEvents(events []AuditEvent, ctx context.Context) error {
+	documents := make([]interface{}, len(events))
+	for i := range events {
+		documents[i] = events[i]
+	}
+	_, err := db.audit.InsertMany(ctx, documents)
+	return err
+}
+
+func (db *Dao) GetAuditEvents(query *AuditQuery, ctx context.Context) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+	opts := options.FindOptions{}
+	cursor, err := db.audit.Find(ctx, auditQueryFilter(query),
+		opts.SetLimit(int64(query.Limit)),
+		opts.SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+func (db *Dao) AddApiKey(key *ApiKey, ctx context.Context) error {
+	_, err := db.apiKeys.InsertOne(ctx, key)
+	return err
+}
+
+func (db *Dao) GetApiKeyByHash(hash string, ctx context.Context) (*ApiKey, error) {
+	findResult := db.apiKeys.FindOne(ctx, bson.M{"hash": hash})
+	if err := findResult.Err(); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var key ApiKey
+	if err := findResult.Decode(&key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (db *Dao) GetApiKeys(ctx context.Context) ([]ApiKey, error) {
+	keys := make([]ApiKey, 0)
+	opts := options.FindOptions{}
+	cursor, err := db.apiKeys.Find(ctx, bson.D{}, opts.SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(ctx, &keys)
+	return keys, err
+}
+
+// RevokeApiKey returns nil if there's no such key, a key which is revoked already keeps its revocation time
+func (db *Dao) RevokeApiKey(id primitive.ObjectID, at time.Time, ctx context.Context) (*ApiKey, error) {
+	opts := options.FindOneAndUpdateOptions{}
+	result := db.apiKeys.FindOneAndUpdate(ctx, bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": at}},
+		opts.SetReturnDocument(options.After))
+	if err := result.Err(); err == mongo.ErrNoDocuments {
+		return db.getApiKey(id, ctx)
+	} else if err != nil {
+		return nil, err
+	}
+	var key ApiKey
+	if err := result.Decode(&key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (db *Dao) getApiKey(id primitive.ObjectID, ctx context.Context) (*ApiKey, error) {
+	findResult := db.apiKeys.FindOne(ctx, bson.M{"_id": id})
+	if err := findResult.Err(); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var key ApiKey
+	if err := findResult.Decode(&key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func newDeviceFromPayload(device *DevicePayload) Device {
+	return device.toDevice(primitive.NewObjectID())
+}
+
+func deviceQueryFilter(query *DeviceQuery) bson.M {
+	filter := bson.M{}
+	if query == nil {
+		return filter
+	}
+
+	name := bson.M{}
+	if query.Name != "" {
+		name["$eq"] = query.Name
+	}
+	if query.NamePrefix != "" {
+		name["$regex"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query.NamePrefix)}
+	}
+	if query.NameContains != "" {
+		// $regex can't be repeated within one field, chain it with $and instead
+		contains := bson.M{"name": primitive.Regex{Pattern: regexp.QuoteMeta(query.NameContains)}}
+		filter["$and"] = bson.A{contains}
+	}
+	if len(name) > 0 {
+		filter["name"] = name
+	}
+
+	interval := bson.M{}
+	if query.MinInterval != nil {
+		interval["$gte"] = *query.MinInterval
+	}
+	if query.MaxInterval != nil {
+		interval["$lte"] = *query.MaxInterval
+	}
+	if len(interval) > 0 {
+		filter["interval"] = interval
+	}
+
+	value := bson.M{}
+	if query.MinValue != nil {
+		value["$gte"] = *query.MinValue
+	}
+	if query.MaxValue != nil {
+		value["$lte"] = *query.MaxValue
+	}
+	if len(value) > 0 {
+		filter["value"] = value
+	}
+
+	// label names are restricted to characters which are safe to use in a dotted path
+	for key, labelValue := range query.Labels {
+		filter["labels."+key] = labelValue
+	}
+	if query.Group != "" {
+		filter["groups"] = query.Group
+	}
+
+	return filter
+}
+
+func auditQueryFilter(query *AuditQuery) bson.M {
+	filter := bson.M{}
+	if query == nil {
+		return filter
+	}
+	if query.DeviceId != nil {
+		filter["deviceId"] = *query.DeviceId
+	}
+	if query.Actor != "" {
+		filter["actor"] = query.Actor
+	}
+	timestamp := bson.M{}
+	if !query.From.IsZero() {
+		timestamp["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		timestamp["$lte"] = query.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter
+}
+
+func jobQueryFilter(query *JobQuery) bson.M {
+	filter := bson.M{}
+	if query == nil {
+		return filter
+	}
+	if query.Type != "" {
+		filter["type"] = query.Type
+	}
+	if query.Target != "" {
+		filter["target"] = query.Target
+	}
+	if query.State != "" {
+		filter["state"] = query.State
+	}
+	return filter
+}
+
+// expiredJobFilesFilter matches the jobs which still have a file and are either old or didn't get done
+func expiredJobFilesFilter(finishedBefore time.Time) bson.M {
+	return bson.M{
+		"file": bson.M{"$exists": true, "$ne": ""},
+		"$or": bson.A{
+			bson.M{"state": bson.M{"$in": bson.A{jobFailed, jobCancelled, jobInterrupted}}},
+			bson.M{"finishedAt": bson.M{"$lt": finishedBefore}},
+		},
+	}
+}
+
+// results are always ordered, _id breaks ties so that pages stay stable
+func deviceQuerySort(query *DeviceQuery) bson.D {
+	if query == nil || query.SortBy == "" {
+		return bson.D{{Key: "_id", Value: 1}}
+	}
+	direction := 1
+	if query.SortDesc {
+		direction = -1
+	}
+	field := deviceSortFields[query.SortBy]
+	sort := bson.D{{Key: field, Value: direction}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: 1})
+	}
+	return sort
+}
+
 func verifyMongoDBName(dbName string) error {
 	if !(len(dbName) < 64 && 0 < len(dbName)) {
 		return errors.New("db name must not be empty")
@@ -2,7 +2,10 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"testing"
+	"time"
 )
 
 func TestVerifyMongoDBName_DifferentLength(t *testing.T) {
@@ -53,3 +56,70 @@ func TestVerifyMongoDBName_GivenNameWithNotAllowedChars_FuncReturnsError(t *test
 		})
 	}
 }
+
+func TestDeviceQueryFilter_GivenQuery_FuncBuildsMatchingFilter(t *testing.T) {
+	minInterval := 100
+	maxValue := 2.5
+	query := &DeviceQuery{
+		Name:         "thermo",
+		NamePrefix:   "the.",
+		NameContains: "rm",
+		MinInterval:  &minInterval,
+		MaxValue:     &maxValue,
+		Labels:       map[string]string{"site": "lab1"},
+		Group:        "floor-1",
+	}
+
+	expected := bson.M{
+		"name": bson.M{
+			"$eq":    "thermo",
+			"$regex": primitive.Regex{Pattern: `^the\.`},
+		},
+		"$and":        bson.A{bson.M{"name": primitive.Regex{Pattern: "rm"}}},
+		"interval":    bson.M{"$gte": 100},
+		"value":       bson.M{"$lte": 2.5},
+		"labels.site": "lab1",
+		"groups":      "floor-1",
+	}
+
+	assert.Equal(t, expected, deviceQueryFilter(query))
+}
+
+func TestDeviceQueryFilter_GivenEmptyQuery_FuncReturnsEmptyFilter(t *testing.T) {
+	assert.Equal(t, bson.M{}, deviceQueryFilter(&DeviceQuery{}))
+	assert.Equal(t, bson.M{}, deviceQueryFilter(nil))
+}
+
+func TestDeviceQuerySort_GivenDifferentQueries_FuncReturnsStableSort(t *testing.T) {
+	tests := map[string]struct {
+		input    *DeviceQuery
+		expected bson.D
+	}{
+		"no sort":       {input: &DeviceQuery{}, expected: bson.D{{Key: "_id", Value: 1}}},
+		"by id desc":    {input: &DeviceQuery{SortBy: "id", SortDesc: true}, expected: bson.D{{Key: "_id", Value: -1}}},
+		"by name":       {input: &DeviceQuery{SortBy: "name"}, expected: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}},
+		"by value desc": {input: &DeviceQuery{SortBy: "value", SortDesc: true}, expected: bson.D{{Key: "value", Value: -1}, {Key: "_id", Value: 1}}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, deviceQuerySort(tc.input))
+		})
+	}
+}
+
+func TestAuditQueryFilter_GivenQuery_FuncBuildsMatchingFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	expected := bson.M{
+		"deviceId":  id,
+		"actor":     "admin",
+		"timestamp": bson.M{"$gte": from, "$lte": to},
+	}
+
+	assert.Equal(t, expected, auditQueryFilter(&AuditQuery{DeviceId: &id, Actor: "admin", From: from, To: to}))
+	assert.Equal(t, bson.M{"timestamp": bson.M{"$gte": from}}, auditQueryFilter(&AuditQuery{From: from}))
+	assert.Equal(t, bson.M{}, auditQueryFilter(&AuditQuery{}))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
 	"time"
 )
 
@@ -10,26 +12,57 @@ type Device struct {
 	Name     string             `json:"name"`
 	Value    float64            `json:"value"`
 	Interval int                `json:"interval"`
+	Unit     string             `json:"unit,omitempty"`
+	Labels   map[string]string  `json:"labels,omitempty"`
+	Groups   []string           `json:"groups,omitempty"`
+	// Jitter delays every tick by a random part of the interval, in percent
+	Jitter int `json:"jitter,omitempty"`
+	// Phase delays the first tick by the given number of milliseconds
+	Phase int `json:"phase,omitempty"`
+	// Cron replaces Interval when set
+	Cron      string          `json:"cron,omitempty"`
+	Generator *ValueGenerator `json:"generator,omitempty"`
+	Faults    *DeviceFaults   `json:"faults,omitempty"`
 }
 
+// Measurement is a single reading, Timestamp is the moment it was generated rather than written
 type Measurement struct {
-	Id    primitive.ObjectID
-	Value float64
+	Id        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name,omitempty"`
+	Unit      string             `json:"unit,omitempty"`
+	Value     float64            `json:"value"`
+	Labels    map[string]string  `json:"labels,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
 }
 
-func (d *Device) deviceTicker(publish chan<- Measurement, stop <-chan bool) {
-	ticker := time.NewTicker(time.Duration(d.Interval) * time.Millisecond)
+// MarshalJSON writes the values which JSON can't represent, like the NaN sent by a faulty device, as null
+func (m Measurement) MarshalJSON() ([]byte, error) {
+	type measurement Measurement
+	var value *float64
+	if !math.IsNaN(m.Value) && !math.IsInf(m.Value, 0) {
+		value = &m.Value
+	}
+	return json.Marshal(struct {
+		measurement
+		Value *float64 `json:"value"`
+	}{measurement(m), value})
+}
+
+// interval never goes below a millisecond, so that a device can't stall the scheduler
+func (d *Device) interval() time.Duration {
+	if d.Interval <= 0 {
+		return time.Millisecond
+	}
+	return time.Duration(d.Interval) * time.Millisecond
+}
 
-	for {
-		select {
-		case <-stop:
-			ticker.Stop()
-			return
-		case <-ticker.C:
-			publish <- Measurement{
-				Id:    d.Id,
-				Value: d.Value,
-			}
-		}
+func (d *Device) measurement(timestamp time.Time) Measurement {
+	return Measurement{
+		Id:        d.Id,
+		Name:      d.Name,
+		Unit:      d.Unit,
+		Value:     d.Value,
+		Labels:    d.Labels,
+		Timestamp: timestamp,
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DeviceQuery narrows down and orders the devices returned by GET /devices
+type DeviceQuery struct {
+	Name         string
+	NamePrefix   string
+	NameContains string
+	MinInterval  *int
+	MaxInterval  *int
+	MinValue     *float64
+	MaxValue     *float64
+	Labels       map[string]string
+	Group        string
+	SortBy       string
+	SortDesc     bool
+}
+
+// query parameter -> document field
+var deviceSortFields = map[string]string{
+	"id":       "_id",
+	"name":     "name",
+	"value":    "value",
+	"interval": "interval",
+}
+
+// parseDeviceQuery reads the filtering and sorting parameters,
+// sort accepts a field name optionally prefixed with '-' for descending order
+func parseDeviceQuery(values url.Values) (*DeviceQuery, error) {
+	query := &DeviceQuery{
+		Name:         values.Get("name"),
+		NamePrefix:   values.Get("namePrefix"),
+		NameContains: values.Get("nameContains"),
+		Group:        values.Get("group"),
+	}
+
+	var err error
+	if query.Labels, err = parseLabels(values.Get("labels")); err != nil {
+		return nil, err
+	}
+	if query.MinInterval, err = readOptionalInt(values, "minInterval"); err != nil {
+		return nil, err
+	}
+	if query.MaxInterval, err = readOptionalInt(values, "maxInterval"); err != nil {
+		return nil, err
+	}
+	if query.MinValue, err = readOptionalFloat(values, "minValue"); err != nil {
+		return nil, err
+	}
+	if query.MaxValue, err = readOptionalFloat(values, "maxValue"); err != nil {
+		return nil, err
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if strings.HasPrefix(sort, "-") {
+			query.SortDesc = true
+			sort = sort[1:]
+		}
+		if _, ok := deviceSortFields[sort]; !ok {
+			return nil, ErrValidation("unknown sort field: " + sort)
+		}
+		query.SortBy = sort
+	}
+
+	return query, nil
+}
+
+func readOptionalInt(values url.Values, param string) (*int, error) {
+	valueStr := values.Get(param)
+	if valueStr == "" {
+		return nil, nil
+	}
+	value, err := convertToPositiveInteger(valueStr)
+	if err != nil {
+		return nil, ErrValidation(param + ": " + err.Error())
+	}
+	return &value, nil
+}
+
+func readOptionalFloat(values url.Values, param string) (*float64, error) {
+	valueStr := values.Get(param)
+	if valueStr == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return nil, ErrValidation(param + ": " + err.Error())
+	}
+	return &value, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func Test_ParseDeviceQuery_GivenAllParams_FuncReturnsFilledQuery(t *testing.T) {
+	values, _ := url.ParseQuery("name=a&namePrefix=b&nameContains=c&minInterval=10&maxInterval=20&minValue=-1.5&maxValue=3&labels=site=lab1,type=thermo&group=g&sort=-interval")
+
+	query, err := parseDeviceQuery(values)
+
+	minInterval, maxInterval := 10, 20
+	minValue, maxValue := -1.5, 3.0
+	expected := &DeviceQuery{
+		Name:         "a",
+		NamePrefix:   "b",
+		NameContains: "c",
+		MinInterval:  &minInterval,
+		MaxInterval:  &maxInterval,
+		MinValue:     &minValue,
+		MaxValue:     &maxValue,
+		Labels:       map[string]string{"site": "lab1", "type": "thermo"},
+		Group:        "g",
+		SortBy:       "interval",
+		SortDesc:     true,
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, query)
+}
+
+func Test_ParseDeviceQuery_GivenNoParams_FuncReturnsEmptyQuery(t *testing.T) {
+	query, err := parseDeviceQuery(url.Values{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, &DeviceQuery{}, query)
+}
+
+func Test_ParseDeviceQuery_GivenWrongInput_FuncReturnsErrValidation(t *testing.T) {
+	tests := map[string]string{
+		"unknown sort field":     "sort=color",
+		"descending unknown":     "sort=-color",
+		"interval is not int":    "minInterval=a",
+		"negative interval":      "maxInterval=-1",
+		"value is not a number":  "minValue=abc",
+		"max value not a number": "maxValue=1,5",
+		"malformed labels":       "labels=site",
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tc)
+			_, err := parseDeviceQuery(values)
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
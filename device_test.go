@@ -1,28 +1,56 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
 	"testing"
+	"time"
 )
 
-func Test_DeviceTicker_ChannelReturnsCorrectMeasurement(t *testing.T) {
-	publish := make(chan Measurement)
-	stop := make(chan bool)
+func Test_DeviceMeasurement_GivenTimestamp_FuncReturnsCorrectMeasurement(t *testing.T) {
 	id := primitive.NewObjectID()
-	defer close(publish)
-	defer close(stop)
+	timestamp := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	d := Device{Id: id, Name: "thermo", Unit: "C", Value: 24.34, Interval: 1, Labels: map[string]string{"site": "lab1"}}
 
 	expected := Measurement{
-		Id:    id,
-		Value: 24.34,
+		Id:        id,
+		Name:      "thermo",
+		Unit:      "C",
+		Value:     24.34,
+		Labels:    map[string]string{"site": "lab1"},
+		Timestamp: timestamp,
 	}
 
-	d := Device{Id: expected.Id, Value: expected.Value, Interval: 1}
+	assert.Equal(t, expected, d.measurement(timestamp))
+}
+
+func Test_DeviceInterval_GivenDifferentIntervals_FuncNeverGoesBelowMillisecond(t *testing.T) {
+	tests := map[string]struct {
+		input    int
+		expected time.Duration
+	}{
+		"regular":  {input: 1500, expected: 1500 * time.Millisecond},
+		"zero":     {input: 0, expected: time.Millisecond},
+		"negative": {input: -5, expected: time.Millisecond},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := Device{Interval: tc.input}
+
+			assert.Equal(t, tc.expected, d.interval())
+		})
+	}
+}
+
+func Test_MeasurementMarshalJSON_GivenNaN_ValueIsNull(t *testing.T) {
+	id := primitive.NewObjectID()
+	timestamp := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
 
-	go d.deviceTicker(publish, stop)
-	result := <-publish
-	stop <- true
+	data, err := json.Marshal(Measurement{Id: id, Value: math.NaN(), Timestamp: timestamp})
 
-	assert.Equal(t, expected, result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id": "`+id.Hex()+`", "value": null, "timestamp": "2019-12-01T10:00:00Z"}`, string(data))
 }
@@ -1,9 +1,14 @@
 package main
 
+import "strconv"
+
 type ErrValidation string
 
 func (e ErrValidation) Error() string {
-	return "input validation failed"
+	if e == "" {
+		return "input validation failed"
+	}
+	return "input validation failed: " + string(e)
 }
 
 type ErrDao string
@@ -11,3 +16,57 @@ type ErrDao string
 func (e ErrDao) Error() string {
 	return "dao has failed"
 }
+
+// ErrBulkWrite maps positions of the documents which were not written to the reason
+type ErrBulkWrite map[int]string
+
+func (e ErrBulkWrite) Error() string {
+	return "some of the documents were not written"
+}
+
+type ErrPipelineNotRunning string
+
+func (e ErrPipelineNotRunning) Error() string {
+	return "pipeline is not running, POST /start first"
+}
+
+// ErrPipelineStopped tells that the pipeline was stopped while its start was still pending
+type ErrPipelineStopped string
+
+func (e ErrPipelineStopped) Error() string {
+	return "pipeline was stopped before it could start"
+}
+
+// ErrJobRunning tells that the same work is already being done in the background
+type ErrJobRunning string
+
+func (e ErrJobRunning) Error() string {
+	if e == "" {
+		return "a job is already running"
+	}
+	return "a job is already running: " + string(e)
+}
+
+// ErrUnauthorized tells that the request didn't come with valid credentials
+type ErrUnauthorized string
+
+func (e ErrUnauthorized) Error() string {
+	if e == "" {
+		return "unauthorized"
+	}
+	return "unauthorized: " + string(e)
+}
+
+// ErrForbidden tells that the credentials lack the scope the call requires
+type ErrForbidden string
+
+func (e ErrForbidden) Error() string {
+	return "missing scope: " + string(e)
+}
+
+// ErrBodyTooLarge tells that the request body went past the limit of that many bytes
+type ErrBodyTooLarge int64
+
+func (e ErrBodyTooLarge) Error() string {
+	return "request body is larger than " + strconv.FormatInt(int64(e), 10) + " bytes"
+}
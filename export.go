@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const (
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+)
+
+// deviceExporter writes devices in one of the formats accepted back by POST /devices:bulk
+type deviceExporter interface {
+	Write(device *Device) error
+	Flush() error
+}
+
+func newDeviceExporter(w io.Writer, format string, withIds bool) (deviceExporter, error) {
+	switch format {
+	case exportFormatNDJSON:
+		return &ndjsonExporter{encoder: json.NewEncoder(w), withIds: withIds}, nil
+	case exportFormatCSV:
+		return &csvExporter{writer: csv.NewWriter(w), withIds: withIds}, nil
+	default:
+		return nil, ErrValidation("unknown export format: " + format)
+	}
+}
+
+func exportContentType(format string) string {
+	if format == exportFormatCSV {
+		return contentTypeCSV
+	}
+	return contentTypeNDJSON
+}
+
+type ndjsonExporter struct {
+	encoder *json.Encoder
+	withIds bool
+}
+
+func (e *ndjsonExporter) Write(device *Device) error {
+	payload := newDevicePayload(device, e.withIds)
+	return e.encoder.Encode(&payload)
+}
+
+func (e *ndjsonExporter) Flush() error {
+	return nil
+}
+
+type csvExporter struct {
+	writer        *csv.Writer
+	withIds       bool
+	headerWritten bool
+}
+
+func (e *csvExporter) Write(device *Device) error {
+	if !e.headerWritten {
+		if err := e.writer.Write(e.header()); err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+	payload := newDevicePayload(device, e.withIds)
+	record := []string{
+		payload.Name,
+		strconv.FormatFloat(payload.Value, 'g', -1, 64),
+		strconv.Itoa(payload.Interval),
+		payload.Unit,
+		formatLabels(payload.Labels),
+		formatGroups(payload.Groups),
+		formatOptionalInt(payload.Jitter),
+		formatOptionalInt(payload.Phase),
+		payload.Cron,
+	}
+	generator, err := formatGenerator(payload.Generator)
+	if err != nil {
+		return err
+	}
+	record = append(record, generator)
+	if e.withIds {
+		record = append([]string{payload.Id}, record...)
+	}
+	return e.writer.Write(record)
+}
+
+// Flush makes sure the header is there even when there were no devices to export
+func (e *csvExporter) Flush() error {
+	if !e.headerWritten {
+		if err := e.writer.Write(e.header()); err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvExporter) header() []string {
+	header := []string{"name", "value", "interval", "unit", "labels", "groups", "jitter", "phase", "cron", "generator"}
+	if e.withIds {
+		header = append([]string{"id"}, header...)
+	}
+	return header
+}
+
+// formatOptionalInt leaves the column empty for options which aren't set
+func formatOptionalInt(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+// formatGenerator writes the generator as JSON, it has too many options for a column of its own each
+func formatGenerator(generator *ValueGenerator) (string, error) {
+	if generator == nil {
+		return "", nil
+	}
+	encoded, err := json.Marshal(generator)
+	return string(encoded), err
+}
+
+// ExportResult is what an export job reports back, the file itself is downloaded from GET /jobs/{id}/file
+type ExportResult struct {
+	Format  string `json:"format"`
+	Devices int64  `json:"devices"`
+}
+
+// jobsDirFromEnv reads JOBS_DIR, the files of the jobs go to the temporary directory by default
+func jobsDirFromEnv() string {
+	if dir := os.Getenv("JOBS_DIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// exportDevicesToFile writes the export into a new file in dir, the file is removed again unless the export gets done.
+// The job knows about the file from the start, a file left behind by a restart is removed with the expired ones
+func exportDevicesToFile(service *Service, dir string, query *DeviceQuery, format string, withIds bool, progress *JobProgress, ctx context.Context) (*ExportResult, error) {
+	total, err := service.Dao.CountDevices(query, ctx)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(dir, "export-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	progress.SetFile(file.Name())
+
+	result := &ExportResult{Format: format}
+	buffered := bufio.NewWriter(file)
+	exporter, err := newDeviceExporter(buffered, format, withIds)
+	if err == nil {
+		err = service.ExportDevices(query, func(device *Device) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			result.Devices++
+			if total > 0 {
+				progress.Set(float64(result.Devices) / float64(total))
+			}
+			return exporter.Write(device)
+		}, ctx)
+	}
+	if err == nil {
+		err = exporter.Flush()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		progress.SetFile("")
+		return result, err
+	}
+	return result, nil
+}
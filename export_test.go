@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func Test_DeviceExporter_GivenDevices_ExportedDataCanBeImportedBack(t *testing.T) {
+	devices := []Device{
+		{Id: primitive.NewObjectID(), Name: "first", Value: 21.5, Interval: 100, Unit: "C", Labels: map[string]string{"site": "lab1", "type": "thermo"}, Groups: []string{"a", "b"}},
+		{Id: primitive.NewObjectID(), Name: "second, with a comma", Value: -3, Interval: 1000, Jitter: 10, Phase: 250},
+		{Id: primitive.NewObjectID(), Name: "third", Cron: "*/5 9-17 * * 1-5"},
+		{Id: primitive.NewObjectID(), Name: "fourth", Value: 20, Interval: 1000, Generator: &ValueGenerator{Type: "sine", Amplitude: 2.5, Period: 60000}},
+	}
+	tests := map[string]struct {
+		format  string
+		withIds bool
+	}{
+		"ndjson":          {format: exportFormatNDJSON},
+		"ndjson with ids": {format: exportFormatNDJSON, withIds: true},
+		"csv":             {format: exportFormatCSV},
+		"csv with ids":    {format: exportFormatCSV, withIds: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			exporter, err := newDeviceExporter(&buf, tc.format, tc.withIds)
+			assert.NoError(t, err)
+
+			for i := range devices {
+				assert.NoError(t, exporter.Write(&devices[i]))
+			}
+			assert.NoError(t, exporter.Flush())
+
+			payloads, err := parseBulkPayloads(&buf, exportContentType(tc.format))
+
+			var expected []DevicePayload
+			for i := range devices {
+				expected = append(expected, newDevicePayload(&devices[i], tc.withIds))
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, expected, payloads)
+		})
+	}
+}
+
+func Test_DeviceExporter_GivenNoDevices_CSVStillHasHeader(t *testing.T) {
+	var buf bytes.Buffer
+	exporter, _ := newDeviceExporter(&buf, exportFormatCSV, true)
+
+	err := exporter.Flush()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "id,name,value,interval,unit,labels,groups,jitter,phase,cron,generator\n", buf.String())
+}
+
+func Test_NewDeviceExporter_GivenUnknownFormat_FuncReturnsErrValidation(t *testing.T) {
+	_, err := newDeviceExporter(&bytes.Buffer{}, "xml", false)
+
+	assert.IsType(t, ErrValidation(""), err)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DeviceFaults makes a device misbehave on purpose, every fault is off unless set
+type DeviceFaults struct {
+	Dropout *DropoutFault `json:"dropout,omitempty"`
+	// Stuck keeps repeating the value the device had when the faults were set
+	Stuck bool        `json:"stuck,omitempty"`
+	Spike *SpikeFault `json:"spike,omitempty"`
+	// Drift is added to the value for every second since the faults were set
+	Drift   float64       `json:"drift,omitempty"`
+	Invalid *InvalidFault `json:"invalid,omitempty"`
+}
+
+// DropoutFault silences the device for the first Duration milliseconds of every Period,
+// without a period the device stays silent until the fault is cleared
+type DropoutFault struct {
+	Period   int `json:"period,omitempty" validate:"min=0"`
+	Duration int `json:"duration,omitempty" validate:"min=0"`
+}
+
+// SpikeFault adds or subtracts Magnitude from the value with the given probability
+type SpikeFault struct {
+	Probability float64 `json:"probability" validate:"min=0,max=1"`
+	Magnitude   float64 `json:"magnitude"`
+}
+
+// InvalidFault replaces the value with the given probability, by Value if set or NaN otherwise
+type InvalidFault struct {
+	Probability float64  `json:"probability" validate:"min=0,max=1"`
+	Value       *float64 `json:"value,omitempty"`
+}
+
+// faultState is what the faults need to remember about a device between its ticks
+type faultState struct {
+	faults *DeviceFaults
+	// since is when the faults were set, the dropout windows and the drift are counted from it
+	since time.Time
+	value float64
+}
+
+func newFaultState(device *Device, now time.Time) *faultState {
+	if device.Faults == nil {
+		return nil
+	}
+	return &faultState{faults: device.Faults, since: now, value: device.Value}
+}
+
+// apply changes the measurement according to the faults, it returns false when the measurement is to be dropped
+func (f *faultState) apply(measurement *Measurement, random *rand.Rand) bool {
+	faults := f.faults
+	elapsed := measurement.Timestamp.Sub(f.since)
+
+	if dropout := faults.Dropout; dropout != nil {
+		if dropout.Period <= 0 {
+			return false
+		}
+		period := time.Duration(dropout.Period) * time.Millisecond
+		if elapsed%period < time.Duration(dropout.Duration)*time.Millisecond {
+			return false
+		}
+	}
+
+	if faults.Stuck {
+		measurement.Value = f.value
+	} else if faults.Drift != 0 {
+		measurement.Value += faults.Drift * elapsed.Seconds()
+	}
+
+	if spike := faults.Spike; spike != nil && random.Float64() < spike.Probability {
+		if random.Intn(2) == 0 {
+			measurement.Value += spike.Magnitude
+		} else {
+			measurement.Value -= spike.Magnitude
+		}
+	}
+
+	if invalid := faults.Invalid; invalid != nil && random.Float64() < invalid.Probability {
+		if invalid.Value != nil {
+			measurement.Value = *invalid.Value
+		} else {
+			measurement.Value = math.NaN()
+		}
+	}
+	return true
+}
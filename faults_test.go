@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_FaultStateApply_GivenDifferentFaults_FuncChangesMeasurement(t *testing.T) {
+	outOfRange := -999.0
+	tests := map[string]struct {
+		faults   DeviceFaults
+		elapsed  time.Duration
+		keep     bool
+		expected float64
+	}{
+		"no faults":             {elapsed: time.Second, keep: true, expected: 20},
+		"outage":                {faults: DeviceFaults{Dropout: &DropoutFault{}}, elapsed: time.Hour},
+		"inside dropout window": {faults: DeviceFaults{Dropout: &DropoutFault{Period: 10000, Duration: 2000}}, elapsed: 21 * time.Second},
+		"outside dropout window": {
+			faults: DeviceFaults{Dropout: &DropoutFault{Period: 10000, Duration: 2000}}, elapsed: 23 * time.Second, keep: true, expected: 20,
+		},
+		"stuck":                {faults: DeviceFaults{Stuck: true}, elapsed: time.Second, keep: true, expected: 10},
+		"stuck wins the drift": {faults: DeviceFaults{Stuck: true, Drift: 1}, elapsed: time.Second, keep: true, expected: 10},
+		"drift":                {faults: DeviceFaults{Drift: 0.5}, elapsed: 10 * time.Second, keep: true, expected: 25},
+		"spike":                {faults: DeviceFaults{Spike: &SpikeFault{Probability: 1, Magnitude: 100}}, keep: true, expected: 120},
+		"no spike":             {faults: DeviceFaults{Spike: &SpikeFault{Probability: 0, Magnitude: 100}}, keep: true, expected: 20},
+		"out of range":         {faults: DeviceFaults{Invalid: &InvalidFault{Probability: 1, Value: &outOfRange}}, keep: true, expected: -999},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			faults := tc.faults
+			state := &faultState{faults: &faults, since: schedulerEpoch, value: 10}
+			measurement := Measurement{Value: 20, Timestamp: schedulerEpoch.Add(tc.elapsed)}
+			// with this seed the first spike goes up
+			random := rand.New(rand.NewSource(2))
+
+			keep := state.apply(&measurement, random)
+
+			assert.Equal(t, tc.keep, keep)
+			if tc.keep {
+				assert.Equal(t, tc.expected, measurement.Value)
+			}
+		})
+	}
+}
+
+func Test_FaultStateApply_GivenInvalidFaultWithoutValue_MeasurementBecomesNaN(t *testing.T) {
+	state := &faultState{faults: &DeviceFaults{Invalid: &InvalidFault{Probability: 1}}, since: schedulerEpoch}
+	measurement := Measurement{Value: 20, Timestamp: schedulerEpoch}
+
+	state.apply(&measurement, rand.New(rand.NewSource(1)))
+
+	assert.True(t, math.IsNaN(measurement.Value))
+}
+
+func TestScheduler_Update_GivenFaultsToggled_DeviceDropsOutAndComesBack(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000, Value: 5}
+	s.Add(device)
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, time.Second, 1)
+	before := <-queue.C()
+	device.Faults = &DeviceFaults{Dropout: &DropoutFault{}}
+	s.Update(device)
+	advanceBy(clock, time.Second, 3)
+	device.Faults = nil
+	s.Update(device)
+	advanceBy(clock, time.Second, 1)
+	after := <-queue.C()
+
+	assert.Equal(t, schedulerEpoch.Add(time.Second), before.Timestamp)
+	assert.Equal(t, device.measurement(schedulerEpoch.Add(5*time.Second)), after)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	generatorConstant   = "constant"
+	generatorSine       = "sine"
+	generatorRandomWalk = "random"
+	generatorRamp       = "ramp"
+
+	// in milliseconds
+	defaultGeneratorPeriod = 60000
+)
+
+// ValueGenerator makes the value of a device change over time, starting from the device's value
+type ValueGenerator struct {
+	Type string `json:"type" validate:"oneof=constant sine random ramp"`
+	// Amplitude and Period (in milliseconds) of the sine wave around the value
+	Amplitude float64 `json:"amplitude,omitempty"`
+	Period    int     `json:"period,omitempty" validate:"min=0"`
+	// Step is the biggest change of the random walk, or the change of the ramp, on every tick
+	Step float64 `json:"step,omitempty"`
+	// Min and Max bound the random walk and the ramp when Max is above Min, the ramp starts over once it leaves them
+	Min float64 `json:"min,omitempty"`
+	Max float64 `json:"max,omitempty"`
+}
+
+// generatorState is what the generator needs to remember about a device between its ticks
+type generatorState struct {
+	generator *ValueGenerator
+	since     time.Time
+	base      float64
+	value     float64
+}
+
+func newGeneratorState(device *Device, now time.Time) *generatorState {
+	if device.Generator == nil {
+		return nil
+	}
+	return &generatorState{generator: device.Generator, since: now, base: device.Value, value: device.Value}
+}
+
+func (g *generatorState) next(timestamp time.Time, random *rand.Rand) float64 {
+	generator := g.generator
+	bounded := generator.Max > generator.Min
+	switch generator.Type {
+	case generatorSine:
+		period := generator.Period
+		if period <= 0 {
+			period = defaultGeneratorPeriod
+		}
+		elapsed := timestamp.Sub(g.since)
+		return g.base + generator.Amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(time.Duration(period)*time.Millisecond))
+	case generatorRandomWalk:
+		g.value += (random.Float64()*2 - 1) * generator.Step
+		if bounded {
+			g.value = math.Max(generator.Min, math.Min(generator.Max, g.value))
+		}
+		return g.value
+	case generatorRamp:
+		g.value += generator.Step
+		if bounded && g.value > generator.Max {
+			g.value = generator.Min
+		} else if bounded && g.value < generator.Min {
+			g.value = generator.Max
+		}
+		return g.value
+	default:
+		return g.base
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_GeneratorStateNext_GivenSine_ValueFollowsTheWave(t *testing.T) {
+	device := Device{Value: 10, Generator: &ValueGenerator{Type: generatorSine, Amplitude: 2, Period: 4000}}
+	state := newGeneratorState(&device, schedulerEpoch)
+	random := rand.New(rand.NewSource(1))
+
+	assert.InDelta(t, 12, state.next(schedulerEpoch.Add(time.Second), random), 1e-9)
+	assert.InDelta(t, 10, state.next(schedulerEpoch.Add(2*time.Second), random), 1e-9)
+	assert.InDelta(t, 8, state.next(schedulerEpoch.Add(3*time.Second), random), 1e-9)
+}
+
+func Test_GeneratorStateNext_GivenRamp_ValueStartsOverAboveMax(t *testing.T) {
+	device := Device{Value: 1, Generator: &ValueGenerator{Type: generatorRamp, Step: 1, Min: 0, Max: 2}}
+	state := newGeneratorState(&device, schedulerEpoch)
+
+	var values []float64
+	for i := 0; i < 4; i++ {
+		values = append(values, state.next(schedulerEpoch, nil))
+	}
+
+	assert.Equal(t, []float64{2, 0, 1, 2}, values)
+}
+
+func Test_GeneratorStateNext_GivenRandomWalk_ValueStaysWithinBounds(t *testing.T) {
+	device := Device{Value: 5, Generator: &ValueGenerator{Type: generatorRandomWalk, Step: 3, Min: 4, Max: 6}}
+	state := newGeneratorState(&device, schedulerEpoch)
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		value := state.next(schedulerEpoch, random)
+		assert.True(t, value >= 4 && value <= 6, "value %f out of bounds", value)
+	}
+}
+
+func Test_NewGeneratorState_GivenNoGenerator_FuncReturnsNil(t *testing.T) {
+	assert.Nil(t, newGeneratorState(&Device{Value: 5}, schedulerEpoch))
+}
@@ -6,9 +6,17 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/mongo"
+	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const streamHeartbeatInterval = 15 * time.Second
+
 type HandlersEnvironment struct {
 	controller *Controller
 }
@@ -24,7 +32,7 @@ func (he *HandlersEnvironment) AddDeviceHandler(w http.ResponseWriter, r *http.R
 
 	err := json.NewDecoder(r.Body).Decode(&devPayload)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeDecodeError(w, r, err)
 		return
 	}
 
@@ -37,6 +45,117 @@ func (he *HandlersEnvironment) AddDeviceHandler(w http.ResponseWriter, r *http.R
 
 }
 
+// AddDevicesBulkHandler accepts a JSON array, NDJSON or CSV, with ?atomic=true either all devices are added or none.
+// With ?async=true the devices are added by a job and the reply is the job
+func (he *HandlersEnvironment) AddDevicesBulkHandler(w http.ResponseWriter, r *http.Request) {
+	atomic, err := readBoolFromQueryParameter(r.URL, "atomic")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	async, err := readBoolFromQueryParameter(r.URL, "async")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	payloads, err := parseBulkPayloads(r.Body, r.Header.Get("Content-Type"))
+	if _, ok := err.(ErrUnsupportedMediaType); ok {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if async {
+		job, err := he.controller.AddDevicesInBackground(payloads, atomic, r.Context())
+		if caseSwitchError(w, err) {
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		he.writeObject(w, job)
+		return
+	}
+
+	result, err := he.controller.AddDevices(payloads, atomic, r.Context())
+	if err != nil && result != nil {
+		// the batch got rejected, the result tells which items were at fault
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.WriteHeader(errorStatusCode(err))
+		he.writeObject(w, result)
+		return
+	}
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, result)
+}
+
+// ExportDevicesHandler streams the devices as NDJSON (default) or CSV, ?ids=true keeps their ids,
+// the filters are the same as for GET /devices
+func (he *HandlersEnvironment) ExportDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	format, withIds, query, err := parseExportParameters(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exporter, err := newDeviceExporter(w, format, withIds)
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="devices.%s"`, format))
+	exported := 0
+	err = he.controller.ExportDevices(query, func(device *Device) error {
+		exported++
+		return exporter.Write(device)
+	}, r.Context())
+	if err != nil && exported == 0 {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		err = exporter.Flush()
+	}
+	if err != nil {
+		// the status has been sent with the first device already, all that's left is to cut the stream short
+		log.Printf("export was interrupted: %s", err.Error())
+	}
+}
+
+// ExportDevicesJobHandler takes the same parameters as ExportDevicesHandler but writes the export by a job,
+// the file is downloaded from GET /jobs/{id}/file once the job is done
+func (he *HandlersEnvironment) ExportDevicesJobHandler(w http.ResponseWriter, r *http.Request) {
+	format, withIds, query, err := parseExportParameters(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := he.controller.ExportDevicesInBackground(query, format, withIds, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	he.writeObject(w, job)
+}
+
+func parseExportParameters(requestURL *url.URL) (format string, withIds bool, query *DeviceQuery, err error) {
+	format = requestURL.Query().Get("format")
+	if format == "" {
+		format = exportFormatNDJSON
+	}
+	if withIds, err = readBoolFromQueryParameter(requestURL, "ids"); err != nil {
+		return "", false, nil, err
+	}
+	query, err = parseDeviceQuery(requestURL.Query())
+	return format, withIds, query, err
+}
+
 func (he *HandlersEnvironment) GetDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
@@ -53,26 +172,374 @@ func (he *HandlersEnvironment) GetDeviceHandler(w http.ResponseWriter, r *http.R
 	he.writeObject(w, device)
 }
 
+// SetDeviceFaultsHandler replaces all the faults of the device with the ones given
+func (he *HandlersEnvironment) SetDeviceFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	var faults DeviceFaults
+	if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	device, err := he.controller.SetDeviceFaults(mux.Vars(r)["id"], &faults, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, device)
+}
+
+func (he *HandlersEnvironment) ClearDeviceFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	device, err := he.controller.SetDeviceFaults(mux.Vars(r)["id"], nil, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, device)
+}
+
 func (he *HandlersEnvironment) GetPaginatedDevices(w http.ResponseWriter, r *http.Request) {
 	limit := r.Context().Value("limit").(int)
 	page := r.Context().Value("page").(int)
 
-	devices, err := he.controller.GetPaginatedDevices(limit, page, r.Context())
+	query, err := parseDeviceQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// page and limit stay the default, the envelope is only returned to those asking for a cursor
+	if _, ok := r.URL.Query()["cursor"]; ok {
+		he.getDevicesByCursor(w, r, query, limit)
+		return
+	}
+
+	devices, total, err := he.controller.GetPaginatedDevices(limit, page, query, r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
 	he.writeObject(w, devices)
 
 }
 
+func (he *HandlersEnvironment) getDevicesByCursor(w http.ResponseWriter, r *http.Request, query *DeviceQuery, limit int) {
+	cursorPage, err := he.controller.GetDevicesByCursor(query, r.URL.Query().Get("cursor"), limit, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	var links []string
+	if cursorPage.Next != "" {
+		cursorPage.Links.Next = urlWithCursor(r.URL, cursorPage.Next)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, cursorPage.Links.Next))
+	}
+	if cursorPage.Prev != "" {
+		cursorPage.Links.Prev = urlWithCursor(r.URL, cursorPage.Prev)
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, cursorPage.Links.Prev))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	he.writeObject(w, cursorPage)
+}
+
+// StartTickerService only triggers the start, the status tells when the pipeline is running or why it couldn't start
 func (he *HandlersEnvironment) StartTickerService(w http.ResponseWriter, r *http.Request) {
-	err := he.controller.StartTickerService(r.Context())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	status, err := he.controller.StartPipeline(r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	he.writeObject(w, status)
+}
+
+// StopTickerService stops the devices, the pipeline stays stopped across restarts until it is started again
+func (he *HandlersEnvironment) StopTickerService(w http.ResponseWriter, r *http.Request) {
+	status, err := he.controller.StopPipeline(r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, status)
+}
+
+// GetMeasurementsHandler returns the device's past values, see parseMeasurementQuery for the parameters
+func (he *HandlersEnvironment) GetMeasurementsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	query, err := parseMeasurementQuery(r.URL.Query())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	points, err := he.controller.GetMeasurements(id, query, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, points)
+}
+
+// StreamDeviceHandler pushes the device's measurements as server-sent events
+func (he *HandlersEnvironment) StreamDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	sub, err := he.controller.SubscribeDevice(id, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+	defer he.controller.Unsubscribe(sub)
+
+	he.streamMeasurements(w, r, sub)
+}
+
+// StreamHandler pushes the measurements of all the devices, or only those matching ?labels=, as server-sent events
+func (he *HandlersEnvironment) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	selector, err := parseLabels(r.URL.Query().Get("labels"))
+	if caseSwitchError(w, err) {
 		return
 	}
+
+	sub := he.controller.Subscribe(selector)
+	defer he.controller.Unsubscribe(sub)
+
+	he.streamMeasurements(w, r, sub)
+}
+
+// streamMeasurements writes events until the client goes away or the hub disconnects it for being too slow
+func (he *HandlersEnvironment) streamMeasurements(w http.ResponseWriter, r *http.Request, sub *Subscription) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case measurement, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(measurement)
+			if err != nil {
+				log.Printf("could not stream %+v: %s", measurement, err.Error())
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: measurement\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+type GroupTickersResponse struct {
+	Group   string `json:"group"`
+	Started int    `json:"started,omitempty"`
+	Stopped int    `json:"stopped,omitempty"`
+}
+
+// BackfillHandler starts writing historical measurements of the device as a job,
+// it can be followed with GET /devices/{id}/backfill or through /jobs
+func (he *HandlersEnvironment) BackfillHandler(w http.ResponseWriter, r *http.Request) {
+	var request BackfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	job, err := he.controller.Backfill(mux.Vars(r)["id"], &request, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	he.writeObject(w, job)
+}
+
+func (he *HandlersEnvironment) GetBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := he.controller.GetBackfill(mux.Vars(r)["id"], r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, job)
+}
+
+func (he *HandlersEnvironment) CancelBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := he.controller.CancelBackfill(mux.Vars(r)["id"], r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, job)
+}
+
+// GetJobsHandler lists the latest jobs first, they can be narrowed down with ?type=, ?target= and ?state=
+func (he *HandlersEnvironment) GetJobsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := readIntFromQueryParameter(r.URL, "limit", 100)
+	if err != nil || limit == 0 {
+		http.Error(w, "limit has to be a positive number", http.StatusBadRequest)
+		return
+	}
+	query := &JobQuery{
+		Type:   r.URL.Query().Get("type"),
+		Target: r.URL.Query().Get("target"),
+		State:  r.URL.Query().Get("state"),
+	}
+
+	jobs, err := he.controller.GetJobs(query, limit, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, jobs)
+}
+
+func (he *HandlersEnvironment) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := he.controller.GetJob(mux.Vars(r)["id"], r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, job)
+}
+
+// CancelJobHandler replies with the job as it is, it turns cancelled only once it has actually stopped
+func (he *HandlersEnvironment) CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := he.controller.CancelJob(mux.Vars(r)["id"], r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, job)
+}
+
+// GetJobFileHandler downloads the file left by a job which is done, like an export
+func (he *HandlersEnvironment) GetJobFileHandler(w http.ResponseWriter, r *http.Request) {
+	job, file, err := he.controller.OpenJobFile(mux.Vars(r)["id"], r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+	defer file.Close()
+
+	format := strings.TrimPrefix(filepath.Ext(job.File), ".")
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="devices.%s"`, format))
+	modified := job.UpdatedAt
+	if job.FinishedAt != nil {
+		modified = *job.FinishedAt
+	}
+	http.ServeContent(w, r, "", modified, file)
+}
+
+// GetAuditHandler lists the latest changes first, they can be narrowed down by device, actor and time range
+func (he *HandlersEnvironment) GetAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseAuditQuery(r.URL.Query())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	events, err := he.controller.GetAuditEvents(query, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, events)
+}
+
+// CreateApiKeyHandler replies with the key itself, it can't be read back later
+func (he *HandlersEnvironment) CreateApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request ApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	key, err := he.controller.CreateApiKey(&request, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	he.writeObject(w, key)
+}
+
+func (he *HandlersEnvironment) GetApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := he.controller.GetApiKeys(r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, keys)
+}
+
+func (he *HandlersEnvironment) RevokeApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := he.controller.RevokeApiKey(mux.Vars(r)["id"], r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, key)
+}
+
+// RunScenarioHandler takes the scenario as YAML or JSON and replies once its devices are provisioned
+func (he *HandlersEnvironment) RunScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	scenario, err := LoadScenario(r.Body)
+	if caseSwitchError(w, bodyError(r, err)) {
+		return
+	}
+
+	run, err := he.controller.RunScenario(scenario, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	he.writeObject(w, run)
+}
+
+func (he *HandlersEnvironment) StartGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	started, err := he.controller.StartGroup(group, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, GroupTickersResponse{Group: group, Started: started})
+}
+
+func (he *HandlersEnvironment) StopGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["group"]
+
+	stopped, err := he.controller.StopGroup(group, r.Context())
+	if caseSwitchError(w, err) {
+		return
+	}
+
+	he.writeObject(w, GroupTickersResponse{Group: group, Stopped: stopped})
+}
+
+func (he *HandlersEnvironment) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	he.writeObject(w, he.controller.Status())
 }
 
 func (he *HandlersEnvironment) writeObject(w http.ResponseWriter, object interface{}) {
@@ -110,13 +577,45 @@ func pageAndLimitWrapper(h http.HandlerFunc) http.HandlerFunc {
 
 func caseSwitchError(w http.ResponseWriter, err error) bool {
 	if err != nil {
-		switch err.(type) {
-		case ErrValidation:
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), errorStatusCode(err))
 		return true
 	}
 	return false
 }
+
+// writeDecodeError replies 413 when the body went past the size limit and 400 for anything else wrong with it
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err = bodyError(r, err); errorStatusCode(err) == http.StatusRequestEntityTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func errorStatusCode(err error) int {
+	if err == mongo.ErrNoDocuments {
+		return http.StatusNotFound
+	}
+	switch err.(type) {
+	case ErrValidation:
+		return http.StatusBadRequest
+	case ErrBulkWrite, ErrPipelineNotRunning, ErrJobRunning:
+		return http.StatusConflict
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// urlWithCursor keeps all the other query parameters of the request so that filters carry over
+func urlWithCursor(requestURL *url.URL, cursor string) string {
+	query := requestURL.Query()
+	query.Set("cursor", cursor)
+	query.Del("page")
+	return requestURL.Path + "?" + query.Encode()
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"github.com/influxdata/influxdb1-client/v2"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 type mockResponseWriter struct {
@@ -169,11 +176,55 @@ func Test_GetPaginatedDevicesHandler_GivenPageThatHasNoDevicesToShow_HandlerRetu
 	assert.Equal(t, []int(nil), result)
 }
 
-func Test_StartTickerServiceHandler_GivenDaoError_HandlerReturns500(t *testing.T) {
-	r := newRouter(&Controller{mainService: NewService(&mockDao{returnErr: ErrDao("")})})
-	mockServer := httptest.NewServer(r)
+func Test_StartTickerServiceHandler_GivenDaoError_HandlerReturns202AndStatusTellsTheError(t *testing.T) {
+	c := &Controller{mainService: NewService(&mockDao{returnErr: ErrDao("")}), stateDao: &mockPipelineStateDao{}, ctx: context.Background()}
+	mockServer := httptest.NewServer(newRouter(c))
 
 	resp, err := http.Post(mockServer.URL+"/start", "", nil)
+	assert.NoError(t, err)
+	var status PipelineStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.True(t, status.Starting)
+	assert.False(t, status.Running)
+	assert.Eventually(t, func() bool {
+		return c.Status().Error == ErrDao("").Error()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_StartTickerServiceHandler_GivenNewController_MeasurementsReachTheHub(t *testing.T) {
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	os.Setenv("INFLUXDB_URL", influx.URL)
+	defer os.Unsetenv("INFLUXDB_URL")
+	device := Device{Id: primitive.NewObjectID(), Interval: 10}
+	c := NewController(NewService(&mockDao{data: []Device{device}}), newMockJobDao(), &mockPipelineStateDao{}, &mockApiKeyDao{}, &mockAuditDao{})
+	defer c.Close()
+	sub := c.hub.Subscribe(nil)
+	mockServer := httptest.NewServer(newRouter(c))
+	defer mockServer.Close()
+
+	resp, err := http.Post(mockServer.URL+"/start", "", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	select {
+	case measurement := <-sub.C:
+		assert.Equal(t, device.Id, measurement.Id)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "no measurement has reached the hub")
+	}
+}
+
+func Test_StopTickerServiceHandler_GivenStateDaoError_HandlerReturns500(t *testing.T) {
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID()}, &mockPipelineStateDao{returnErr: ErrDao("")}, &mockInfluxClient{})
+	mockServer := httptest.NewServer(newRouter(c))
+
+	resp, err := http.Post(mockServer.URL+"/stop", "", nil)
 
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
@@ -199,3 +250,578 @@ func Test_CaseSwitchError_GivenDifferentErrors_FuncWritesProperStatusCode(t *tes
 		})
 	}
 }
+
+func Test_GetPaginatedDevicesHandler_GivenDevices_HandlerSetsTotalCountHeader(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{data: []Device{{Name: "a"}, {Name: "b"}}})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+}
+
+func Test_GetPaginatedDevicesHandler_GivenFilterParams_HandlerPassesQueryToDao(t *testing.T) {
+	dao := &mockDao{}
+	r := newRouter(&Controller{mainService: NewService(dao)})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices?namePrefix=therm&sort=-value")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, &DeviceQuery{NamePrefix: "therm", SortBy: "value", SortDesc: true}, dao.query)
+}
+
+func Test_GetPaginatedDevicesHandler_GivenUnknownSortField_HandlerReturns400(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices?sort=color")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_GetPaginatedDevicesHandler_GivenCursorParam_HandlerReturnsEnvelopeWithLinks(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID()}
+	r := newRouter(&Controller{mainService: NewService(&mockDao{data: []Device{{Id: ids[0]}, {Id: ids[1]}}})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices?cursor=&limit=1&name=a")
+	assert.NoError(t, err)
+
+	var result DeviceCursorPage
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	next := encodeCursor(DeviceCursor{Id: ids[0]})
+	expectedLink := "/devices?cursor=" + next + "&limit=1&name=a"
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Device{{Id: ids[0]}}, result.Data)
+	assert.Equal(t, next, result.Next)
+	assert.Equal(t, expectedLink, result.Links.Next)
+	assert.Empty(t, result.Links.Prev)
+	assert.Equal(t, `<`+expectedLink+`>; rel="next"`, resp.Header.Get("Link"))
+}
+
+func Test_GetPaginatedDevicesHandler_GivenMalformedCursor_HandlerReturns400(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices?cursor=abc")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_GetPaginatedDevicesHandler_GivenCursorWithDescendingSort_HandlerReturns400(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices?cursor=&sort=-id")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_AddDevicesBulkHandler_GivenCSV_HandlerReturnsPerItemResults(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	requestBody := bytes.NewBufferString("name,interval\nfirst,10\nx,10\n")
+	resp, err := http.Post(mockServer.URL+"/devices:bulk", "text/csv", requestBody)
+	assert.NoError(t, err)
+
+	var result BulkResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, "first", result.Items[0].Device.Name)
+}
+
+func Test_AddDevicesBulkHandler_GivenInvalidItemInAtomicMode_HandlerReturns400WithResults(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	requestBody := bytes.NewBufferString(`[{"name": "first"}, {"name": "x"}]`)
+	resp, err := http.Post(mockServer.URL+"/devices:bulk?atomic=true", "application/json", requestBody)
+	assert.NoError(t, err)
+
+	var result BulkResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, 2, result.Failed)
+}
+
+func Test_AddDevicesBulkHandler_GivenWrongInput_HandlerReturnsClientError(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	tests := map[string]struct {
+		url         string
+		contentType string
+		body        string
+		expected    int
+	}{
+		"atomic is not bool": {url: "/devices:bulk?atomic=maybe", contentType: "application/json", body: `[{"name": "first"}]`, expected: http.StatusBadRequest},
+		"malformed json":     {url: "/devices:bulk", contentType: "application/json", body: `[{"name"`, expected: http.StatusBadRequest},
+		"unsupported format": {url: "/devices:bulk", contentType: "application/xml", body: `<devices/>`, expected: http.StatusUnsupportedMediaType},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Post(mockServer.URL+tc.url, tc.contentType, bytes.NewBufferString(tc.body))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_ExportDevicesHandler_GivenCSVFormatWithIds_HandlerStreamsCSV(t *testing.T) {
+	id := primitive.NewObjectID()
+	r := newRouter(&Controller{mainService: NewService(&mockDao{data: []Device{{Id: id, Name: "first", Value: 1.5, Interval: 10}}})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices/export?format=csv&ids=true")
+	assert.NoError(t, err)
+
+	var body bytes.Buffer
+	_, err = body.ReadFrom(resp.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "id,name,value,interval,unit,labels,groups,jitter,phase,cron,generator\n"+id.Hex()+",first,1.5,10,,,,,,,\n", body.String())
+}
+
+func Test_ExportDevicesHandler_GivenWrongInput_HandlerReturns400(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{})})
+	mockServer := httptest.NewServer(r)
+
+	tests := map[string]string{
+		"unknown format":  "/devices/export?format=xml",
+		"ids is not bool": "/devices/export?ids=maybe",
+		"bad filter":      "/devices/export?minValue=abc",
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Get(mockServer.URL + tc)
+
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func Test_ExportDevicesHandler_GivenDaoError_HandlerReturns500(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{returnErr: ErrDao("")})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices/export")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func Test_RunScenarioHandler_GivenWrongInput_HandlerReturnsClientError(t *testing.T) {
+	tests := map[string]struct {
+		body     string
+		expected int
+	}{
+		"malformed scenario":   {body: "devices: [", expected: http.StatusBadRequest},
+		"pipeline not running": {body: testScenario, expected: http.StatusConflict},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newRouter(&Controller{mainService: NewService(&mockDao{}), tickerService: NewTickerService(SystemClock{})})
+			mockServer := httptest.NewServer(r)
+
+			resp, err := http.Post(mockServer.URL+"/scenarios", "application/yaml", strings.NewReader(tc.body))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_StartGroupHandler_GivenPipelineNotRunning_HandlerReturns409(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{}), tickerService: NewTickerService(SystemClock{})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Post(mockServer.URL+"/groups/floor-1/start", "", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func Test_StopGroupHandler_GivenGroup_HandlerReturnsNumberOfStoppedDevices(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{data: []Device{{Id: primitive.NewObjectID()}}}), tickerService: NewTickerService(SystemClock{})})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Post(mockServer.URL+"/groups/floor-1/stop", "", nil)
+	assert.NoError(t, err)
+
+	var result GroupTickersResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, GroupTickersResponse{Group: "floor-1"}, result)
+}
+
+func Test_SetDeviceFaultsHandler_GivenFaults_HandlerStoresThem(t *testing.T) {
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID()}}
+	r := newRouter(&Controller{mainService: NewService(dao), tickerService: NewTickerService(SystemClock{})})
+	mockServer := httptest.NewServer(r)
+	body := `{"stuck": true, "spike": {"probability": 0.1, "magnitude": 50}}`
+
+	req, _ := http.NewRequest(http.MethodPut, mockServer.URL+"/devices/"+dao.device.Id.Hex()+"/faults", strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	var device Device
+	err = json.NewDecoder(resp.Body).Decode(&device)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, &DeviceFaults{Stuck: true, Spike: &SpikeFault{Probability: 0.1, Magnitude: 50}}, device.Faults)
+}
+
+func Test_SetDeviceFaultsHandler_GivenWrongInput_HandlerReturnsClientError(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	tests := map[string]struct {
+		id       string
+		body     string
+		device   *Device
+		expected int
+	}{
+		"malformed body":      {id: id, body: `{"stuck": "yes"}`, expected: http.StatusBadRequest},
+		"probability above 1": {id: id, body: `{"spike": {"probability": 2}}`, expected: http.StatusBadRequest},
+		"negative dropout":    {id: id, body: `{"dropout": {"period": -1}}`, expected: http.StatusBadRequest},
+		"malformed id":        {id: "abc", body: `{}`, expected: http.StatusBadRequest},
+		"non-existing device": {id: id, body: `{}`, expected: http.StatusNotFound},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newRouter(&Controller{mainService: NewService(&mockDao{}), tickerService: NewTickerService(SystemClock{})})
+			mockServer := httptest.NewServer(r)
+
+			req, _ := http.NewRequest(http.MethodPut, mockServer.URL+"/devices/"+tc.id+"/faults", strings.NewReader(tc.body))
+			resp, err := http.DefaultClient.Do(req)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_ClearDeviceFaultsHandler_GivenDeviceWithFaults_HandlerClearsThem(t *testing.T) {
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID(), Faults: &DeviceFaults{Stuck: true}}}
+	r := newRouter(&Controller{mainService: NewService(dao), tickerService: NewTickerService(SystemClock{})})
+	mockServer := httptest.NewServer(r)
+
+	req, _ := http.NewRequest(http.MethodDelete, mockServer.URL+"/devices/"+dao.device.Id.Hex()+"/faults", nil)
+	resp, err := http.DefaultClient.Do(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, dao.device.Faults)
+}
+
+func Test_BackfillHandler_GivenTimeRange_JobWritesMeasurementsAndCanBeCancelled(t *testing.T) {
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID(), Interval: 1000}}
+	// nothing reads the writes, so the job waits in the middle of its first one
+	influx := &mockInfluxClient{written: make(chan client.BatchPoints)}
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086", Database: "devices"}, SystemClock{})
+	mws.writerClient = influx
+	c := &Controller{mainService: NewService(dao), writerService: mws, jobs: NewJobManager(newMockJobDao())}
+	mockServer := httptest.NewServer(newRouter(c))
+	url := mockServer.URL + "/devices/" + dao.device.Id.Hex() + "/backfill"
+	body := `{"from": "2019-12-01T10:00:00Z", "to": "2019-12-01T13:00:00Z"}`
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	var job Job
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, jobRunning, job.State)
+	assert.Equal(t, jobBackfill, job.Type)
+	assert.Equal(t, dao.device.Id.Hex(), job.Target)
+
+	resp, err = http.Post(url, "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	<-influx.written
+	c.jobs.wait(job.Id)
+
+	resp, err = http.Get(mockServer.URL + "/jobs/" + job.Id.Hex())
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	var result BackfillResult
+	assert.NoError(t, json.Unmarshal(job.Result, &result))
+	assert.Equal(t, jobCancelled, job.State)
+	assert.Equal(t, int64(backfillBatch), result.Written)
+}
+
+func Test_BackfillHandler_GivenWrongInput_HandlerReturnsClientError(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	tests := map[string]struct {
+		id       string
+		body     string
+		expected int
+	}{
+		"malformed body":      {id: id, body: `{"from": "yesterday"}`, expected: http.StatusBadRequest},
+		"empty time range":    {id: id, body: `{"from": "2019-12-01T10:00:00Z", "to": "2019-12-01T10:00:00Z"}`, expected: http.StatusBadRequest},
+		"malformed id":        {id: "abc", body: `{"from": "2019-12-01T10:00:00Z", "to": "2019-12-01T11:00:00Z"}`, expected: http.StatusBadRequest},
+		"non-existing device": {id: id, body: `{"from": "2019-12-01T10:00:00Z", "to": "2019-12-01T11:00:00Z"}`, expected: http.StatusNotFound},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newRouter(&Controller{mainService: NewService(&mockDao{}), jobs: NewJobManager(newMockJobDao())})
+			mockServer := httptest.NewServer(r)
+
+			resp, err := http.Post(mockServer.URL+"/devices/"+tc.id+"/backfill", "application/json", strings.NewReader(tc.body))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_GetBackfillHandler_GivenNoBackfill_HandlerReturns404(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{}), jobs: NewJobManager(newMockJobDao())})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices/" + primitive.NewObjectID().Hex() + "/backfill")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_GetJobsHandler_GivenJobs_HandlerReturnsTheLatestMatchingOnesFirst(t *testing.T) {
+	first := Job{Id: primitive.NewObjectID(), Type: jobExport, State: jobDone}
+	second := Job{Id: primitive.NewObjectID(), Type: jobBackfill, Target: "device", State: jobFailed}
+	third := Job{Id: primitive.NewObjectID(), Type: jobExport, State: jobDone}
+	r := newRouter(&Controller{jobs: NewJobManager(newMockJobDao(first, second, third))})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/jobs?type=export")
+	assert.NoError(t, err)
+	var jobs []Job
+	err = json.NewDecoder(resp.Body).Decode(&jobs)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, third.Id, jobs[0].Id)
+	assert.Equal(t, first.Id, jobs[1].Id)
+}
+
+func Test_GetJobHandler_GivenDifferentIds_HandlerReturnsProperStatusCode(t *testing.T) {
+	job := Job{Id: primitive.NewObjectID(), Type: jobExport, State: jobDone}
+	tests := map[string]struct {
+		id       string
+		method   string
+		expected int
+	}{
+		"existing job":        {id: job.Id.Hex(), method: http.MethodGet, expected: http.StatusOK},
+		"unknown job":         {id: primitive.NewObjectID().Hex(), method: http.MethodGet, expected: http.StatusNotFound},
+		"malformed id":        {id: "abc", method: http.MethodGet, expected: http.StatusBadRequest},
+		"cancel finished job": {id: job.Id.Hex(), method: http.MethodDelete, expected: http.StatusOK},
+		"cancel unknown job":  {id: primitive.NewObjectID().Hex(), method: http.MethodDelete, expected: http.StatusNotFound},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newRouter(&Controller{jobs: NewJobManager(newMockJobDao(job))})
+			mockServer := httptest.NewServer(r)
+
+			req, _ := http.NewRequest(tc.method, mockServer.URL+"/jobs/"+tc.id, nil)
+			resp, err := http.DefaultClient.Do(req)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_AddDevicesBulkHandler_GivenAsync_DevicesAreAddedByAJob(t *testing.T) {
+	dao := &mockDao{}
+	c := &Controller{mainService: NewService(dao), jobs: NewJobManager(newMockJobDao())}
+	mockServer := httptest.NewServer(newRouter(c))
+	body := `[{"name": "first", "interval": "1000"}, {"name": "second", "interval": "2000"}]`
+
+	resp, err := http.Post(mockServer.URL+"/devices:bulk?async=true", contentTypeJSON, strings.NewReader(body))
+	assert.NoError(t, err)
+	var job Job
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	c.jobs.wait(job.Id)
+	finished, err := c.GetJob(job.Id.Hex(), context.TODO())
+	assert.NoError(t, err)
+	var result BulkResult
+	err = json.Unmarshal(finished.Result, &result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, jobBulkImport, job.Type)
+	assert.Equal(t, jobDone, finished.State)
+	assert.Len(t, result.Items, 2)
+	assert.Equal(t, 1, dao.calledTimes)
+}
+
+func Test_ExportDevicesJobHandler_GivenDevices_FileCanBeDownloadedOnceTheJobIsDone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dao := &mockDao{data: []Device{{Id: primitive.NewObjectID(), Name: "a", Interval: 1000, Value: 1}}}
+	c := &Controller{mainService: NewService(dao), jobs: NewJobManager(newMockJobDao()), jobsDir: dir}
+	mockServer := httptest.NewServer(newRouter(c))
+
+	resp, err := http.Post(mockServer.URL+"/devices/export?format=csv", "", nil)
+	assert.NoError(t, err)
+	var job Job
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	c.jobs.wait(job.Id)
+	file, err := http.Get(mockServer.URL + "/jobs/" + job.Id.Hex() + "/file")
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(file.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, http.StatusOK, file.StatusCode)
+	assert.Equal(t, contentTypeCSV, file.Header.Get("Content-Type"))
+	assert.Equal(t, "name,value,interval,unit,labels,groups,jitter,phase,cron,generator\na,1,1000,,,,,,,\n", string(content))
+}
+
+func Test_GetJobFileHandler_GivenJobWithoutFile_HandlerReturns404(t *testing.T) {
+	job := Job{Id: primitive.NewObjectID(), Type: jobBackfill, State: jobDone}
+	r := newRouter(&Controller{jobs: NewJobManager(newMockJobDao(job))})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/jobs/" + job.Id.Hex() + "/file")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_GetMeasurementsHandler_GivenStoredMeasurements_HandlerReturnsThem(t *testing.T) {
+	id := primitive.NewObjectID()
+	timestamp := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	reader := NewMemoryMeasurementReader()
+	reader.Add(Measurement{Id: id, Value: 21.5, Timestamp: timestamp})
+	r := newRouter(&Controller{mainService: NewService(&mockDao{device: &Device{Id: id}}), measurementReader: reader})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices/" + id.Hex() + "/measurements?from=2019-12-01T00:00:00Z")
+	assert.NoError(t, err)
+
+	var result []MeasurementPoint
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []MeasurementPoint{{Timestamp: timestamp, Value: 21.5}}, result)
+}
+
+func Test_GetMeasurementsHandler_GivenDifferentErrors_HandlerReturnsProperStatusCode(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+	tests := map[string]struct {
+		dao      *mockDao
+		url      string
+		expected int
+	}{
+		"device not found": {dao: &mockDao{}, url: "/devices/" + id + "/measurements", expected: http.StatusNotFound},
+		"invalid id":       {dao: &mockDao{}, url: "/devices/abc/measurements", expected: http.StatusBadRequest},
+		"invalid query":    {dao: &mockDao{device: &Device{}}, url: "/devices/" + id + "/measurements?agg=median", expected: http.StatusBadRequest},
+		"dao error":        {dao: &mockDao{returnErr: ErrDao("")}, url: "/devices/" + id + "/measurements", expected: http.StatusInternalServerError},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newRouter(&Controller{mainService: NewService(tc.dao), measurementReader: NewMemoryMeasurementReader()})
+			mockServer := httptest.NewServer(r)
+
+			resp, err := http.Get(mockServer.URL + tc.url)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+}
+
+func Test_StreamHandler_GivenPublishedMeasurements_HandlerStreamsMatchingEvents(t *testing.T) {
+	hub := NewMeasurementHub(4, DropMeasurements)
+	r := newRouter(&Controller{mainService: NewService(&mockDao{}), hub: hub})
+	mockServer := httptest.NewServer(r)
+	defer mockServer.Close()
+	id := primitive.NewObjectID()
+
+	resp, err := http.Get(mockServer.URL + "/stream?labels=site=lab1")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	hub.Publish(Measurement{Id: primitive.NewObjectID(), Value: 1, Labels: map[string]string{"site": "lab2"}})
+	hub.Publish(Measurement{Id: id, Value: 2, Labels: map[string]string{"site": "lab1"}})
+
+	reader := bufio.NewReader(resp.Body)
+	event, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+
+	var result Measurement
+	err = json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &result)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "event: measurement\n", event)
+	assert.Equal(t, id, result.Id)
+	assert.Equal(t, 2.0, result.Value)
+}
+
+func Test_StreamDeviceHandler_GivenNonExistingDevice_HandlerReturns404(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{}), hub: NewMeasurementHub(1, DropMeasurements)})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/devices/" + primitive.NewObjectID().Hex() + "/stream")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_StreamHandler_GivenMalformedLabels_HandlerReturns400(t *testing.T) {
+	r := newRouter(&Controller{mainService: NewService(&mockDao{}), hub: NewMeasurementHub(1, DropMeasurements)})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/stream?labels=site")
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_StatusHandler_GivenQueue_HandlerReportsQueueDepth(t *testing.T) {
+	queue := NewMeasurementQueue(4, DropOldest)
+	queue.Push(Measurement{}, nil)
+	r := newRouter(&Controller{mainService: NewService(&mockDao{}), queue: queue})
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/status")
+	assert.NoError(t, err)
+
+	var result PipelineStatus
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	assert.NoError(t, err)
+	assert.False(t, result.Running)
+	assert.Equal(t, &QueueStatus{Depth: 1, Capacity: 4, Policy: DropOldest}, result.Queue)
+}
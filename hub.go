@@ -0,0 +1,143 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultSubscriptionBuffer = 64
+
+type SlowConsumerPolicy int
+
+const (
+	// DropMeasurements skips measurements which don't fit into the subscriber's buffer
+	DropMeasurements SlowConsumerPolicy = iota
+	// DisconnectSubscriber closes the subscription of a subscriber whose buffer is full
+	DisconnectSubscriber
+)
+
+// MeasurementHub broadcasts measurements to subscribers without ever blocking the publisher,
+// every subscriber has its own buffer and the policy decides what happens once it fills up
+type MeasurementHub struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+	bufferSize  int
+	policy      SlowConsumerPolicy
+}
+
+type Subscription struct {
+	C       <-chan Measurement
+	ch      chan Measurement
+	filter  func(Measurement) bool
+	dropped uint64
+}
+
+// newMeasurementHubFromEnv reads STREAM_BUFFER_SIZE and STREAM_SLOW_CONSUMERS (drop or disconnect)
+func newMeasurementHubFromEnv() *MeasurementHub {
+	bufferSize := 0
+	if bufferSizeStr := os.Getenv("STREAM_BUFFER_SIZE"); bufferSizeStr != "" {
+		var err error
+		if bufferSize, err = convertToPositiveInteger(bufferSizeStr); err != nil {
+			log.Panicf("incorrect stream buffer size: %s: %+v", bufferSizeStr, err.Error())
+		}
+	}
+	policy := DropMeasurements
+	switch os.Getenv("STREAM_SLOW_CONSUMERS") {
+	case "", "drop":
+	case "disconnect":
+		policy = DisconnectSubscriber
+	default:
+		log.Panicf("unknown slow consumer policy: %s", os.Getenv("STREAM_SLOW_CONSUMERS"))
+	}
+	return NewMeasurementHub(bufferSize, policy)
+}
+
+func NewMeasurementHub(bufferSize int, policy SlowConsumerPolicy) *MeasurementHub {
+	if bufferSize <= 0 {
+		bufferSize = defaultSubscriptionBuffer
+	}
+	return &MeasurementHub{
+		subscribers: make(map[*Subscription]struct{}),
+		bufferSize:  bufferSize,
+		policy:      policy,
+	}
+}
+
+// Subscribe registers a subscriber for the measurements accepted by the filter, nil filter accepts everything.
+// C gets closed when the subscriber is disconnected
+func (h *MeasurementHub) Subscribe(filter func(Measurement) bool) *Subscription {
+	ch := make(chan Measurement, h.bufferSize)
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+
+	h.mutex.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mutex.Unlock()
+	return sub
+}
+
+// Unsubscribe is safe to call for a subscription which has already been disconnected
+func (h *MeasurementHub) Unsubscribe(sub *Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.remove(sub)
+}
+
+func (h *MeasurementHub) Publish(measurement Measurement) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for sub := range h.subscribers {
+		if sub.filter != nil && !sub.filter(measurement) {
+			continue
+		}
+		select {
+		case sub.ch <- measurement:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			if h.policy == DisconnectSubscriber {
+				h.remove(sub)
+			}
+		}
+	}
+}
+
+// Forward publishes everything coming from in and passes it on to out, which is closed once in is
+func (h *MeasurementHub) Forward(in <-chan Measurement, out chan<- Measurement) {
+	go func() {
+		defer close(out)
+		for measurement := range in {
+			h.Publish(measurement)
+			out <- measurement
+		}
+	}()
+}
+
+func (h *MeasurementHub) remove(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Dropped tells how many measurements didn't fit into the subscriber's buffer
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func deviceFilter(id primitive.ObjectID) func(Measurement) bool {
+	return func(measurement Measurement) bool {
+		return measurement.Id == id
+	}
+}
+
+func labelsFilter(selector map[string]string) func(Measurement) bool {
+	if len(selector) == 0 {
+		return nil
+	}
+	return func(measurement Measurement) bool {
+		return matchesLabels(measurement.Labels, selector)
+	}
+}
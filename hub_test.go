@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestMeasurementHub_Publish_GivenFilteredSubscribers_OnlyMatchingOnesReceive(t *testing.T) {
+	hub := NewMeasurementHub(4, DropMeasurements)
+	id := primitive.NewObjectID()
+	all := hub.Subscribe(nil)
+	device := hub.Subscribe(deviceFilter(id))
+	labelled := hub.Subscribe(labelsFilter(map[string]string{"site": "lab1"}))
+
+	hub.Publish(Measurement{Id: id, Value: 1})
+	hub.Publish(Measurement{Id: primitive.NewObjectID(), Value: 2, Labels: map[string]string{"site": "lab1"}})
+
+	assert.Len(t, all.C, 2)
+	assert.Len(t, device.C, 1)
+	assert.Equal(t, 1.0, (<-device.C).Value)
+	assert.Len(t, labelled.C, 1)
+	assert.Equal(t, 2.0, (<-labelled.C).Value)
+}
+
+func TestMeasurementHub_Publish_GivenSlowSubscriberAndDropPolicy_HubDropsMeasurements(t *testing.T) {
+	hub := NewMeasurementHub(1, DropMeasurements)
+	sub := hub.Subscribe(nil)
+
+	hub.Publish(Measurement{Value: 1})
+	hub.Publish(Measurement{Value: 2})
+	hub.Publish(Measurement{Value: 3})
+
+	assert.Equal(t, uint64(2), sub.Dropped())
+	assert.Equal(t, 1.0, (<-sub.C).Value)
+	hub.Publish(Measurement{Value: 4})
+	assert.Equal(t, 4.0, (<-sub.C).Value)
+}
+
+func TestMeasurementHub_Publish_GivenSlowSubscriberAndDisconnectPolicy_HubClosesSubscription(t *testing.T) {
+	hub := NewMeasurementHub(1, DisconnectSubscriber)
+	sub := hub.Subscribe(nil)
+
+	hub.Publish(Measurement{Value: 1})
+	hub.Publish(Measurement{Value: 2})
+
+	measurement, ok := <-sub.C
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, measurement.Value)
+	_, ok = <-sub.C
+	assert.False(t, ok)
+	assert.NotPanics(t, func() { hub.Unsubscribe(sub) })
+}
+
+func TestMeasurementHub_Forward_GivenMeasurements_HubPublishesAndPassesThemOn(t *testing.T) {
+	hub := NewMeasurementHub(1, DropMeasurements)
+	sub := hub.Subscribe(nil)
+	in := make(chan Measurement)
+
+	out := make(chan Measurement)
+	hub.Forward(in, out)
+	in <- Measurement{Value: 1}
+
+	assert.Equal(t, 1.0, (<-out).Value)
+	assert.Equal(t, 1.0, (<-sub.C).Value)
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+}
+
+func TestMeasurementHub_Unsubscribe_GivenSubscription_SubscriberStopsReceiving(t *testing.T) {
+	hub := NewMeasurementHub(1, DropMeasurements)
+	sub := hub.Subscribe(nil)
+
+	hub.Unsubscribe(sub)
+	hub.Publish(Measurement{Value: 1})
+
+	_, ok := <-sub.C
+	assert.False(t, ok)
+}
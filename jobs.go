@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// kinds of background jobs
+const (
+	jobBackfill   = "backfill"
+	jobBulkImport = "bulkImport"
+	jobExport     = "export"
+	jobScenario   = "scenario"
+)
+
+// states of a background job
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+	// the service went down while the job was running
+	jobInterrupted = "interrupted"
+)
+
+// how often the progress of a running job gets saved
+const jobSaveInterval = time.Second
+
+const (
+	// how long the files of the jobs are kept unless JOBS_RETENTION says otherwise
+	defaultJobsRetention = 24 * time.Hour
+	// how often the expired files are looked for
+	jobFilesSweepInterval = time.Hour
+)
+
+// jobsRetentionFromEnv reads JOBS_RETENTION (like 24h), how long the files of the finished jobs can be downloaded
+func jobsRetentionFromEnv() time.Duration {
+	retentionStr := os.Getenv("JOBS_RETENTION")
+	if retentionStr == "" {
+		return defaultJobsRetention
+	}
+	retention, err := time.ParseDuration(retentionStr)
+	if err != nil || retention <= 0 {
+		log.Panicf("incorrect jobs retention: %s", retentionStr)
+	}
+	return retention
+}
+
+// Job is a long operation running in the background, it is saved whenever its state changes
+// so that the last state is still there after a restart
+type Job struct {
+	Id   primitive.ObjectID `json:"id" bson:"_id"`
+	Type string             `json:"type" bson:"type"`
+	// Target is what the job works on, like the device of a backfill, a target has one job of a type running at a time
+	Target string `json:"target,omitempty" bson:"target,omitempty"`
+	State  string `json:"state" bson:"state"`
+	// Progress goes from 0 to 1
+	Progress float64 `json:"progress" bson:"progress"`
+	Error    string  `json:"error,omitempty" bson:"error,omitempty"`
+	// Result is what the job reports back, it is kept even when the job fails halfway
+	Result     JobResult  `json:"result,omitempty" bson:"result,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" bson:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+	// File is where the job has left its output, the path doesn't leave the service
+	File string `json:"-" bson:"file,omitempty"`
+}
+
+// JobResult is the result as JSON, it is stored as a string so that any result can be saved
+type JobResult []byte
+
+func (r JobResult) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+func (r *JobResult) UnmarshalJSON(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+func (r JobResult) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bsontype.String, bsoncore.AppendString(nil, string(r)), nil
+}
+
+func (r *JobResult) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t != bsontype.String {
+		*r = nil
+		return nil
+	}
+	value, _, ok := bsoncore.ReadString(data)
+	if !ok {
+		return ErrValidation("malformed job result")
+	}
+	*r = JobResult(value)
+	return nil
+}
+
+// JobQuery narrows down the listed jobs, empty fields match everything
+type JobQuery struct {
+	Type   string
+	Target string
+	State  string
+}
+
+type JobDao interface {
+	SaveJob(job *Job, ctx context.Context) error
+	GetJob(id primitive.ObjectID, ctx context.Context) (*Job, error)
+	// GetJobs returns the latest jobs first
+	GetJobs(query *JobQuery, limit int, ctx context.Context) ([]Job, error)
+	// InterruptJobs marks the jobs which are still running as interrupted
+	InterruptJobs(ctx context.Context) (int64, error)
+	// GetExpiredJobFiles returns the jobs with a file which have either finished before the given time
+	// or haven't got done, their files are of no use
+	GetExpiredJobFiles(finishedBefore time.Time, ctx context.Context) ([]Job, error)
+}
+
+// JobFunc does the work of a job, it returns the result reported back to the client
+type JobFunc func(progress *JobProgress, ctx context.Context) (interface{}, error)
+
+// JobManager runs the jobs in the background and keeps the running ones in memory,
+// the finished ones are only read from the dao
+type JobManager struct {
+	dao JobDao
+
+	mutex   sync.Mutex
+	running map[primitive.ObjectID]*runningJob
+}
+
+type runningJob struct {
+	mutex  sync.Mutex
+	job    Job
+	saved  time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// JobProgress lets the job tell how far it has got
+type JobProgress struct {
+	manager *JobManager
+	job     *runningJob
+}
+
+// NewJobManager marks the jobs left running by the previous process as interrupted, nothing is running them anymore
+func NewJobManager(dao JobDao) *JobManager {
+	interrupted, err := dao.InterruptJobs(context.Background())
+	if err != nil {
+		log.Printf("could not mark the jobs of the previous run as interrupted: %s", err.Error())
+	} else if interrupted > 0 {
+		log.Printf("%d jobs were interrupted by the restart", interrupted)
+	}
+	return &JobManager{
+		dao:     dao,
+		running: make(map[primitive.ObjectID]*runningJob),
+	}
+}
+
+// Start saves the job and runs it in the background, ctx only covers the saving. It fails with ErrJobRunning
+// when there's a job of the same type running for the target
+func (m *JobManager) Start(jobType, target string, fn JobFunc, ctx context.Context) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if target != "" && m.findRunning(jobType, target) != nil {
+		return nil, ErrJobRunning(jobType + " of " + target)
+	}
+
+	now := time.Now()
+	rj := &runningJob{
+		job: Job{
+			Id:        primitive.NewObjectID(),
+			Type:      jobType,
+			Target:    target,
+			State:     jobRunning,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		saved: now,
+		done:  make(chan struct{}),
+	}
+	if err := m.dao.SaveJob(&rj.job, ctx); err != nil {
+		return nil, err
+	}
+	// the job outlives the request which has started it
+	jobCtx, cancel := context.WithCancel(context.Background())
+	rj.cancel = cancel
+	m.running[rj.job.Id] = rj
+
+	go m.run(rj, fn, jobCtx)
+	job := rj.snapshot()
+	return &job, nil
+}
+
+func (m *JobManager) run(rj *runningJob, fn JobFunc, ctx context.Context) {
+	defer close(rj.done)
+	defer rj.cancel()
+	result, err := fn(&JobProgress{manager: m, job: rj}, ctx)
+
+	rj.mutex.Lock()
+	now := time.Now()
+	rj.job.UpdatedAt = now
+	rj.job.FinishedAt = &now
+	switch {
+	case err == nil:
+		rj.job.State = jobDone
+		rj.job.Progress = 1
+	case ctx.Err() == context.Canceled:
+		// whatever the job has failed with, it was because of the cancellation
+		rj.job.State = jobCancelled
+	default:
+		rj.job.State = jobFailed
+		rj.job.Error = err.Error()
+	}
+	if result != nil {
+		if rj.job.Result, err = json.Marshal(result); err != nil {
+			log.Printf("could not keep the result of job %s: %s", rj.job.Id.Hex(), err.Error())
+		}
+	}
+	job := rj.job
+	rj.mutex.Unlock()
+
+	m.save(&job)
+	m.mutex.Lock()
+	delete(m.running, job.Id)
+	m.mutex.Unlock()
+}
+
+func (m *JobManager) save(job *Job) {
+	if err := m.dao.SaveJob(job, context.Background()); err != nil {
+		log.Printf("could not save job %s: %s", job.Id.Hex(), err.Error())
+	}
+}
+
+// Get returns the job, the running ones come with their latest progress
+func (m *JobManager) Get(id string, ctx context.Context) (*Job, error) {
+	objectID, err := stringIDToObjectID(id)
+	if err != nil {
+		return nil, ErrValidation("invalid job id: " + id)
+	}
+	if rj := m.getRunning(objectID); rj != nil {
+		job := rj.snapshot()
+		return &job, nil
+	}
+	job, err := m.dao.GetJob(objectID, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	return job, nil
+}
+
+// List returns the latest jobs first
+func (m *JobManager) List(query *JobQuery, limit int, ctx context.Context) ([]Job, error) {
+	jobs, err := m.dao.GetJobs(query, limit, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if rj := m.getRunning(jobs[i].Id); rj != nil {
+			jobs[i] = rj.snapshot()
+		}
+	}
+	return jobs, nil
+}
+
+// Latest returns the latest job of the type for the target
+func (m *JobManager) Latest(jobType, target string, ctx context.Context) (*Job, error) {
+	jobs, err := m.List(&JobQuery{Type: jobType, Target: target}, 1, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &jobs[0], nil
+}
+
+// Cancel asks the running job to stop, the job stays running until it has done so.
+// Cancelling a job which is over changes nothing
+func (m *JobManager) Cancel(id string, ctx context.Context) (*Job, error) {
+	job, err := m.Get(id, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rj := m.getRunning(job.Id); rj != nil {
+		rj.cancel()
+	}
+	return job, nil
+}
+
+// IsRunning tells whether there's a job of the type running for the target
+func (m *JobManager) IsRunning(jobType, target string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.findRunning(jobType, target) != nil
+}
+
+func (m *JobManager) getRunning(id primitive.ObjectID) *runningJob {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.running[id]
+}
+
+// findRunning requires the mutex to be held
+func (m *JobManager) findRunning(jobType, target string) *runningJob {
+	for _, rj := range m.running {
+		if rj.job.Type == jobType && rj.job.Target == target {
+			return rj
+		}
+	}
+	return nil
+}
+
+// wait blocks until the job is over, it is there for the tests
+func (m *JobManager) wait(id primitive.ObjectID) {
+	if rj := m.getRunning(id); rj != nil {
+		<-rj.done
+	}
+}
+
+func (rj *runningJob) snapshot() Job {
+	rj.mutex.Lock()
+	defer rj.mutex.Unlock()
+	return rj.job
+}
+
+// Set updates the progress, it gets saved at most once every jobSaveInterval
+func (p *JobProgress) Set(progress float64) {
+	if p == nil {
+		return
+	}
+	p.job.mutex.Lock()
+	now := time.Now()
+	p.job.job.Progress = progress
+	p.job.job.UpdatedAt = now
+	save := now.Sub(p.job.saved) >= jobSaveInterval
+	if save {
+		p.job.saved = now
+	}
+	job := p.job.job
+	p.job.mutex.Unlock()
+
+	if save {
+		p.manager.save(&job)
+	}
+}
+
+// SetFile tells where the output of the job is, it is saved right away so that the file of a job
+// interrupted by a restart can still be found and removed
+func (p *JobProgress) SetFile(path string) {
+	if p == nil {
+		return
+	}
+	p.job.mutex.Lock()
+	p.job.job.File = path
+	job := p.job.job
+	p.job.mutex.Unlock()
+	p.manager.save(&job)
+}
+
+// RemoveExpiredFiles removes the files of the jobs which have finished before the retention
+// and of the ones which haven't got done, it returns how many files were removed
+func (m *JobManager) RemoveExpiredFiles(retention time.Duration, ctx context.Context) (int, error) {
+	jobs, err := m.dao.GetExpiredJobFiles(time.Now().Add(-retention), ctx)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := range jobs {
+		job := &jobs[i]
+		if err := os.Remove(job.File); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove the file of job %s: %s", job.Id.Hex(), err.Error())
+			continue
+		}
+		job.File = ""
+		m.save(job)
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockJobDao keeps the jobs in memory, the latest ones last
+type mockJobDao struct {
+	mutex       sync.Mutex
+	jobs        []Job
+	interrupted int64
+}
+
+func newMockJobDao(jobs ...Job) *mockJobDao {
+	return &mockJobDao{jobs: jobs}
+}
+
+func (m *mockJobDao) SaveJob(job *Job, ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.jobs {
+		if m.jobs[i].Id == job.Id {
+			m.jobs[i] = *job
+			return nil
+		}
+	}
+	m.jobs = append(m.jobs, *job)
+	return nil
+}
+
+func (m *mockJobDao) GetJob(id primitive.ObjectID, ctx context.Context) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, job := range m.jobs {
+		if job.Id == id {
+			return &job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockJobDao) GetJobs(query *JobQuery, limit int, ctx context.Context) ([]Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	jobs := make([]Job, 0)
+	for i := len(m.jobs) - 1; i >= 0 && len(jobs) < limit; i-- {
+		job := m.jobs[i]
+		if (query.Type == "" || query.Type == job.Type) && (query.Target == "" || query.Target == job.Target) &&
+			(query.State == "" || query.State == job.State) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (m *mockJobDao) InterruptJobs(ctx context.Context) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.jobs {
+		if m.jobs[i].State == jobRunning {
+			m.jobs[i].State = jobInterrupted
+			m.interrupted++
+		}
+	}
+	return m.interrupted, nil
+}
+
+func (m *mockJobDao) GetExpiredJobFiles(finishedBefore time.Time, ctx context.Context) ([]Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	jobs := make([]Job, 0)
+	for _, job := range m.jobs {
+		if job.File != "" && (job.State == jobFailed || job.State == jobCancelled || job.State == jobInterrupted ||
+			job.FinishedAt != nil && job.FinishedAt.Before(finishedBefore)) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (m *mockJobDao) saved(id primitive.ObjectID) Job {
+	job, _ := m.GetJob(id, context.TODO())
+	return *job
+}
+
+func TestJobManager_Start_GivenSucceedingJob_ResultAndStateAreSaved(t *testing.T) {
+	dao := newMockJobDao()
+	m := NewJobManager(dao)
+
+	job, err := m.Start(jobBulkImport, "", func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		progress.Set(0.5)
+		return map[string]int{"added": 3}, nil
+	}, context.TODO())
+	assert.NoError(t, err)
+	m.wait(job.Id)
+
+	saved := dao.saved(job.Id)
+	assert.Equal(t, jobRunning, job.State)
+	assert.Equal(t, jobDone, saved.State)
+	assert.Equal(t, 1.0, saved.Progress)
+	assert.JSONEq(t, `{"added": 3}`, string(saved.Result))
+	assert.NotNil(t, saved.FinishedAt)
+}
+
+func TestJobManager_Start_GivenFailingJob_ErrorIsSaved(t *testing.T) {
+	dao := newMockJobDao()
+	m := NewJobManager(dao)
+
+	job, _ := m.Start(jobExport, "", func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		return nil, errors.New("disk full")
+	}, context.TODO())
+	m.wait(job.Id)
+
+	saved := dao.saved(job.Id)
+	assert.Equal(t, jobFailed, saved.State)
+	assert.Equal(t, "disk full", saved.Error)
+	assert.Nil(t, saved.Result)
+}
+
+func TestJobManager_Cancel_GivenRunningJob_JobStopsAsCancelled(t *testing.T) {
+	dao := newMockJobDao()
+	m := NewJobManager(dao)
+	started := make(chan struct{})
+	job, _ := m.Start(jobScenario, "demo", func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, errors.New("stopped halfway")
+	}, context.TODO())
+	<-started
+
+	running, err := m.Get(job.Id.Hex(), context.TODO())
+	assert.NoError(t, err)
+	assert.True(t, m.IsRunning(jobScenario, "demo"))
+	cancelled, err := m.Cancel(job.Id.Hex(), context.TODO())
+	assert.NoError(t, err)
+	m.wait(job.Id)
+	finished, err := m.Get(job.Id.Hex(), context.TODO())
+
+	assert.NoError(t, err)
+	assert.Equal(t, jobRunning, running.State)
+	assert.Equal(t, job.Id, cancelled.Id)
+	assert.Equal(t, jobCancelled, finished.State)
+	assert.False(t, m.IsRunning(jobScenario, "demo"))
+}
+
+func TestJobManager_Start_GivenJobRunningForTheTarget_ReturnsErrJobRunning(t *testing.T) {
+	m := NewJobManager(newMockJobDao())
+	release := make(chan struct{})
+	block := func(progress *JobProgress, ctx context.Context) (interface{}, error) {
+		<-release
+		return nil, nil
+	}
+	first, _ := m.Start(jobBackfill, "device", block, context.TODO())
+
+	_, sameTarget := m.Start(jobBackfill, "device", block, context.TODO())
+	other, otherTarget := m.Start(jobBackfill, "other", block, context.TODO())
+	close(release)
+	m.wait(first.Id)
+	m.wait(other.Id)
+
+	assert.IsType(t, ErrJobRunning(""), sameTarget)
+	assert.NoError(t, otherTarget)
+}
+
+func TestNewJobManager_GivenJobsLeftRunning_TheyAreMarkedInterrupted(t *testing.T) {
+	dao := newMockJobDao(Job{Id: primitive.NewObjectID(), State: jobRunning}, Job{Id: primitive.NewObjectID(), State: jobDone})
+
+	NewJobManager(dao)
+
+	assert.Equal(t, jobInterrupted, dao.jobs[0].State)
+	assert.Equal(t, jobDone, dao.jobs[1].State)
+}
+
+func TestJobManager_RemoveExpiredFiles_GivenOldAndUnfinishedJobs_TheirFilesAreRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	newFile := func() string {
+		file, err := ioutil.TempFile(dir, "export-*.csv")
+		assert.NoError(t, err)
+		_ = file.Close()
+		return file.Name()
+	}
+	recent := time.Now().Add(-time.Hour)
+	old := time.Now().Add(-48 * time.Hour)
+	interrupted := Job{Id: primitive.NewObjectID(), State: jobInterrupted, FinishedAt: &recent, File: newFile()}
+	expired := Job{Id: primitive.NewObjectID(), State: jobDone, FinishedAt: &old, File: newFile()}
+	kept := Job{Id: primitive.NewObjectID(), State: jobDone, FinishedAt: &recent, File: newFile()}
+	dao := newMockJobDao(interrupted, expired, kept)
+	m := NewJobManager(dao)
+
+	removed, err := m.RemoveExpiredFiles(24*time.Hour, context.TODO())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	for _, job := range []Job{interrupted, expired} {
+		_, err := os.Stat(job.File)
+		assert.True(t, os.IsNotExist(err))
+		assert.Empty(t, dao.saved(job.Id).File)
+	}
+	_, err = os.Stat(kept.File)
+	assert.NoError(t, err)
+	assert.Equal(t, kept.File, dao.saved(kept.Id).File)
+}
+
+func TestJobManager_Get_GivenUnknownOrMalformedId_ReturnsError(t *testing.T) {
+	m := NewJobManager(newMockJobDao())
+
+	_, unknown := m.Get(primitive.NewObjectID().Hex(), context.TODO())
+	_, malformed := m.Get("abc", context.TODO())
+
+	assert.Equal(t, mongo.ErrNoDocuments, unknown)
+	assert.IsType(t, ErrValidation(""), malformed)
+}
+
+func TestJobResult_GivenBsonRoundTrip_ResultIsKeptAsJSON(t *testing.T) {
+	job := Job{Id: primitive.NewObjectID(), Result: JobResult(`{"written":10}`)}
+
+	data, err := bson.Marshal(job)
+	assert.NoError(t, err)
+	var raw bson.M
+	assert.NoError(t, bson.Unmarshal(data, &raw))
+	var decoded Job
+	assert.NoError(t, bson.Unmarshal(data, &decoded))
+
+	assert.Equal(t, `{"written":10}`, raw["result"])
+	assert.Equal(t, job.Result, decoded.Result)
+}
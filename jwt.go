@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how much the clocks of the issuer and of the service may disagree
+	jwtLeeway = 30 * time.Second
+	// the key set is fetched again for an unknown key id at most this often
+	jwksMinRefresh = 30 * time.Second
+	jwksTimeout    = 10 * time.Second
+)
+
+// jwtAlgorithms are the signatures which are accepted, the symmetric ones and "none" never are
+// an ES algorithm only goes with the keys on its own curve
+var jwtAlgorithms = map[string]struct {
+	keyType string
+	hash    crypto.Hash
+	curve   string
+}{
+	"RS256": {"RSA", crypto.SHA256, ""},
+	"RS384": {"RSA", crypto.SHA384, ""},
+	"RS512": {"RSA", crypto.SHA512, ""},
+	"ES256": {"EC", crypto.SHA256, "P-256"},
+	"ES384": {"EC", crypto.SHA384, "P-384"},
+	"ES512": {"EC", crypto.SHA512, "P-521"},
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type verificationKey struct {
+	kid string
+	kty string
+	alg string
+	crv string
+	key crypto.PublicKey
+}
+
+// JwksKeySet keeps the signing keys of the issuer, source is either a file or an http(s) URL.
+// The keys are read again when a token comes with a key id which isn't known, so that rotated keys get picked up
+type JwksKeySet struct {
+	source string
+	client *http.Client
+	clock  Clock
+
+	mutex   sync.Mutex
+	keys    []verificationKey
+	fetched time.Time
+}
+
+func NewJwksKeySet(source string, clock Clock) *JwksKeySet {
+	s := &JwksKeySet{source: source, client: &http.Client{Timeout: jwksTimeout}, clock: clock}
+	s.fetched = clock.Now()
+	keys, err := s.load()
+	if err != nil {
+		// the issuer may just not be up yet, the next token tries again
+		log.Printf("could not read the JWKS from %s: %s", source, err.Error())
+	}
+	s.keys = keys
+	return s
+}
+
+// find returns the key the token was signed with, nil if there's no such key.
+// The key set is fetched without holding the mutex, so that a slow issuer doesn't hold up the tokens signed with known keys
+func (s *JwksKeySet) find(kid, alg string) *verificationKey {
+	s.mutex.Lock()
+	key := s.lookup(kid, alg)
+	// whoever finds the key set due for a refresh fetches it, the others go on with the keys there are
+	refresh := key == nil && s.clock.Now().Sub(s.fetched) >= jwksMinRefresh
+	if refresh {
+		s.fetched = s.clock.Now()
+	}
+	s.mutex.Unlock()
+	if !refresh {
+		return key
+	}
+
+	keys, err := s.load()
+	if err != nil {
+		log.Printf("could not read the JWKS from %s: %s", s.source, err.Error())
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+	return s.lookup(kid, alg)
+}
+
+// lookup requires the mutex to be held, a token without a key id can only be matched to a lone key
+func (s *JwksKeySet) lookup(kid, alg string) *verificationKey {
+	var found *verificationKey
+	algorithm := jwtAlgorithms[alg]
+	for i := range s.keys {
+		key := &s.keys[i]
+		if key.kty != algorithm.keyType || key.crv != algorithm.curve || (key.alg != "" && key.alg != alg) {
+			continue
+		}
+		if kid == "" {
+			if found != nil {
+				return nil
+			}
+			found = key
+		} else if key.kid == kid {
+			return key
+		}
+	}
+	return found
+}
+
+// load reads the keys of the set, the mutex doesn't have to be held
+func (s *JwksKeySet) load() ([]verificationKey, error) {
+	data, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make([]verificationKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("skipping JWK %q: %s", jwk.Kid, err.Error())
+			continue
+		}
+		keys = append(keys, verificationKey{kid: jwk.Kid, kty: jwk.Kty, alg: jwk.Alg, crv: jwk.Crv, key: key})
+	}
+	return keys, nil
+}
+
+func (s *JwksKeySet) read() ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return ioutil.ReadFile(s.source)
+	}
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrValidation("JWKS endpoint replied with " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, ErrValidation("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, ErrValidation("unsupported curve " + k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, ErrValidation("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, ErrValidation("unsupported key type " + k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrValidation("missing key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// JwtValidator checks bearer tokens issued by the platform and turns their scope claim into the scopes of the routes
+type JwtValidator struct {
+	keys     *JwksKeySet
+	audience string
+	// no check of the issuer when empty
+	issuer string
+	// the claim holding the scopes, either a space separated string or an array
+	scopeClaim string
+	clock      Clock
+}
+
+// newJwtValidatorFromEnv returns nil when JWT_JWKS isn't set, JWT_AUDIENCE is required then
+func newJwtValidatorFromEnv() *JwtValidator {
+	source := os.Getenv("JWT_JWKS")
+	if source == "" {
+		return nil
+	}
+	audience := os.Getenv("JWT_AUDIENCE")
+	if audience == "" {
+		log.Panicf("JWT_AUDIENCE is required together with JWT_JWKS")
+	}
+	scopeClaim := os.Getenv("JWT_SCOPE_CLAIM")
+	if scopeClaim == "" {
+		scopeClaim = "scope"
+	}
+	clock := SystemClock{}
+	return NewJwtValidator(NewJwksKeySet(source, clock), audience, os.Getenv("JWT_ISSUER"), scopeClaim, clock)
+}
+
+func NewJwtValidator(keys *JwksKeySet, audience, issuer, scopeClaim string, clock Clock) *JwtValidator {
+	return &JwtValidator{keys: keys, audience: audience, issuer: issuer, scopeClaim: scopeClaim, clock: clock}
+}
+
+// Validate returns the principal of the token, ErrUnauthorized if the token isn't signed by the issuer,
+// has expired or was issued for someone else
+func (v *JwtValidator) Validate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, ErrUnauthorized("malformed token header")
+	}
+	algorithm, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, ErrUnauthorized("unsupported algorithm " + header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrUnauthorized("malformed token signature")
+	}
+	key := v.keys.find(header.Kid, header.Alg)
+	if key == nil {
+		return nil, ErrUnauthorized("unknown signing key")
+	}
+	hash := algorithm.hash.New()
+	hash.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key.key, algorithm.hash, hash.Sum(nil), signature) {
+		return nil, ErrUnauthorized("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, ErrUnauthorized("malformed token claims")
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	subject, _ := claims["sub"].(string)
+	return &Principal{Name: "jwt:" + subject, Scopes: v.scopes(claims)}, nil
+}
+
+func (v *JwtValidator) checkClaims(claims map[string]interface{}) error {
+	now := v.clock.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return ErrUnauthorized("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return ErrUnauthorized("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return ErrUnauthorized("token is not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return ErrUnauthorized("token has the wrong issuer")
+	}
+	if !containsString(claimStrings(claims["aud"]), v.audience) {
+		return ErrUnauthorized("token has the wrong audience")
+	}
+	return nil
+}
+
+// scopes keeps the values of the scope claim which are scopes of the routes, the others mean nothing here
+func (v *JwtValidator) scopes(claims map[string]interface{}) []string {
+	scopes := make([]string, 0)
+	for _, scope := range claimStrings(claims[v.scopeClaim]) {
+		if knownScopes[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// claimStrings reads a claim which is either a space separated string or an array of strings
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// the signature is r and s one after the other, each the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAudience = "device-service"
+
+var jwtEpoch = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+var testRsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func rsaJwk(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJwk(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func writeJwks(t *testing.T, keys ...map[string]string) string {
+	dir, err := ioutil.TempDir("", "jwks")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "jwks.json")
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func signRS256(kid string, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(kid string, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	return signES("ES256", crypto.SHA256, kid, key, claims)
+}
+
+// signES signs with whatever the algorithm and the curve of the key are, even when they don't go together
+func signES(alg string, hash crypto.Hash, kid string, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	signed := encodeSegment(map[string]string{"alg": alg, "kid": kid}) + "." + encodeSegment(claims)
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[size-len(rBytes):size], rBytes)
+	copy(signature[2*size-len(sBytes):], sBytes)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "svc-platform",
+		"aud":   []string{"other", testAudience},
+		"exp":   jwtEpoch.Add(time.Hour).Unix(),
+		"scope": scope,
+	}
+}
+
+func newTestJwtValidator(t *testing.T, clock Clock, keys ...map[string]string) *JwtValidator {
+	return NewJwtValidator(NewJwksKeySet(writeJwks(t, keys...), clock), testAudience, "", "scope", clock)
+}
+
+func TestJwtValidator_Validate_GivenValidToken_ReturnsPrincipalWithKnownScopes(t *testing.T) {
+	v := newTestJwtValidator(t, NewFakeClock(jwtEpoch), rsaJwk("k1", &testRsaKey.PublicKey))
+
+	principal, err := v.Validate(signRS256("k1", testRsaKey, testClaims("devices:read openid pipeline:control")))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "jwt:svc-platform", principal.Name)
+	assert.Equal(t, []string{scopeDevicesRead, scopePipelineControl}, principal.Scopes)
+}
+
+func TestJwtValidator_Validate_GivenEcdsaToken_TokenIsAccepted(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := newTestJwtValidator(t, NewFakeClock(jwtEpoch), ecJwk("ec", &key.PublicKey))
+	claims := testClaims("")
+	claims["scp"] = []string{scopeDevicesWrite}
+	v.scopeClaim = "scp"
+
+	principal, err := v.Validate(signES256("ec", key, claims))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{scopeDevicesWrite}, principal.Scopes)
+}
+
+func TestJwtValidator_Validate_GivenEcdsaAlgorithmOfAnotherCurve_ReturnsErrUnauthorized(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := newTestJwtValidator(t, NewFakeClock(jwtEpoch), ecJwk("ec", &key.PublicKey))
+
+	_, es384 := v.Validate(signES("ES384", crypto.SHA384, "ec", key, testClaims("")))
+	_, es512 := v.Validate(signES("ES512", crypto.SHA512, "ec", key, testClaims("")))
+
+	assert.IsType(t, ErrUnauthorized(""), es384)
+	assert.IsType(t, ErrUnauthorized(""), es512)
+}
+
+func TestJwtValidator_Validate_GivenInvalidTokens_ReturnsErrUnauthorized(t *testing.T) {
+	clock := NewFakeClock(jwtEpoch.Add(time.Hour + time.Minute))
+	v := newTestJwtValidator(t, clock, rsaJwk("k1", &testRsaKey.PublicKey))
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	wrongAudience := testClaims("devices:read")
+	wrongAudience["aud"] = "other"
+	valid := testClaims("devices:read")
+	valid["exp"] = clock.Now().Add(time.Hour).Unix()
+	unsigned := encodeSegment(map[string]string{"alg": "none"}) + "." + encodeSegment(valid) + "."
+
+	tokens := map[string]string{
+		"expired":        signRS256("k1", testRsaKey, testClaims("devices:read")),
+		"wrong audience": signRS256("k1", testRsaKey, wrongAudience),
+		"wrong key":      signRS256("k1", otherKey, valid),
+		"unknown key":    signRS256("k2", testRsaKey, valid),
+		"unsigned":       unsigned,
+		"malformed":      "abc",
+	}
+	for name, token := range tokens {
+		_, err := v.Validate(token)
+		assert.IsType(t, ErrUnauthorized(""), err, name)
+	}
+	_, err := v.Validate(signRS256("k1", testRsaKey, valid))
+	assert.NoError(t, err)
+}
+
+func TestJwksKeySet_Find_GivenRotatedKey_KeySetIsFetchedAgain(t *testing.T) {
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var rotated int32
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		keys := []map[string]string{rsaJwk("k1", &testRsaKey.PublicKey)}
+		if atomic.LoadInt32(&rotated) == 1 {
+			keys = append(keys, rsaJwk("k2", &newKey.PublicKey))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+	clock := NewFakeClock(jwtEpoch)
+	v := NewJwtValidator(NewJwksKeySet(server.URL, clock), testAudience, "", "scope", clock)
+	token := signRS256("k2", newKey, testClaims("devices:read"))
+
+	atomic.StoreInt32(&rotated, 1)
+	_, tooSoon := v.Validate(token)
+	clock.Advance(jwksMinRefresh)
+	_, afterRefresh := v.Validate(token)
+
+	assert.Error(t, tooSoon)
+	assert.NoError(t, afterRefresh)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestJwksKeySet_Find_GivenSlowRefresh_KnownKeysAreStillFound(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJwk("k1", &testRsaKey.PublicKey)}})
+	}))
+	defer server.Close()
+	defer close(release)
+	clock := NewFakeClock(jwtEpoch)
+	v := NewJwtValidator(NewJwksKeySet(server.URL, clock), testAudience, "", "scope", clock)
+	clock.Advance(jwksMinRefresh)
+
+	go func() { _, _ = v.Validate(signRS256("k2", testRsaKey, testClaims("devices:read"))) }()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&fetches) == 2 }, time.Second, time.Millisecond)
+	validated := make(chan error, 1)
+	go func() {
+		_, err := v.Validate(signRS256("k1", testRsaKey, testClaims("devices:read")))
+		validated <- err
+	}()
+
+	select {
+	case err := <-validated:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the known key waited for the refresh")
+	}
+}
+
+func TestAuthenticator_Middleware_GivenBearerTokens_RepliesWithProblems(t *testing.T) {
+	a := NewAuthenticator(&mockApiKeyDao{}, "")
+	a.tokens = newTestJwtValidator(t, NewFakeClock(jwtEpoch), rsaJwk("k1", &testRsaKey.PublicKey))
+	server := httptest.NewServer(newRouter(&Controller{mainService: NewService(&mockDao{}), auth: a}))
+	defer server.Close()
+	expired := testClaims("devices:read")
+	expired["exp"] = jwtEpoch.Add(-time.Hour).Unix()
+	get := func(token string) (*http.Response, Problem) {
+		request, _ := http.NewRequest("GET", server.URL+"/devices", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		var problem Problem
+		if resp.StatusCode != http.StatusOK {
+			assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+		}
+		return resp, problem
+	}
+
+	ok, _ := get(signRS256("k1", testRsaKey, testClaims("devices:read")))
+	unauthorized, expiredProblem := get(signRS256("k1", testRsaKey, expired))
+	forbidden, forbiddenProblem := get(signRS256("k1", testRsaKey, testClaims("devices:write")))
+
+	assert.Equal(t, http.StatusOK, ok.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, unauthorized.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, expiredProblem.Status)
+	assert.Contains(t, expiredProblem.Detail, "expired")
+	assert.Contains(t, unauthorized.Header.Get("WWW-Authenticate"), `error="invalid_token"`)
+	assert.Equal(t, http.StatusForbidden, forbidden.StatusCode)
+	assert.Equal(t, ErrForbidden(scopeDevicesRead).Error(), forbiddenProblem.Detail)
+	assert.Contains(t, forbidden.Header.Get("WWW-Authenticate"), `error="insufficient_scope"`)
+}
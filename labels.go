@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/go-playground/validator/v10"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// label names double as document keys and influx tag keys, so they're kept plain
+	labelNameRegex  = regexp.MustCompile(`^[A-Za-z0-9_-]{1,63}$`)
+	labelValueRegex = regexp.MustCompile(`^[^,=]{1,255}$`)
+)
+
+// parseLabels reads labels in the selector format: site=lab1,type=thermo
+func parseLabels(selector string) (map[string]string, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(selector, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrValidation("label must be in the key=value form: " + pair)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !labelNameRegex.MatchString(key) || !labelValueRegex.MatchString(value) {
+			return nil, ErrValidation("invalid label: " + pair)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// formatLabels is the inverse of parseLabels, keys are sorted so that the output is stable
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func parseGroups(groups string) []string {
+	if strings.TrimSpace(groups) == "" {
+		return nil
+	}
+	result := strings.Split(groups, ",")
+	for i := range result {
+		result[i] = strings.TrimSpace(result[i])
+	}
+	return result
+}
+
+func formatGroups(groups []string) string {
+	return strings.Join(groups, ",")
+}
+
+// matchesLabels tells whether all the labels from the selector are present with the same values
+func matchesLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func validateLabelName(fl validator.FieldLevel) bool {
+	return labelNameRegex.MatchString(fl.Field().String())
+}
+
+func validateLabelValue(fl validator.FieldLevel) bool {
+	return labelValueRegex.MatchString(fl.Field().String())
+}
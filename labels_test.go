@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_ParseLabels_GivenSelector_FuncReturnsLabels(t *testing.T) {
+	labels, err := parseLabels("site=lab1, type=thermo")
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"site": "lab1", "type": "thermo"}, labels)
+}
+
+func Test_ParseLabels_GivenEmptySelector_FuncReturnsNil(t *testing.T) {
+	labels, err := parseLabels(" ")
+
+	assert.NoError(t, err)
+	assert.Nil(t, labels)
+}
+
+func Test_ParseLabels_GivenMalformedSelector_FuncReturnsErrValidation(t *testing.T) {
+	tests := map[string]string{
+		"no value":        "site",
+		"empty key":       "=lab1",
+		"empty value":     "site=",
+		"dot in key":      "site.name=lab1",
+		"dollar in key":   "$site=lab1",
+		"trailing comma":  "site=lab1,",
+		"equals in value": "site=lab=1",
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseLabels(tc)
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
+
+func Test_FormatLabels_GivenLabels_FuncReturnsSortedSelectorThatParsesBack(t *testing.T) {
+	labels := map[string]string{"type": "thermo", "site": "lab 1"}
+
+	selector := formatLabels(labels)
+	parsed, err := parseLabels(selector)
+
+	assert.Equal(t, "site=lab 1,type=thermo", selector)
+	assert.NoError(t, err)
+	assert.Equal(t, labels, parsed)
+}
+
+func Test_MatchesLabels_GivenDifferentSelectors_FuncReturnsWhetherAllMatch(t *testing.T) {
+	labels := map[string]string{"site": "lab1", "type": "thermo"}
+	tests := map[string]struct {
+		selector map[string]string
+		expected bool
+	}{
+		"empty selector":  {selector: nil, expected: true},
+		"subset":          {selector: map[string]string{"site": "lab1"}, expected: true},
+		"all":             {selector: map[string]string{"site": "lab1", "type": "thermo"}, expected: true},
+		"different value": {selector: map[string]string{"site": "lab2"}, expected: false},
+		"missing key":     {selector: map[string]string{"floor": "1"}, expected: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, matchesLabels(labels, tc.selector))
+		})
+	}
+}
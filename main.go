@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
 	"net/http"
+	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 // reads through the temperatures provided by lm-sensors
@@ -18,10 +25,63 @@ func valueService(n int) float64 {
 }
 
 func main() {
-	s := NewService(NewDao())
-	c := NewController(s)
+	scenarioPath := flag.String("scenario", "", "YAML file of a scenario to run once the pipeline has started")
+	flag.Parse()
 
-	r := newRouter(c)
+	dao := NewDao()
+	c := NewController(NewService(dao), dao, dao, dao, dao)
+	if *scenarioPath != "" {
+		runScenarioFile(c, *scenarioPath)
+	} else if pipelineAutostartFromEnv() {
+		go c.Resume()
+	}
 
-	http.ListenAndServe(":8000", r)
+	server := &http.Server{Addr: ":8000", Handler: newRouter(c), TLSConfig: tlsConfigFromEnv()}
+	go shutdownOnSignal(server, c)
+	var err error
+	if server.TLSConfig != nil {
+		// the certificate comes from the config so that it can be reloaded
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("server failed: %s", err.Error())
+	}
+}
+
+// shutdownOnSignal lets the requests in flight finish and closes the pipeline once the service is asked to stop
+func shutdownOnSignal(server *http.Server, c *Controller) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("server did not shut down cleanly: %s", err.Error())
+	}
+	c.Close()
+}
+
+// runScenarioFile starts the pipeline and the scenario, any failure stops the service from starting
+func runScenarioFile(c *Controller, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("could not open the scenario: %s", err.Error())
+	}
+	defer file.Close()
+
+	scenario, err := LoadScenario(file)
+	if err != nil {
+		log.Fatalf("could not load the scenario: %s", err.Error())
+	}
+	if err = c.StartTickerService(); err != nil {
+		log.Fatalf("could not start the pipeline: %s", err.Error())
+	}
+	run, err := c.RunScenario(scenario, context.Background())
+	if err != nil {
+		log.Fatalf("could not run the scenario: %s", err.Error())
+	}
+	log.Printf("scenario %s started with %d devices", run.Name, len(run.Devices))
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb1-client/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMeasurementsLimit = 1000
+	maxMeasurementsLimit     = 10000
+)
+
+var measurementAggregations = map[string]bool{"mean": true, "min": true, "max": true, "last": true}
+
+// MeasurementQuery describes which of the device's past values should be read,
+// zero From or To leave the range open on that side
+type MeasurementQuery struct {
+	DeviceId    primitive.ObjectID
+	From        time.Time
+	To          time.Time
+	Limit       int
+	Aggregation string
+	Window      time.Duration
+}
+
+type MeasurementPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// MeasurementReader returns points in ascending time order, when there are more than Limit of them
+// the most recent ones are returned
+type MeasurementReader interface {
+	ReadMeasurements(query *MeasurementQuery, ctx context.Context) ([]MeasurementPoint, error)
+}
+
+// parseMeasurementQuery reads from and to (RFC3339), limit, agg (mean, min, max or last) and window (e.g. 5m)
+func parseMeasurementQuery(values url.Values) (*MeasurementQuery, error) {
+	query := &MeasurementQuery{Aggregation: values.Get("agg")}
+
+	var err error
+	if query.From, err = readOptionalTime(values, "from"); err != nil {
+		return nil, err
+	}
+	if query.To, err = readOptionalTime(values, "to"); err != nil {
+		return nil, err
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && query.To.Before(query.From) {
+		return nil, ErrValidation("to must not be before from")
+	}
+
+	limit, err := readOptionalInt(values, "limit")
+	if err != nil {
+		return nil, err
+	}
+	query.Limit = defaultMeasurementsLimit
+	if limit != nil {
+		query.Limit = *limit
+	}
+	if query.Limit == 0 || query.Limit > maxMeasurementsLimit {
+		return nil, ErrValidation(fmt.Sprintf("limit must be between 1 and %d", maxMeasurementsLimit))
+	}
+
+	if query.Aggregation != "" && !measurementAggregations[query.Aggregation] {
+		return nil, ErrValidation("unknown aggregation: " + query.Aggregation)
+	}
+	if windowStr := values.Get("window"); windowStr != "" {
+		if query.Window, err = time.ParseDuration(windowStr); err != nil {
+			return nil, ErrValidation("window: " + err.Error())
+		}
+		if query.Window < time.Millisecond {
+			return nil, ErrValidation("window must be at least 1ms")
+		}
+		if query.Aggregation == "" {
+			return nil, ErrValidation("window requires an aggregation")
+		}
+		if query.From.IsZero() {
+			return nil, ErrValidation("window requires from")
+		}
+	}
+
+	return query, nil
+}
+
+func readOptionalTime(values url.Values, param string) (time.Time, error) {
+	valueStr := values.Get(param)
+	if valueStr == "" {
+		return time.Time{}, nil
+	}
+	value, err := time.Parse(time.RFC3339Nano, valueStr)
+	if err != nil {
+		return time.Time{}, ErrValidation(param + ": " + err.Error())
+	}
+	return value, nil
+}
+
+// InfluxMeasurementReader reads back what MeasurementsWriterService writes
+type InfluxMeasurementReader struct {
+	db              string
+	measurementName string
+	readerClient    client.Client
+}
+
+func NewInfluxMeasurementReader(config InfluxConfig) *InfluxMeasurementReader {
+	config.setDefaults()
+	clt, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr: config.Address,
+	})
+	if err != nil {
+		log.Panicf("could not initialize influx connection: %s", err.Error())
+	}
+	return &InfluxMeasurementReader{
+		db:              config.Database,
+		measurementName: config.MeasurementName,
+		readerClient:    clt,
+	}
+}
+
+// ReadMeasurements doesn't honour the context, the influx client has no way of passing it on
+func (imr *InfluxMeasurementReader) ReadMeasurements(query *MeasurementQuery, ctx context.Context) ([]MeasurementPoint, error) {
+	command := buildInfluxQuery(query, imr.measurementName)
+	response, err := imr.readerClient.Query(client.NewQueryWithParameters(command, imr.db, "",
+		map[string]interface{}{"deviceId": query.DeviceId.Hex()}))
+	if err != nil {
+		return nil, err
+	}
+	if err = response.Error(); err != nil {
+		return nil, err
+	}
+
+	points := make([]MeasurementPoint, 0)
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				point, err := influxRowToPoint(values)
+				if err != nil {
+					return nil, err
+				}
+				if point != nil {
+					points = append(points, *point)
+				}
+			}
+		}
+	}
+	// the query walks backwards to get the most recent points
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points, nil
+}
+
+func buildInfluxQuery(query *MeasurementQuery, measurementName string) string {
+	field := `"value"`
+	if query.Aggregation != "" {
+		field = fmt.Sprintf(`%s("value")`, query.Aggregation)
+	}
+	conditions := []string{`"deviceId" = $deviceId`}
+	if !query.From.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("time >= '%s'", query.From.UTC().Format(time.RFC3339Nano)))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("time <= '%s'", query.To.UTC().Format(time.RFC3339Nano)))
+	}
+
+	command := fmt.Sprintf(`SELECT %s FROM "%s" WHERE %s`, field,
+		strings.Replace(measurementName, `"`, `\"`, -1), strings.Join(conditions, " AND "))
+	if query.Window > 0 {
+		command += fmt.Sprintf(" GROUP BY time(%dms) fill(none)", query.Window/time.Millisecond)
+	}
+	return command + fmt.Sprintf(" ORDER BY time DESC LIMIT %d", query.Limit)
+}
+
+// influxRowToPoint converts [time, value], rows without a value (empty windows) are skipped
+func influxRowToPoint(values []interface{}) (*MeasurementPoint, error) {
+	if len(values) < 2 || values[1] == nil {
+		return nil, nil
+	}
+	timeStr, ok := values[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected time in influx response: %v", values[0])
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, timeStr)
+	if err != nil {
+		return nil, err
+	}
+	var value float64
+	switch v := values[1].(type) {
+	case json.Number:
+		value, err = v.Float64()
+	case float64:
+		value = v
+	default:
+		err = fmt.Errorf("unexpected value in influx response: %v", values[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MeasurementPoint{Timestamp: timestamp, Value: value}, nil
+}
+
+// MemoryMeasurementReader keeps the measurements in memory and aggregates them the same way influx does,
+// windows are aligned to the epoch and labelled with their start
+type MemoryMeasurementReader struct {
+	mutex  sync.RWMutex
+	points map[primitive.ObjectID][]MeasurementPoint
+}
+
+func NewMemoryMeasurementReader() *MemoryMeasurementReader {
+	return &MemoryMeasurementReader{points: make(map[primitive.ObjectID][]MeasurementPoint)}
+}
+
+func (mmr *MemoryMeasurementReader) Add(measurement Measurement) {
+	mmr.mutex.Lock()
+	defer mmr.mutex.Unlock()
+	points := append(mmr.points[measurement.Id], MeasurementPoint{Timestamp: measurement.Timestamp, Value: measurement.Value})
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	mmr.points[measurement.Id] = points
+}
+
+func (mmr *MemoryMeasurementReader) ReadMeasurements(query *MeasurementQuery, ctx context.Context) ([]MeasurementPoint, error) {
+	mmr.mutex.RLock()
+	defer mmr.mutex.RUnlock()
+
+	inRange := make([]MeasurementPoint, 0)
+	for _, point := range mmr.points[query.DeviceId] {
+		if !query.From.IsZero() && point.Timestamp.Before(query.From) {
+			continue
+		}
+		if !query.To.IsZero() && point.Timestamp.After(query.To) {
+			continue
+		}
+		inRange = append(inRange, point)
+	}
+
+	result := inRange
+	if query.Aggregation != "" {
+		result = aggregatePoints(inRange, query.Aggregation, query.Window)
+	}
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[len(result)-query.Limit:]
+	}
+	return result, nil
+}
+
+// aggregatePoints expects points in ascending order, without a window everything ends up in a single one
+func aggregatePoints(points []MeasurementPoint, aggregation string, window time.Duration) []MeasurementPoint {
+	result := make([]MeasurementPoint, 0)
+	for start := 0; start < len(points); {
+		bucket := time.Time{}
+		if window > 0 {
+			bucket = points[start].Timestamp.Truncate(window)
+		}
+		end := start
+		for end < len(points) && (window == 0 || points[end].Timestamp.Truncate(window).Equal(bucket)) {
+			end++
+		}
+		result = append(result, MeasurementPoint{Timestamp: bucket, Value: aggregate(points[start:end], aggregation)})
+		start = end
+	}
+	return result
+}
+
+func aggregate(points []MeasurementPoint, aggregation string) float64 {
+	value := points[0].Value
+	for _, point := range points[1:] {
+		switch aggregation {
+		case "mean":
+			value += point.Value
+		case "min":
+			if point.Value < value {
+				value = point.Value
+			}
+		case "max":
+			if point.Value > value {
+				value = point.Value
+			}
+		case "last":
+			value = point.Value
+		}
+	}
+	if aggregation == "mean" {
+		value /= float64(len(points))
+	}
+	return value
+}
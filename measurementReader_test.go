@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_ParseMeasurementQuery_GivenAllParams_FuncReturnsQuery(t *testing.T) {
+	values, _ := url.ParseQuery("from=2019-12-01T10:00:00Z&to=2019-12-01T11:00:00Z&limit=10&agg=mean&window=5m")
+
+	query, err := parseMeasurementQuery(values)
+
+	expected := &MeasurementQuery{
+		From:        time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC),
+		To:          time.Date(2019, 12, 1, 11, 0, 0, 0, time.UTC),
+		Limit:       10,
+		Aggregation: "mean",
+		Window:      5 * time.Minute,
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, query)
+}
+
+func Test_ParseMeasurementQuery_GivenNoParams_FuncDefaultsLimit(t *testing.T) {
+	query, err := parseMeasurementQuery(url.Values{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, &MeasurementQuery{Limit: defaultMeasurementsLimit}, query)
+}
+
+func Test_ParseMeasurementQuery_GivenWrongInput_FuncReturnsErrValidation(t *testing.T) {
+	tests := map[string]string{
+		"from is not a time":     "from=yesterday",
+		"to before from":         "from=2019-12-01T10:00:00Z&to=2019-12-01T09:00:00Z",
+		"zero limit":             "limit=0",
+		"limit too big":          "limit=10001",
+		"unknown aggregation":    "agg=median",
+		"window is not duration": "agg=mean&from=2019-12-01T10:00:00Z&window=5",
+		"window too small":       "agg=mean&from=2019-12-01T10:00:00Z&window=1us",
+		"window without agg":     "from=2019-12-01T10:00:00Z&window=5m",
+		"window without from":    "agg=mean&window=5m",
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tc)
+			_, err := parseMeasurementQuery(values)
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
+
+func Test_BuildInfluxQuery_GivenDifferentQueries_FuncReturnsInfluxQL(t *testing.T) {
+	from := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	to := time.Date(2019, 12, 1, 11, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		input    *MeasurementQuery
+		expected string
+	}{
+		"raw values": {
+			input:    &MeasurementQuery{Limit: 5},
+			expected: `SELECT "value" FROM "deviceValues" WHERE "deviceId" = $deviceId ORDER BY time DESC LIMIT 5`,
+		},
+		"time range": {
+			input:    &MeasurementQuery{From: from, To: to, Limit: 5},
+			expected: `SELECT "value" FROM "deviceValues" WHERE "deviceId" = $deviceId AND time >= '2019-12-01T10:00:00Z' AND time <= '2019-12-01T11:00:00Z' ORDER BY time DESC LIMIT 5`,
+		},
+		"aggregated": {
+			input:    &MeasurementQuery{From: from, Limit: 5, Aggregation: "max", Window: time.Minute},
+			expected: `SELECT max("value") FROM "deviceValues" WHERE "deviceId" = $deviceId AND time >= '2019-12-01T10:00:00Z' GROUP BY time(60000ms) fill(none) ORDER BY time DESC LIMIT 5`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, buildInfluxQuery(tc.input, defaultMeasurementName))
+		})
+	}
+}
+
+func Test_InfluxRowToPoint_GivenRows_FuncConvertsThem(t *testing.T) {
+	point, err := influxRowToPoint([]interface{}{"2019-12-01T10:00:00.5Z", json.Number("21.5")})
+
+	assert.NoError(t, err)
+	assert.Equal(t, &MeasurementPoint{Timestamp: time.Date(2019, 12, 1, 10, 0, 0, 500000000, time.UTC), Value: 21.5}, point)
+
+	point, err = influxRowToPoint([]interface{}{"2019-12-01T10:00:00Z", nil})
+
+	assert.NoError(t, err)
+	assert.Nil(t, point)
+
+	_, err = influxRowToPoint([]interface{}{"2019-12-01T10:00:00Z", "abc"})
+
+	assert.Error(t, err)
+}
+
+func TestMemoryMeasurementReader_ReadMeasurements_GivenQueries_ReaderReturnsMatchingPoints(t *testing.T) {
+	id := primitive.NewObjectID()
+	start := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	mmr := NewMemoryMeasurementReader()
+	for i, value := range []float64{1, 5, 3, 2, 8, 4} {
+		mmr.Add(Measurement{Id: id, Value: value, Timestamp: start.Add(time.Duration(i) * 30 * time.Second)})
+	}
+	mmr.Add(Measurement{Id: primitive.NewObjectID(), Value: 100, Timestamp: start})
+
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	tests := map[string]struct {
+		query    *MeasurementQuery
+		expected []MeasurementPoint
+	}{
+		"limited to most recent": {
+			query:    &MeasurementQuery{Limit: 2},
+			expected: []MeasurementPoint{{Timestamp: at(120), Value: 8}, {Timestamp: at(150), Value: 4}},
+		},
+		"time range": {
+			query:    &MeasurementQuery{From: at(30), To: at(60), Limit: 10},
+			expected: []MeasurementPoint{{Timestamp: at(30), Value: 5}, {Timestamp: at(60), Value: 3}},
+		},
+		"mean over minute": {
+			query:    &MeasurementQuery{Limit: 10, Aggregation: "mean", Window: time.Minute},
+			expected: []MeasurementPoint{{Timestamp: at(0), Value: 3}, {Timestamp: at(60), Value: 2.5}, {Timestamp: at(120), Value: 6}},
+		},
+		"min over minute": {
+			query:    &MeasurementQuery{Limit: 10, Aggregation: "min", Window: time.Minute},
+			expected: []MeasurementPoint{{Timestamp: at(0), Value: 1}, {Timestamp: at(60), Value: 2}, {Timestamp: at(120), Value: 4}},
+		},
+		"max over two minutes": {
+			query:    &MeasurementQuery{Limit: 10, Aggregation: "max", Window: 2 * time.Minute},
+			expected: []MeasurementPoint{{Timestamp: at(0), Value: 5}, {Timestamp: at(120), Value: 8}},
+		},
+		"last without window": {
+			query:    &MeasurementQuery{Limit: 10, Aggregation: "last"},
+			expected: []MeasurementPoint{{Value: 4}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc.query.DeviceId = id
+			points, err := mmr.ReadMeasurements(tc.query, context.TODO())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, points)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// desired states of the pipeline, they survive restarts
+const (
+	pipelineRunning = "running"
+	pipelineStopped = "stopped"
+)
+
+// how long the auto-start waits between attempts, the wait doubles up to the max
+const (
+	autostartRetry    = time.Second
+	autostartMaxRetry = 30 * time.Second
+)
+
+type PipelineStateDao interface {
+	// GetDesiredState returns an empty state if none was saved yet
+	GetDesiredState(ctx context.Context) (string, error)
+	SetDesiredState(state string, ctx context.Context) error
+}
+
+// pipelineAutostartFromEnv reads PIPELINE_AUTOSTART, the pipeline has to be started by hand by default
+func pipelineAutostartFromEnv() bool {
+	autostartStr := os.Getenv("PIPELINE_AUTOSTART")
+	if autostartStr == "" {
+		return false
+	}
+	autostart, err := strconv.ParseBool(autostartStr)
+	if err != nil {
+		log.Panicf("incorrect pipeline autostart: %s", autostartStr)
+	}
+	return autostart
+}
+
+// Resume brings the pipeline back to the state it was in before the restart, a pipeline which was never
+// started or stopped gets started. It keeps trying until the database and influx are there or the application is closed
+func (c *Controller) Resume() {
+	wait := autostartRetry
+	retry := func(what string, err error) bool {
+		log.Printf("pipeline autostart: %s failed, retrying in %s: %s", what, wait, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return false
+		}
+		if wait *= 2; wait > autostartMaxRetry {
+			wait = autostartMaxRetry
+		}
+		return true
+	}
+
+	// a stop coming in while the pipeline is being resumed wins
+	stops := c.stopCount()
+	for {
+		state, err := c.stateDao.GetDesiredState(c.ctx)
+		if err == nil {
+			if state == pipelineStopped {
+				log.Printf("pipeline autostart: the pipeline was stopped before the restart, it stays stopped")
+				return
+			}
+			break
+		}
+		if !retry("reading the desired state", err) {
+			return
+		}
+	}
+	for {
+		err := c.writerService.Ping()
+		if err == nil {
+			before := c.pipelineSnapshot(c.ctx)
+			if err = c.startUnlessStopped(stops); err == nil {
+				log.Printf("pipeline autostart: the pipeline is running")
+				c.audit.Record(AuditSource{Actor: auditSystem}, auditPipelineStart, nil, before, c.pipelineSnapshot(c.ctx))
+				return
+			}
+			if _, ok := err.(ErrPipelineStopped); ok {
+				log.Printf("pipeline autostart: the pipeline was stopped in the meantime, it stays stopped")
+				return
+			}
+		}
+		if !retry("starting the pipeline", err) {
+			return
+		}
+	}
+}
+
+// StopPipeline stops the devices and remembers that the pipeline should stay stopped,
+// the measurements already in the queue are still written. The stop is only recorded when it has stopped
+// a pipeline which was running or starting
+func (c *Controller) StopPipeline(ctx context.Context) (PipelineStatus, error) {
+	before := c.pipelineSnapshot(ctx)
+	if err := c.stateDao.SetDesiredState(pipelineStopped, ctx); err != nil {
+		return PipelineStatus{}, err
+	}
+	// counted before waiting for the lock, so that a start which is still pending gives up
+	// and the next one doesn't count on it
+	c.mutex.Lock()
+	c.stops++
+	starting := c.starting
+	c.starting = false
+	c.mutex.Unlock()
+	c.startMutex.Lock()
+	c.mutex.Lock()
+	running := c.running
+	c.running = false
+	c.mutex.Unlock()
+	if running {
+		c.tickerService.Stop()
+	}
+	c.startMutex.Unlock()
+	if running || starting {
+		c.audit.Record(auditSourceFrom(ctx), auditPipelineStop, nil, before, c.pipelineSnapshot(ctx))
+	}
+	return c.Status(), nil
+}
+
+// pipelineSnapshot is what the audit log keeps of the pipeline, it is nil when there's no audit log
+func (c *Controller) pipelineSnapshot(ctx context.Context) *AuditSnapshot {
+	if c.audit == nil {
+		return nil
+	}
+	state, err := c.stateDao.GetDesiredState(ctx)
+	if err != nil {
+		log.Printf("could not read the desired state of the pipeline for the audit log: %s", err.Error())
+	}
+	status := c.Status()
+	return &AuditSnapshot{Pipeline: &PipelineSnapshot{DesiredState: state, Running: status.Running, Starting: status.Starting,
+		Ticking: c.tickerService.Ticking()}}
+}
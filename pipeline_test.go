@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/influxdata/influxdb1-client/v2"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockPipelineStateDao keeps the desired state in memory
+type mockPipelineStateDao struct {
+	mutex     sync.Mutex
+	state     string
+	returnErr error
+}
+
+func (m *mockPipelineStateDao) GetDesiredState(ctx context.Context) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state, m.returnErr
+}
+
+func (m *mockPipelineStateDao) SetDesiredState(state string, ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.returnErr != nil {
+		return m.returnErr
+	}
+	m.state = state
+	return nil
+}
+
+func newTestPipelineController(device Device, stateDao PipelineStateDao, influx *mockInfluxClient) *Controller {
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086"}, SystemClock{})
+	mws.writerClient = influx
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Controller{
+		mainService:   NewService(&mockDao{data: []Device{device}}),
+		tickerService: NewTickerService(SystemClock{}),
+		writerService: mws,
+		hub:           NewMeasurementHub(1, DropMeasurements),
+		queue:         NewMeasurementQueue(1, DropNewest),
+		stateDao:      stateDao,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+func TestController_Resume_GivenDesiredState_PipelineResumesIt(t *testing.T) {
+	tests := map[string]struct {
+		state   string
+		running bool
+	}{
+		"never started":   {state: "", running: true},
+		"running":         {state: pipelineRunning, running: true},
+		"stopped by hand": {state: pipelineStopped, running: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+			c := newTestPipelineController(device, &mockPipelineStateDao{state: tc.state}, &mockInfluxClient{})
+			defer c.Close()
+
+			c.Resume()
+
+			assert.Equal(t, tc.running, c.Status().Running)
+			assert.Equal(t, tc.running, c.tickerService.IsRunning(device.Id))
+		})
+	}
+}
+
+func TestController_Resume_GivenInfluxNotReadyYet_PipelineStartsOnceItIs(t *testing.T) {
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	influx := &mockInfluxClient{pingErr: make(chan error, 1)}
+	influx.pingErr <- errors.New("connection refused")
+	c := newTestPipelineController(device, &mockPipelineStateDao{}, influx)
+	defer c.Close()
+
+	c.Resume()
+
+	assert.Len(t, influx.pingErr, 0)
+	assert.True(t, c.Status().Running)
+}
+
+func TestController_Resume_GivenClosedController_ResumeGivesUp(t *testing.T) {
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID()}, &mockPipelineStateDao{returnErr: ErrDao("")}, &mockInfluxClient{})
+	c.Close()
+
+	c.Resume()
+
+	assert.False(t, c.Status().Running)
+}
+
+func TestController_StopPipeline_GivenRunningPipeline_DevicesStopAndTheStateIsKept(t *testing.T) {
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	stateDao := &mockPipelineStateDao{}
+	c := newTestPipelineController(device, stateDao, &mockInfluxClient{written: make(chan client.BatchPoints, 16)})
+	defer c.Close()
+	assert.NoError(t, c.StartTickerService())
+
+	status, err := c.StopPipeline(context.TODO())
+	assert.NoError(t, err)
+	stoppedState := stateDao.state
+	_, err = c.StartPipeline(context.TODO())
+	assert.NoError(t, err)
+	// the start is in the background, the synchronous one waits for it
+	assert.NoError(t, c.StartTickerService())
+
+	assert.False(t, status.Running)
+	assert.Equal(t, pipelineStopped, stoppedState)
+	assert.Equal(t, pipelineRunning, stateDao.state)
+	assert.True(t, c.tickerService.IsRunning(device.Id))
+}
+
+func TestController_StartTickerService_GivenWriterFailingToStart_QueueIsLeftAlone(t *testing.T) {
+	c := newTestPipelineController(Device{Id: primitive.NewObjectID()}, &mockPipelineStateDao{}, &mockInfluxClient{})
+	defer c.Close()
+	c.writerService.precision = "d"
+
+	assert.Error(t, c.StartTickerService())
+	c.queue.Push(Measurement{Value: 1}, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	// nothing has been left behind reading the queue
+	assert.Len(t, c.queue.C(), 1)
+}
+
+func TestController_StopPipeline_GivenStartStillPending_PipelineStaysStopped(t *testing.T) {
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	stateDao := &mockPipelineStateDao{}
+	c := newTestPipelineController(device, stateDao, &mockInfluxClient{})
+	defer c.Close()
+
+	// the start waits for the lock while the stop comes in
+	c.startMutex.Lock()
+	_, err := c.StartPipeline(context.TODO())
+	assert.NoError(t, err)
+	stopped := make(chan error)
+	go func() {
+		_, err := c.StopPipeline(context.TODO())
+		stopped <- err
+	}()
+	assert.Eventually(t, func() bool { return c.stopCount() == 1 }, time.Second, time.Millisecond)
+	c.startMutex.Unlock()
+	assert.NoError(t, <-stopped)
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, pipelineStopped, stateDao.state)
+	assert.False(t, c.Status().Running)
+	assert.False(t, c.Status().Starting)
+	assert.False(t, c.tickerService.IsRunning(device.Id))
+}
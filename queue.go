@@ -0,0 +1,148 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"os"
+	"sync"
+)
+
+const defaultQueueCapacity = 1024
+
+type OverflowPolicy string
+
+const (
+	// Block makes the publishing device wait for room in the queue
+	Block OverflowPolicy = "block"
+	// DropOldest makes room by throwing away the measurement which has waited the longest
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest throws away the measurement being published
+	DropNewest OverflowPolicy = "drop-newest"
+)
+
+// MeasurementQueue is a bounded buffer between the devices and the sinks,
+// the overflow policy decides what happens when the sinks can't keep up
+type MeasurementQueue struct {
+	ch     chan Measurement
+	policy OverflowPolicy
+
+	mutex   sync.Mutex
+	dropped map[primitive.ObjectID]uint64
+	total   uint64
+}
+
+type QueueStatus struct {
+	Depth           int               `json:"depth"`
+	Capacity        int               `json:"capacity"`
+	Policy          OverflowPolicy    `json:"policy"`
+	Dropped         uint64            `json:"dropped"`
+	DroppedByDevice map[string]uint64 `json:"droppedByDevice,omitempty"`
+}
+
+// newMeasurementQueueFromEnv reads PIPELINE_QUEUE_SIZE and PIPELINE_OVERFLOW (block, drop-oldest or drop-newest)
+func newMeasurementQueueFromEnv() *MeasurementQueue {
+	capacity := defaultQueueCapacity
+	if capacityStr := os.Getenv("PIPELINE_QUEUE_SIZE"); capacityStr != "" {
+		var err error
+		if capacity, err = convertToPositiveInteger(capacityStr); err != nil || capacity == 0 {
+			log.Panicf("incorrect pipeline queue size: %s", capacityStr)
+		}
+	}
+	policy := OverflowPolicy(os.Getenv("PIPELINE_OVERFLOW"))
+	if policy == "" {
+		policy = Block
+	}
+	if !isOverflowPolicy(policy) {
+		log.Panicf("unknown pipeline overflow policy: %s", policy)
+	}
+	return NewMeasurementQueue(capacity, policy)
+}
+
+func isOverflowPolicy(policy OverflowPolicy) bool {
+	return policy == Block || policy == DropOldest || policy == DropNewest
+}
+
+func NewMeasurementQueue(capacity int, policy OverflowPolicy) *MeasurementQueue {
+	return &MeasurementQueue{
+		ch:      make(chan Measurement, capacity),
+		policy:  policy,
+		dropped: make(map[primitive.ObjectID]uint64),
+	}
+}
+
+// Push enqueues the measurement according to the policy, a blocked push gives up once stop is closed.
+// It returns whether the measurement made it into the queue
+func (q *MeasurementQueue) Push(measurement Measurement, stop <-chan bool) bool {
+	switch q.policy {
+	case DropNewest:
+		select {
+		case q.ch <- measurement:
+			return true
+		default:
+			q.drop(measurement)
+			return false
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.ch <- measurement:
+				return true
+			default:
+			}
+			// somebody else might have taken the oldest one in the meantime, then there's room already
+			select {
+			case oldest := <-q.ch:
+				q.drop(oldest)
+			default:
+			}
+		}
+	default:
+		// a measurement which fits is never turned away only because stop is closed already
+		select {
+		case q.ch <- measurement:
+			return true
+		default:
+		}
+		select {
+		case q.ch <- measurement:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// C is where the sinks read from
+func (q *MeasurementQueue) C() <-chan Measurement {
+	return q.ch
+}
+
+func (q *MeasurementQueue) Close() {
+	close(q.ch)
+}
+
+func (q *MeasurementQueue) drop(measurement Measurement) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.dropped[measurement.Id]++
+	q.total++
+}
+
+func (q *MeasurementQueue) Status() QueueStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	status := QueueStatus{
+		Depth:    len(q.ch),
+		Capacity: cap(q.ch),
+		Policy:   q.policy,
+		Dropped:  q.total,
+	}
+	if len(q.dropped) > 0 {
+		status.DroppedByDevice = make(map[string]uint64, len(q.dropped))
+		for id, dropped := range q.dropped {
+			status.DroppedByDevice[id.Hex()] = dropped
+		}
+	}
+	return status
+}
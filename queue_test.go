@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestMeasurementQueue_Push_GivenFullQueueAndDropNewest_QueueKeepsOldMeasurements(t *testing.T) {
+	q := NewMeasurementQueue(2, DropNewest)
+	id := primitive.NewObjectID()
+
+	assert.True(t, q.Push(Measurement{Id: id, Value: 1}, nil))
+	assert.True(t, q.Push(Measurement{Id: id, Value: 2}, nil))
+	assert.False(t, q.Push(Measurement{Id: id, Value: 3}, nil))
+
+	assert.Equal(t, 1.0, (<-q.C()).Value)
+	assert.Equal(t, 2.0, (<-q.C()).Value)
+	assert.Equal(t, uint64(1), q.Status().DroppedByDevice[id.Hex()])
+}
+
+func TestMeasurementQueue_Push_GivenFullQueueAndDropOldest_QueueKeepsNewMeasurements(t *testing.T) {
+	q := NewMeasurementQueue(2, DropOldest)
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+
+	assert.True(t, q.Push(Measurement{Id: first, Value: 1}, nil))
+	assert.True(t, q.Push(Measurement{Id: second, Value: 2}, nil))
+	assert.True(t, q.Push(Measurement{Id: second, Value: 3}, nil))
+
+	assert.Equal(t, 2.0, (<-q.C()).Value)
+	assert.Equal(t, 3.0, (<-q.C()).Value)
+	assert.Equal(t, map[string]uint64{first.Hex(): 1}, q.Status().DroppedByDevice)
+}
+
+func TestMeasurementQueue_Push_GivenFullQueueAndBlock_PushGivesUpWhenStopped(t *testing.T) {
+	q := NewMeasurementQueue(1, Block)
+	stop := make(chan bool)
+	q.Push(Measurement{Value: 1}, stop)
+
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(Measurement{Value: 2}, stop) }()
+	close(stop)
+
+	assert.False(t, <-pushed)
+	assert.Equal(t, uint64(0), q.Status().Dropped)
+}
+
+func TestMeasurementQueue_Status_GivenQueuedMeasurements_StatusReportsDepth(t *testing.T) {
+	q := NewMeasurementQueue(3, DropNewest)
+	q.Push(Measurement{}, nil)
+	q.Push(Measurement{}, nil)
+
+	expected := QueueStatus{Depth: 2, Capacity: 3, Policy: DropNewest}
+
+	assert.Equal(t, expected, q.Status())
+}
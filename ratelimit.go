@@ -0,0 +1,322 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the buckets which have filled up again are dropped
+const rateLimitPruneInterval = time.Minute
+
+// the quotas of the route groups unless RATE_LIMITS says otherwise, a group is the scope its routes require
+var defaultRateQuotas = map[string]RateQuota{
+	scopeDevicesRead:     {Limit: 600, Period: time.Minute},
+	scopeDevicesWrite:    {Limit: 120, Period: time.Minute},
+	scopePipelineControl: {Limit: 30, Period: time.Minute},
+	scopeKeysAdmin:       {Limit: 30, Period: time.Minute},
+}
+
+// body sizes accepted unless MAX_BODY_BYTES and MAX_BULK_BODY_BYTES say otherwise
+const (
+	defaultMaxBody     = 1 << 20
+	defaultMaxBulkBody = 32 << 20
+)
+
+// RateQuota lets a client make Limit requests per Period, all of them at once if it has been quiet for a Period
+type RateQuota struct {
+	Limit  int
+	Period time.Duration
+}
+
+// rate is how many tokens come back per second
+func (q RateQuota) rate() float64 {
+	return float64(q.Limit) / q.Period.Seconds()
+}
+
+type tokenBucket struct {
+	quota   RateQuota
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens which have come back since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.quota.Limit), b.tokens+now.Sub(b.updated).Seconds()*b.quota.rate())
+	b.updated = now
+}
+
+// RateLimiter gives every client a token bucket per route group, a client is its principal when the request
+// is authenticated and its IP otherwise
+type RateLimiter struct {
+	quotas map[string]RateQuota
+	clock  Clock
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+// rateDecision is what the limiter has decided about a single request
+type rateDecision struct {
+	allowed   bool
+	quota     RateQuota
+	remaining int
+	// how long until the bucket is full again
+	reset time.Duration
+	// how long until the next request is let through, only when it isn't allowed
+	retry time.Duration
+}
+
+func NewRateLimiter(quotas map[string]RateQuota, clock Clock) *RateLimiter {
+	return &RateLimiter{quotas: quotas, clock: clock, buckets: make(map[string]*tokenBucket), pruned: clock.Now()}
+}
+
+// newRateLimiterFromEnv reads RATE_LIMITS, a comma separated list like "devices:read=100/m,devices:write=10/s"
+// overriding the default quotas. RATE_LIMITS=off turns the limits off and nil is returned
+func newRateLimiterFromEnv() *RateLimiter {
+	limits := os.Getenv("RATE_LIMITS")
+	if limits == "off" {
+		log.Printf("RATE_LIMITS is off, the requests are not rate limited")
+		return nil
+	}
+	quotas, err := parseRateQuotas(limits)
+	if err != nil {
+		log.Panicf("incorrect rate limits: %s", err.Error())
+	}
+	// the limits are about the clients, they run on the wall clock even in a simulation
+	return NewRateLimiter(quotas, SystemClock{})
+}
+
+func parseRateQuotas(limits string) (map[string]RateQuota, error) {
+	quotas := make(map[string]RateQuota, len(defaultRateQuotas))
+	for group, quota := range defaultRateQuotas {
+		quotas[group] = quota
+	}
+	if strings.TrimSpace(limits) == "" {
+		return quotas, nil
+	}
+	for _, entry := range strings.Split(limits, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || !knownScopes[parts[0]] {
+			return nil, ErrValidation("expected <group>=<limit>/<s|m|h> with a scope as the group: " + entry)
+		}
+		quota, err := parseRateQuota(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		quotas[parts[0]] = quota
+	}
+	return quotas, nil
+}
+
+func parseRateQuota(s string) (RateQuota, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateQuota{}, ErrValidation("expected <limit>/<s|m|h>: " + s)
+	}
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return RateQuota{}, ErrValidation("limit has to be a positive number: " + s)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[parts[1]]
+	if !ok {
+		return RateQuota{}, ErrValidation("period has to be s, m or h: " + s)
+	}
+	return RateQuota{Limit: limit, Period: period}, nil
+}
+
+// take takes a token from the bucket of the client for the group, a group without a quota isn't limited
+func (l *RateLimiter) take(group, client string) (rateDecision, bool) {
+	return l.decide(group, client, true)
+}
+
+// check tells whether the client would get a token without taking it
+func (l *RateLimiter) check(group, client string) (rateDecision, bool) {
+	return l.decide(group, client, false)
+}
+
+func (l *RateLimiter) decide(group, client string, charge bool) (rateDecision, bool) {
+	quota, ok := l.quotas[group]
+	if !ok {
+		return rateDecision{}, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	l.prune(now)
+
+	key := group + " " + client
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{quota: quota, tokens: float64(quota.Limit), updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	decision := rateDecision{quota: quota}
+	if bucket.tokens >= 1 {
+		if charge {
+			bucket.tokens--
+		}
+		decision.allowed = true
+	} else {
+		decision.retry = secondsToDuration((1 - bucket.tokens) / quota.rate())
+	}
+	decision.remaining = int(bucket.tokens)
+	decision.reset = secondsToDuration((float64(quota.Limit) - bucket.tokens) / quota.rate())
+	return decision, true
+}
+
+// prune drops the buckets which are full again, they are the same as no bucket. The mutex has to be held
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < rateLimitPruneInterval {
+		return
+	}
+	l.pruned = now
+	for key, bucket := range l.buckets {
+		if bucket.refill(now); bucket.tokens >= float64(bucket.quota.Limit) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware has to come after the authentication so that the clients with a key get their own buckets
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decision, limited := l.take(requiredScope(r), rateLimitClient(r))
+		if limited && !admit(w, decision) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FailedAuthMiddleware comes before the authentication, the requests it turns away with a 401 are charged
+// to the bucket of their IP so that guessing credentials is limited like any anonymous client is.
+// Once that bucket is empty the IP is turned away before its credentials are looked at
+func (l *RateLimiter) FailedAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, client := requiredScope(r), remoteClient(r)
+		decision, limited := l.check(group, client)
+		if limited && !decision.allowed {
+			admit(w, decision)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == http.StatusUnauthorized {
+			l.take(group, client)
+		}
+	})
+}
+
+// admit sets the rate limit headers and replies with a 429 when the request isn't allowed
+func admit(w http.ResponseWriter, decision rateDecision) bool {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.quota.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+	w.Header().Set("RateLimit-Reset", ceilSeconds(decision.reset))
+	if !decision.allowed {
+		w.Header().Set("Retry-After", ceilSeconds(decision.retry))
+		writeProblem(w, http.StatusTooManyRequests, "rate limit of "+strconv.Itoa(decision.quota.Limit)+
+			" requests per "+decision.quota.Period.String()+" exceeded")
+		return false
+	}
+	return true
+}
+
+func rateLimitClient(r *http.Request) string {
+	if principal := principalFrom(r.Context()); principal != nil {
+		return principal.Name
+	}
+	return remoteClient(r)
+}
+
+// remoteClient is the IP the request comes from
+func remoteClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// BodyLimits are the largest request bodies read, zero means no limit. The bulk import has its own limit
+type BodyLimits struct {
+	Default int64
+	Bulk    int64
+}
+
+func bodyLimitsFromEnv() BodyLimits {
+	return BodyLimits{
+		Default: readBodyLimit("MAX_BODY_BYTES", defaultMaxBody),
+		Bulk:    readBodyLimit("MAX_BULK_BODY_BYTES", defaultMaxBulkBody),
+	}
+}
+
+func readBodyLimit(name string, defaultLimit int64) int64 {
+	limitStr := os.Getenv(name)
+	if limitStr == "" {
+		return defaultLimit
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil || limit < 0 {
+		log.Panicf("incorrect %s: %s", name, limitStr)
+	}
+	return limit
+}
+
+// Middleware cuts the bodies off at the limit before anything decodes them
+func (b BodyLimits) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := b.Default
+		if routeTemplate(r) == "/devices:bulk" {
+			limit = b.Bulk
+		}
+		if limit > 0 && r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody remembers that the body went past the limit, the decoders don't keep the error they got
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+		err = ErrBodyTooLarge(b.limit)
+	}
+	return n, err
+}
+
+// bodyError is ErrBodyTooLarge when the body went past the limit, whatever the reading has failed with
+func bodyError(r *http.Request, err error) error {
+	if body, ok := r.Body.(*limitedBody); ok && body.exceeded {
+		return ErrBodyTooLarge(body.limit)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseRateQuotas_GivenOverrides_DefaultsAreKeptForTheOtherGroups(t *testing.T) {
+	quotas, err := parseRateQuotas("devices:read=10/s, pipeline:control=2/h")
+
+	assert.NoError(t, err)
+	assert.Equal(t, RateQuota{Limit: 10, Period: time.Second}, quotas[scopeDevicesRead])
+	assert.Equal(t, RateQuota{Limit: 2, Period: time.Hour}, quotas[scopePipelineControl])
+	assert.Equal(t, defaultRateQuotas[scopeDevicesWrite], quotas[scopeDevicesWrite])
+}
+
+func Test_ParseRateQuotas_GivenInvalidLimits_ReturnsErrValidation(t *testing.T) {
+	for _, limits := range []string{"devices:delete=1/s", "devices:read=10", "devices:read=0/s", "devices:read=1/d"} {
+		_, err := parseRateQuotas(limits)
+		assert.IsType(t, ErrValidation(""), err, limits)
+	}
+}
+
+func TestRateLimiter_Take_GivenEmptyBucket_WaitsForTheTokensToComeBack(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	l := NewRateLimiter(map[string]RateQuota{scopeDevicesWrite: {Limit: 2, Period: time.Minute}}, clock)
+
+	first, _ := l.take(scopeDevicesWrite, "a")
+	second, _ := l.take(scopeDevicesWrite, "a")
+	rejected, _ := l.take(scopeDevicesWrite, "a")
+	otherClient, _ := l.take(scopeDevicesWrite, "b")
+	_, limited := l.take(scopeDevicesRead, "a")
+	clock.Advance(30 * time.Second)
+	refilled, _ := l.take(scopeDevicesWrite, "a")
+
+	assert.True(t, first.allowed)
+	assert.Equal(t, 1, first.remaining)
+	assert.True(t, second.allowed)
+	assert.False(t, rejected.allowed)
+	assert.Equal(t, 30*time.Second, rejected.retry)
+	assert.Equal(t, time.Minute, rejected.reset)
+	assert.True(t, otherClient.allowed)
+	assert.False(t, limited)
+	assert.True(t, refilled.allowed)
+}
+
+func TestRateLimiter_Take_GivenQuietClients_FullBucketsArePruned(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	l := NewRateLimiter(map[string]RateQuota{scopeDevicesRead: {Limit: 1, Period: time.Second}}, clock)
+
+	l.take(scopeDevicesRead, "a")
+	clock.Advance(rateLimitPruneInterval)
+	l.take(scopeDevicesRead, "b")
+
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimiter_Middleware_GivenTooManyRequests_Returns429WithHeaders(t *testing.T) {
+	c := &Controller{mainService: NewService(&mockDao{}),
+		limiter: NewRateLimiter(map[string]RateQuota{scopeDevicesRead: {Limit: 1, Period: time.Minute}}, NewFakeClock(schedulerEpoch))}
+	mockServer := httptest.NewServer(newRouter(c))
+	defer mockServer.Close()
+
+	allowed, _ := http.Get(mockServer.URL + "/devices")
+	rejected, _ := http.Get(mockServer.URL + "/devices")
+	other, _ := http.Post(mockServer.URL+"/devices", "application/json", strings.NewReader(`{"name": "test"}`))
+
+	assert.Equal(t, http.StatusOK, allowed.StatusCode)
+	assert.Equal(t, "1", allowed.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", allowed.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", allowed.Header.Get("RateLimit-Reset"))
+	assert.Equal(t, http.StatusTooManyRequests, rejected.StatusCode)
+	assert.Equal(t, "60", rejected.Header.Get("Retry-After"))
+	assert.Equal(t, "application/problem+json", rejected.Header.Get("Content-Type"))
+	assert.Equal(t, http.StatusOK, other.StatusCode)
+	assert.Empty(t, other.Header.Get("RateLimit-Limit"))
+}
+
+func TestRateLimiter_FailedAuthMiddleware_GivenWrongKeys_IPIsLimited(t *testing.T) {
+	c := &Controller{mainService: NewService(&mockDao{}), auth: NewAuthenticator(&mockApiKeyDao{}, testAdminKey),
+		limiter: NewRateLimiter(map[string]RateQuota{scopeDevicesRead: {Limit: 2, Period: time.Minute}}, NewFakeClock(schedulerEpoch))}
+	mockServer := httptest.NewServer(newRouter(c))
+	defer mockServer.Close()
+
+	// the authenticated requests aren't charged to the IP
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, doWithKey(t, "GET", mockServer.URL+"/devices", testAdminKey, "").StatusCode)
+	}
+	first := doWithKey(t, "GET", mockServer.URL+"/devices", "wrong", "")
+	second := doWithKey(t, "GET", mockServer.URL+"/devices", "", "")
+	rejected := doWithKey(t, "GET", mockServer.URL+"/devices", "wrong", "")
+
+	assert.Equal(t, http.StatusUnauthorized, first.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, second.StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, rejected.StatusCode)
+	assert.Equal(t, "30", rejected.Header.Get("Retry-After"))
+}
+
+func Test_RateLimitClient_GivenPrincipal_KeyIsThePrincipal(t *testing.T) {
+	r := httptest.NewRequest("GET", "/devices", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	authenticated := r.WithContext(withPrincipal(context.Background(), &Principal{Name: "key:ci:1"}))
+
+	assert.Equal(t, "ip:10.0.0.1", rateLimitClient(r))
+	assert.Equal(t, "ip:10.0.0.1", remoteClient(authenticated))
+	assert.Equal(t, "key:ci:1", rateLimitClient(authenticated))
+}
+
+func TestBodyLimits_Middleware_GivenTooLargeBody_Returns413(t *testing.T) {
+	c := &Controller{mainService: NewService(&mockDao{}), bodyLimits: BodyLimits{Default: 64, Bulk: 1024}}
+	mockServer := httptest.NewServer(newRouter(c))
+	defer mockServer.Close()
+	large := `{"name": "` + strings.Repeat("a", 100) + `"}`
+	bulk := `[{"name": "` + strings.Repeat("a", 30) + `"}, {"name": "` + strings.Repeat("b", 30) + `"}]`
+
+	device, _ := http.Post(mockServer.URL+"/devices", "application/json", strings.NewReader(large))
+	scenario, _ := http.Post(mockServer.URL+"/scenarios", "application/yaml", strings.NewReader("name: "+strings.Repeat("a", 100)))
+	bulkResp, _ := http.Post(mockServer.URL+"/devices:bulk", "application/json", strings.NewReader(bulk))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, device.StatusCode)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, scenario.StatusCode)
+	assert.NotEqual(t, http.StatusRequestEntityTooLarge, bulkResp.StatusCode)
+}
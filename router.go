@@ -6,12 +6,50 @@ import (
 
 func newRouter(c *Controller) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(RequestIdMiddleware)
 
 	handlersEnvironment := NewHandlersEnvironment(c)
 	router.HandleFunc("/start", handlersEnvironment.StartTickerService).Methods("POST")
+	router.HandleFunc("/stop", handlersEnvironment.StopTickerService).Methods("POST")
+	router.HandleFunc("/status", handlersEnvironment.StatusHandler).Methods("GET")
 	router.HandleFunc("/devices", handlersEnvironment.AddDeviceHandler).Methods("POST")
+	router.HandleFunc("/devices:bulk", handlersEnvironment.AddDevicesBulkHandler).Methods("POST")
 	router.HandleFunc("/devices", pageAndLimitWrapper(handlersEnvironment.GetPaginatedDevices)).Methods("GET")
+	router.HandleFunc("/devices/export", handlersEnvironment.ExportDevicesHandler).Methods("GET")
+	router.HandleFunc("/devices/export", handlersEnvironment.ExportDevicesJobHandler).Methods("POST")
 	router.HandleFunc("/devices/{id}", handlersEnvironment.GetDeviceHandler).Methods("GET")
+	router.HandleFunc("/devices/{id}/faults", handlersEnvironment.SetDeviceFaultsHandler).Methods("PUT")
+	router.HandleFunc("/devices/{id}/faults", handlersEnvironment.ClearDeviceFaultsHandler).Methods("DELETE")
+	router.HandleFunc("/devices/{id}/backfill", handlersEnvironment.BackfillHandler).Methods("POST")
+	router.HandleFunc("/devices/{id}/backfill", handlersEnvironment.GetBackfillHandler).Methods("GET")
+	router.HandleFunc("/devices/{id}/backfill", handlersEnvironment.CancelBackfillHandler).Methods("DELETE")
+	router.HandleFunc("/devices/{id}/measurements", handlersEnvironment.GetMeasurementsHandler).Methods("GET")
+	router.HandleFunc("/devices/{id}/stream", handlersEnvironment.StreamDeviceHandler).Methods("GET")
+	router.HandleFunc("/stream", handlersEnvironment.StreamHandler).Methods("GET")
+	router.HandleFunc("/ws", handlersEnvironment.WebSocketHandler).Methods("GET")
+	router.HandleFunc("/jobs", handlersEnvironment.GetJobsHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}", handlersEnvironment.GetJobHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}", handlersEnvironment.CancelJobHandler).Methods("DELETE")
+	router.HandleFunc("/jobs/{id}/file", handlersEnvironment.GetJobFileHandler).Methods("GET")
+	router.HandleFunc("/scenarios", handlersEnvironment.RunScenarioHandler).Methods("POST")
+	router.HandleFunc("/groups/{group}/start", handlersEnvironment.StartGroupHandler).Methods("POST")
+	router.HandleFunc("/groups/{group}/stop", handlersEnvironment.StopGroupHandler).Methods("POST")
+	router.HandleFunc("/audit", handlersEnvironment.GetAuditHandler).Methods("GET")
+
+	if c.auth != nil {
+		router.HandleFunc("/keys", handlersEnvironment.CreateApiKeyHandler).Methods("POST")
+		router.HandleFunc("/keys", handlersEnvironment.GetApiKeysHandler).Methods("GET")
+		router.HandleFunc("/keys/{id}", handlersEnvironment.RevokeApiKeyHandler).Methods("DELETE")
+		if c.limiter != nil {
+			// the anonymous clients are only limited by their IP, that covers the ones failing to authenticate
+			router.Use(c.limiter.FailedAuthMiddleware)
+		}
+		router.Use(c.auth.Middleware)
+	}
+	if c.limiter != nil {
+		router.Use(c.limiter.Middleware)
+	}
+	router.Use(c.bodyLimits.Middleware)
 
 	return router
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// actions of the scenario timeline
+const (
+	scenarioStart       = "start"
+	scenarioStop        = "stop"
+	scenarioFault       = "fault"
+	scenarioClearFaults = "clearFaults"
+	scenarioSetValue    = "setValue"
+)
+
+// Scenario describes a whole simulation: the devices to provision and what happens to them over time
+type Scenario struct {
+	Name     string           `yaml:"name"`
+	Devices  []ScenarioDevice `yaml:"devices"`
+	Timeline []ScenarioEvent  `yaml:"timeline"`
+}
+
+type ScenarioDevice struct {
+	Name      string            `yaml:"name"`
+	Value     float64           `yaml:"value"`
+	Unit      string            `yaml:"unit"`
+	Interval  int               `yaml:"interval"`
+	Jitter    int               `yaml:"jitter"`
+	Phase     int               `yaml:"phase"`
+	Cron      string            `yaml:"cron"`
+	Labels    map[string]string `yaml:"labels"`
+	Groups    []string          `yaml:"groups"`
+	Generator *ValueGenerator   `yaml:"generator"`
+}
+
+// ScenarioEvent happens At the given time since the scenario was started, to the device with the given name
+// or to all the devices of the scenario if there is no name
+type ScenarioEvent struct {
+	At     time.Duration `yaml:"at"`
+	Action string        `yaml:"action"`
+	Device string        `yaml:"device"`
+	Faults *DeviceFaults `yaml:"faults"`
+	Value  *float64      `yaml:"value"`
+}
+
+// ScenarioRun is what gets reported back once the scenario has been provisioned
+type ScenarioRun struct {
+	Name string `json:"name"`
+	// the names of the devices and the ids they were given
+	Devices   map[string]string `json:"devices"`
+	StartedAt time.Time         `json:"startedAt"`
+	Events    int               `json:"events"`
+	// the job going through the timeline
+	JobId string `json:"jobId,omitempty"`
+}
+
+// LoadScenario reads the scenario from YAML, which being a superset of JSON accepts JSON as well
+func LoadScenario(r io.Reader) (*Scenario, error) {
+	var scenario Scenario
+	decoder := yaml.NewDecoder(r)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, ErrValidation("malformed scenario: " + err.Error())
+	}
+	if err := scenario.validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+// validate checks what the device validation doesn't, that the timeline makes sense for the devices
+func (s *Scenario) validate() error {
+	if len(s.Devices) == 0 {
+		return ErrValidation("scenario has no devices")
+	}
+	names := make(map[string]bool, len(s.Devices))
+	for _, device := range s.Devices {
+		if names[device.Name] {
+			return ErrValidation("duplicate device name: " + device.Name)
+		}
+		names[device.Name] = true
+	}
+	for i, event := range s.Timeline {
+		if event.At < 0 {
+			return ErrValidation(fmt.Sprintf("event %d: negative time", i))
+		}
+		if event.Device != "" && !names[event.Device] {
+			return ErrValidation(fmt.Sprintf("event %d: unknown device: %s", i, event.Device))
+		}
+		switch event.Action {
+		case scenarioStart, scenarioStop, scenarioClearFaults:
+		case scenarioFault:
+			if event.Faults == nil {
+				return ErrValidation(fmt.Sprintf("event %d: faults are required", i))
+			}
+		case scenarioSetValue:
+			if event.Value == nil {
+				return ErrValidation(fmt.Sprintf("event %d: value is required", i))
+			}
+		default:
+			return ErrValidation(fmt.Sprintf("event %d: unknown action: %s", i, event.Action))
+		}
+	}
+	return nil
+}
+
+func (d *ScenarioDevice) toPayload() DevicePayload {
+	return DevicePayload{
+		Name:      d.Name,
+		Value:     d.Value,
+		Unit:      d.Unit,
+		Interval:  d.Interval,
+		Jitter:    d.Jitter,
+		Phase:     d.Phase,
+		Cron:      d.Cron,
+		Labels:    d.Labels,
+		Groups:    d.Groups,
+		Generator: d.Generator,
+	}
+}
+
+// scenarioRunner executes the timeline of a provisioned scenario
+type scenarioRunner struct {
+	controller *Controller
+	clock      Clock
+	scenario   *Scenario
+	// the ids of the devices by their names
+	ids map[string]string
+	// who has started the scenario, the changes made along the timeline are put down to them
+	source AuditSource
+}
+
+// provision creates all the devices of the scenario or none of them
+func (r *scenarioRunner) provision(ctx context.Context) error {
+	payloads := make([]DevicePayload, len(r.scenario.Devices))
+	for i := range r.scenario.Devices {
+		payloads[i] = r.scenario.Devices[i].toPayload()
+	}
+
+	result, err := r.controller.AddDevices(payloads, true, ctx)
+	if result == nil {
+		return err
+	}
+	if err != nil {
+		messages := make([]string, 0)
+		for _, item := range result.Items {
+			if item.Error != "" {
+				messages = append(messages, fmt.Sprintf("device %s: %s", payloads[item.Index].Name, item.Error))
+			}
+		}
+		return ErrValidation(strings.Join(messages, "; "))
+	}
+
+	r.ids = make(map[string]string, len(result.Items))
+	for _, item := range result.Items {
+		r.ids[item.Device.Name] = item.Device.Id.Hex()
+	}
+	return nil
+}
+
+// run goes through the timeline in order, waiting for each event on the clock. The progress is the part of the events
+// which have happened, cancelling ctx stops the timeline where it is
+func (r *scenarioRunner) run(started time.Time, progress *JobProgress, ctx context.Context) error {
+	timeline := make([]ScenarioEvent, len(r.scenario.Timeline))
+	copy(timeline, r.scenario.Timeline)
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].At < timeline[j].At })
+
+	for i, event := range timeline {
+		if wait := started.Add(event.At).Sub(r.clock.Now()); wait > 0 {
+			timer := r.clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		for _, id := range r.targets(event) {
+			if err := r.execute(event, id, ctx); err != nil {
+				log.Printf("scenario %s: %s on device %s failed: %s", r.scenario.Name, event.Action, id, err.Error())
+			}
+		}
+		progress.Set(float64(i+1) / float64(len(timeline)))
+	}
+	return nil
+}
+
+func (r *scenarioRunner) targets(event ScenarioEvent) []string {
+	if event.Device != "" {
+		return []string{r.ids[event.Device]}
+	}
+	ids := make([]string, 0, len(r.scenario.Devices))
+	for _, device := range r.scenario.Devices {
+		ids = append(ids, r.ids[device.Name])
+	}
+	return ids
+}
+
+func (r *scenarioRunner) execute(event ScenarioEvent, id string, ctx context.Context) error {
+	var err error
+	switch event.Action {
+	case scenarioStart:
+		err = r.controller.StartDevice(id, ctx)
+	case scenarioStop:
+		err = r.controller.StopDevice(id)
+	case scenarioFault:
+		_, err = r.controller.setDeviceFaults(id, event.Faults, r.source, ctx)
+	case scenarioClearFaults:
+		_, err = r.controller.setDeviceFaults(id, nil, r.source, ctx)
+	case scenarioSetValue:
+		_, err = r.controller.setDeviceValue(id, *event.Value, r.source, ctx)
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScenario = `
+name: cold-storage
+devices:
+  - name: freezer
+    value: -18
+    unit: C
+    interval: 1000
+    labels: {site: lab1}
+    generator: {type: sine, amplitude: 2, period: 60000}
+  - name: door
+    cron: "*/5 * * * *"
+timeline:
+  - at: 0s
+    action: start
+  - at: 30m
+    action: stop
+  - at: 5m
+    action: fault
+    device: freezer
+    faults:
+      stuck: true
+      spike: {probability: 0.1, magnitude: 10}
+`
+
+func Test_LoadScenario_GivenYAML_FuncReturnsScenario(t *testing.T) {
+	scenario, err := LoadScenario(strings.NewReader(testScenario))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "cold-storage", scenario.Name)
+	assert.Equal(t, ScenarioDevice{
+		Name:      "freezer",
+		Value:     -18,
+		Unit:      "C",
+		Interval:  1000,
+		Labels:    map[string]string{"site": "lab1"},
+		Generator: &ValueGenerator{Type: generatorSine, Amplitude: 2, Period: 60000},
+	}, scenario.Devices[0])
+	assert.Equal(t, ScenarioEvent{
+		At:     5 * time.Minute,
+		Action: scenarioFault,
+		Device: "freezer",
+		Faults: &DeviceFaults{Stuck: true, Spike: &SpikeFault{Probability: 0.1, Magnitude: 10}},
+	}, scenario.Timeline[2])
+}
+
+func Test_LoadScenario_GivenInvalidScenario_FuncReturnsErrValidation(t *testing.T) {
+	tests := map[string]string{
+		"malformed yaml":    "devices: [",
+		"unknown field":     "devices: [{name: a, colour: red}]",
+		"no devices":        "name: empty",
+		"duplicate devices": "devices: [{name: a}, {name: a}]",
+		"unknown device":    "devices: [{name: a}]\ntimeline: [{at: 1s, action: start, device: b}]",
+		"unknown action":    "devices: [{name: a}]\ntimeline: [{at: 1s, action: explode}]",
+		"fault with none":   "devices: [{name: a}]\ntimeline: [{at: 1s, action: fault}]",
+		"value missing":     "devices: [{name: a}]\ntimeline: [{at: 1s, action: setValue}]",
+		"negative time":     "devices: [{name: a}]\ntimeline: [{at: -1s, action: start}]",
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadScenario(strings.NewReader(tc))
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
+
+func TestScenarioRunner_GivenTimeline_EventsAreExecutedOnTime(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	dao := &mockDao{device: &Device{Id: primitive.NewObjectID(), Name: "freezer", Interval: 1000}}
+	c := &Controller{mainService: NewService(dao), tickerService: NewTickerService(clock), clock: clock}
+	c.tickerService.Start(nil, NewMeasurementQueue(1, DropNewest))
+	scenario, err := LoadScenario(strings.NewReader(testScenario))
+	assert.NoError(t, err)
+	runner := &scenarioRunner{controller: c, clock: clock, scenario: scenario}
+	assert.NoError(t, runner.provision(context.TODO()))
+	assert.Len(t, runner.ids, 2)
+	// the mock hands out the same device whatever the id
+	runner.ids["freezer"] = dao.device.Id.Hex()
+	runner.ids["door"] = dao.device.Id.Hex()
+
+	done := make(chan struct{})
+	go func() {
+		_ = runner.run(clock.Now(), nil, context.TODO())
+		close(done)
+	}()
+	// the scheduler ticking the device and the runner waiting for the next event
+	clock.BlockUntil(2)
+	running := c.tickerService.IsRunning(dao.device.Id)
+	faultsBefore := dao.device.Faults
+	clock.Advance(5 * time.Minute)
+	clock.BlockUntil(2)
+	faultsAfter := dao.device.Faults
+	clock.Advance(25 * time.Minute)
+	<-done
+
+	assert.True(t, running)
+	assert.Nil(t, faultsBefore)
+	assert.Equal(t, &DeviceFaults{Stuck: true, Spike: &SpikeFault{Probability: 0.1, Magnitude: 10}}, faultsAfter)
+	assert.False(t, c.tickerService.IsRunning(dao.device.Id))
+}
+
+func TestScenarioRunner_Provision_GivenInvalidDevice_NothingIsCreated(t *testing.T) {
+	dao := &mockDao{}
+	c := &Controller{mainService: NewService(dao)}
+	scenario := &Scenario{Devices: []ScenarioDevice{{Name: "ok"}, {Name: "x"}}}
+	runner := &scenarioRunner{controller: c, scenario: scenario}
+
+	err := runner.provision(context.TODO())
+
+	assert.IsType(t, ErrValidation(""), err)
+	assert.Contains(t, err.Error(), "device x")
+	assert.Equal(t, 0, dao.calledTimes)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/robfig/cron/v3"
+)
+
+// cron expressions take the standard five fields or descriptors like @hourly and @every 5m,
+// they are evaluated in the local time zone unless prefixed with CRON_TZ=
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+func parseCron(expression string) (cron.Schedule, error) {
+	return cronParser.Parse(expression)
+}
+
+func validateCron(fl validator.FieldLevel) bool {
+	_, err := parseCron(fl.Field().String())
+	return err == nil
+}
+
+// validateDeviceSchedule makes sure a device ticks either at its interval or along its cron expression
+func validateDeviceSchedule(sl validator.StructLevel) {
+	payload := sl.Current().Interface().(DevicePayload)
+	if payload.Cron != "" && payload.Interval != 0 {
+		sl.ReportError(payload.Interval, "Interval", "Interval", "excluded_with", "Cron")
+	}
+}
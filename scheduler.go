@@ -0,0 +1,382 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"math"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scheduleEntry is a device waiting in the heap for its next tick
+type scheduleEntry struct {
+	device Device
+	// nil for devices ticking at their interval
+	cron cron.Schedule
+	// due is where the tick falls on the device's schedule, next is when it fires once the jitter is added
+	due       time.Time
+	next      time.Time
+	generator *generatorState
+	faults    *faultState
+	// breaks ties between devices due at the same instant, the one added first goes first
+	seq   uint64
+	index int
+}
+
+type scheduleHeap []*scheduleEntry
+
+func (h scheduleHeap) Len() int { return len(h) }
+
+func (h scheduleHeap) Less(i, j int) bool {
+	if h[i].next.Equal(h[j].next) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].next.Before(h[j].next)
+}
+
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	entry := x.(*scheduleEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// never is where devices whose cron expression can't be satisfied wait
+var never = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// idleWait is how long the timing loop waits without any devices, a simulation sees a timer which is never due
+// and knows that there's nothing left to fire
+const idleWait = time.Duration(math.MaxInt64)
+
+// Scheduler fires all the devices from a single timing goroutine keeping them in a heap ordered by their next tick,
+// the measurements are pushed by a pool of workers so that a blocked queue doesn't throw the timing off.
+// Ticks are due at exact multiples of the interval since the device was added (shifted by its phase)
+// or along its cron expression, the jitter only delays the single tick without moving the schedule.
+// Ticks that couldn't be handled in time are skipped and counted
+type Scheduler struct {
+	mutex   sync.Mutex
+	heap    scheduleHeap
+	entries map[primitive.ObjectID]*scheduleEntry
+	seq     uint64
+	skipped uint64
+	random  *rand.Rand
+	// how many ticks were handed over to the workers and haven't been pushed yet
+	pending int
+	pushed  *sync.Cond
+
+	clock   Clock
+	queue   *MeasurementQueue
+	workers int
+	wake    chan struct{}
+	ticks   chan Measurement
+	stop    chan bool
+	wg      sync.WaitGroup
+}
+
+func NewScheduler(queue *MeasurementQueue, workers int, clock Clock) *Scheduler {
+	if workers <= 0 {
+		workers = 1
+	}
+	s := &Scheduler{
+		entries: make(map[primitive.ObjectID]*scheduleEntry),
+		clock:   clock,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		queue:   queue,
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+		ticks:   make(chan Measurement, workers),
+		stop:    make(chan bool),
+	}
+	s.pushed = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (s *Scheduler) Start() {
+	s.wg.Add(s.workers + 1)
+	go s.run()
+	for i := 0; i < s.workers; i++ {
+		go s.work()
+	}
+}
+
+// Stop waits for the timing loop and the workers to finish
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+	// the ticks which haven't been pushed are gone, nobody is left to wait for them
+	s.mutex.Lock()
+	s.pending = 0
+	s.pushed.Broadcast()
+	s.mutex.Unlock()
+}
+
+// Drain waits until the workers have pushed every tick which has been due so far, with the block policy
+// that is until the queue has taken them all. A simulation drains the scheduler before stopping it at its end
+func (s *Scheduler) Drain() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.pending > 0 {
+		s.pushed.Wait()
+	}
+}
+
+// Add schedules the device's first tick one interval after its phase, it returns false if the device is already scheduled
+func (s *Scheduler) Add(device Device) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.entries[device.Id]; ok {
+		return false
+	}
+	s.seq++
+	now := s.clock.Now()
+	entry := &scheduleEntry{device: device, cron: deviceCron(&device), seq: s.seq}
+	entry.generator = newGeneratorState(&device, now)
+	entry.faults = newFaultState(&device, now)
+	s.reschedule(entry, now.Add(time.Duration(device.Phase)*time.Millisecond), now)
+	s.entries[device.Id] = entry
+	heap.Push(&s.heap, entry)
+	s.poke()
+	return true
+}
+
+// Update swaps the device kept by the scheduler, the schedule is only reset when the interval or the cron expression
+// has changed. The generator starts over from a new value and the faults only when they have been changed
+func (s *Scheduler) Update(device Device) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[device.Id]
+	if !ok {
+		return false
+	}
+	now := s.clock.Now()
+	if entry.device.Value != device.Value || !reflect.DeepEqual(entry.device.Generator, device.Generator) {
+		entry.generator = newGeneratorState(&device, now)
+	}
+	if !reflect.DeepEqual(entry.device.Faults, device.Faults) {
+		entry.faults = newFaultState(&device, now)
+	}
+	changed := entry.device.Interval != device.Interval || entry.device.Cron != device.Cron
+	entry.device = device
+	if changed {
+		entry.cron = deviceCron(&device)
+		s.reschedule(entry, now, now)
+		heap.Fix(&s.heap, entry.index)
+		s.poke()
+	}
+	return true
+}
+
+func (s *Scheduler) Remove(id primitive.ObjectID) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		return false
+	}
+	heap.Remove(&s.heap, entry.index)
+	delete(s.entries, id)
+	s.poke()
+	return true
+}
+
+func (s *Scheduler) Has(id primitive.ObjectID) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.entries[id]
+	return ok
+}
+
+func (s *Scheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries)
+}
+
+// Skipped tells how many ticks were skipped because the scheduler fell behind
+func (s *Scheduler) Skipped() uint64 {
+	return atomic.LoadUint64(&s.skipped)
+}
+
+// poke wakes the timing loop up so that it looks at the heap again, the mutex has to be held
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer s.wg.Done()
+	// created on the first wait, so that a virtual clock never sees a timer nobody is waiting for
+	var timer Timer
+
+	for {
+		s.mutex.Lock()
+		due, wait := s.popDue(s.clock.Now())
+		s.pending += len(due)
+		s.mutex.Unlock()
+
+		for _, measurement := range due {
+			select {
+			case s.ticks <- measurement:
+			case <-s.stop:
+				return
+			}
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		if wait < 0 {
+			wait = idleWait
+		}
+		if timer == nil {
+			timer = s.clock.NewTimer(wait)
+		} else {
+			timer.Reset(wait)
+		}
+		select {
+		case <-timer.C():
+		case <-s.wake:
+			if !timer.Stop() {
+				<-timer.C()
+			}
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// popDue takes all the ticks due at now and reschedules their devices,
+// wait is how long until the next tick or negative if there are no devices at all
+func (s *Scheduler) popDue(now time.Time) (due []Measurement, wait time.Duration) {
+	for len(s.heap) > 0 {
+		entry := s.heap[0]
+		if entry.next.After(now) {
+			return due, entry.next.Sub(now)
+		}
+		// the measurement is stamped with when it was due rather than when it got handled
+		measurement := entry.device.measurement(entry.next)
+		if entry.generator != nil {
+			measurement.Value = entry.generator.next(measurement.Timestamp, s.random)
+		}
+		if entry.faults == nil || entry.faults.apply(&measurement, s.random) {
+			due = append(due, measurement)
+		}
+
+		atomic.AddUint64(&s.skipped, s.reschedule(entry, entry.due, now))
+		heap.Fix(&s.heap, 0)
+	}
+	return due, -1
+}
+
+// reschedule moves the entry to its first tick after from which is still to come at now
+// and returns how many ticks were passed over on the way, the mutex has to be held
+func (s *Scheduler) reschedule(entry *scheduleEntry, from, now time.Time) (skipped uint64) {
+	if entry.cron != nil {
+		entry.due = entry.cron.Next(from)
+		for !entry.due.IsZero() && !entry.due.After(now) {
+			entry.due = entry.cron.Next(entry.due)
+			skipped++
+		}
+		if entry.due.IsZero() {
+			// the expression can't be satisfied (like the 30th of February)
+			entry.due = never
+		}
+	} else {
+		interval := entry.device.interval()
+		entry.due = from.Add(interval)
+		if !entry.due.After(now) {
+			missed := now.Sub(entry.due)/interval + 1
+			entry.due = entry.due.Add(missed * interval)
+			skipped = uint64(missed)
+		}
+	}
+	entry.next = entry.due.Add(s.jitter(entry))
+	return skipped
+}
+
+// jitter is a random delay of up to the device's percentage of the time between its ticks
+func (s *Scheduler) jitter(entry *scheduleEntry) time.Duration {
+	if entry.device.Jitter <= 0 || entry.due.Equal(never) {
+		return 0
+	}
+	span := entry.device.interval()
+	if entry.cron != nil {
+		following := entry.cron.Next(entry.due)
+		if following.IsZero() {
+			return 0
+		}
+		span = following.Sub(entry.due)
+	}
+	max := int64(span) * int64(entry.device.Jitter) / 100
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(s.random.Int63n(max))
+}
+
+func deviceCron(device *Device) cron.Schedule {
+	if device.Cron == "" {
+		return nil
+	}
+	schedule, err := parseCron(device.Cron)
+	if err != nil {
+		log.Printf("device %s has an invalid cron expression, it falls back to its interval: %s", device.Id.Hex(), err.Error())
+		return nil
+	}
+	return schedule
+}
+
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+	for {
+		select {
+		case measurement := <-s.ticks:
+			s.push(measurement)
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *Scheduler) push(measurement Measurement) {
+	s.queue.Push(measurement, s.stop)
+	s.mutex.Lock()
+	if s.pending--; s.pending <= 0 {
+		s.pushed.Broadcast()
+	}
+	s.mutex.Unlock()
+}
+
+// flush hands the ticks which were already due over to the queue as long as there's room for them
+func (s *Scheduler) flush() {
+	for {
+		select {
+		case measurement := <-s.ticks:
+			s.push(measurement)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// legacyDeviceTicker is how every device used to be run before the scheduler, kept around for the benchmarks
+func legacyDeviceTicker(d Device, queue *MeasurementQueue, stop <-chan bool) {
+	ticker := time.NewTicker(d.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case timestamp := <-ticker.C:
+			queue.Push(d.measurement(timestamp), stop)
+		}
+	}
+}
+
+func BenchmarkLegacyTickers_1k(b *testing.B)   { benchmarkTickers(b, 1000, startLegacyTickers) }
+func BenchmarkLegacyTickers_10k(b *testing.B)  { benchmarkTickers(b, 10000, startLegacyTickers) }
+func BenchmarkLegacyTickers_100k(b *testing.B) { benchmarkTickers(b, 100000, startLegacyTickers) }
+func BenchmarkScheduler_1k(b *testing.B)       { benchmarkTickers(b, 1000, startScheduler) }
+func BenchmarkScheduler_10k(b *testing.B)      { benchmarkTickers(b, 10000, startScheduler) }
+func BenchmarkScheduler_100k(b *testing.B)     { benchmarkTickers(b, 100000, startScheduler) }
+
+func startLegacyTickers(devices []Device, queue *MeasurementQueue) func() {
+	stop := make(chan bool)
+	for _, device := range devices {
+		go legacyDeviceTicker(device, queue, stop)
+	}
+	return func() { close(stop) }
+}
+
+func startScheduler(devices []Device, queue *MeasurementQueue) func() {
+	s := NewScheduler(queue, runtime.NumCPU(), SystemClock{})
+	s.Start()
+	for _, device := range devices {
+		s.Add(device)
+	}
+	return s.Stop
+}
+
+// benchmarkTickers runs the devices with a one second interval and consumes b.N of their measurements.
+// Besides the usual ones it reports the memory held per device once they are all running
+// and the cpu time spent per measurement
+func benchmarkTickers(b *testing.B, count int, start func([]Device, *MeasurementQueue) func()) {
+	devices := make([]Device, count)
+	for i := range devices {
+		devices[i] = Device{Id: primitive.NewObjectID(), Interval: 1000, Value: float64(i)}
+	}
+	queue := NewMeasurementQueue(defaultQueueCapacity, Block)
+
+	before := memoryInUse()
+	stop := start(devices, queue)
+	after := memoryInUse()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	cpuBefore := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		<-queue.C()
+	}
+	cpuAfter := cpuTime(b)
+	b.StopTimer()
+	// reported only now because ResetTimer throws the metrics away
+	b.ReportMetric(float64(after-before)/float64(count), "B/device")
+	b.ReportMetric(float64(cpuAfter-cpuBefore)/float64(b.N), "cpu-ns/op")
+
+	stop()
+}
+
+func memoryInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse + stats.StackInuse
+}
+
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
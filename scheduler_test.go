@@ -0,0 +1,213 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var schedulerEpoch = time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+
+// advanceBy moves the clock in steps, letting the scheduler handle the ticks and arm its timer again after every step
+func advanceBy(clock *FakeClock, step time.Duration, steps int) {
+	for i := 0; i < steps; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(step)
+	}
+	clock.BlockUntil(1)
+}
+
+func receive(queue *MeasurementQueue, n int) []Measurement {
+	measurements := make([]Measurement, n)
+	for i := range measurements {
+		measurements[i] = <-queue.C()
+	}
+	return measurements
+}
+
+func TestScheduler_GivenDevicesWithDifferentIntervals_MeasurementsComeInOrderOfTheirTicks(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	fast := Device{Id: primitive.NewObjectID(), Interval: 10, Value: 1}
+	slow := Device{Id: primitive.NewObjectID(), Interval: 25, Value: 2}
+	s.Add(slow)
+	s.Add(fast)
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, 5*time.Millisecond, 10)
+	measurements := receive(queue, 7)
+
+	at := func(ms int) time.Time { return schedulerEpoch.Add(time.Duration(ms) * time.Millisecond) }
+	expected := []Measurement{
+		fast.measurement(at(10)),
+		fast.measurement(at(20)),
+		slow.measurement(at(25)),
+		fast.measurement(at(30)),
+		fast.measurement(at(40)),
+		// due at the same instant, the one added first goes first
+		slow.measurement(at(50)),
+		fast.measurement(at(50)),
+	}
+	assert.Equal(t, expected, measurements)
+	assert.Equal(t, uint64(0), s.Skipped())
+}
+
+func TestScheduler_GivenTimeJumpingOverTicks_MissedTicksAreSkippedAndCounted(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	s.Add(device)
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, 3500*time.Millisecond, 1)
+	measurement := <-queue.C()
+	advanceBy(clock, 500*time.Millisecond, 1)
+	next := <-queue.C()
+
+	assert.Equal(t, schedulerEpoch.Add(time.Second), measurement.Timestamp)
+	assert.Equal(t, schedulerEpoch.Add(4*time.Second), next.Timestamp)
+	assert.Equal(t, uint64(2), s.Skipped())
+}
+
+func TestScheduler_Remove_GivenScheduledDevice_DeviceStopsTicking(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	removed := Device{Id: primitive.NewObjectID(), Interval: 10}
+	kept := Device{Id: primitive.NewObjectID(), Interval: 10}
+	s.Start()
+	defer s.Stop()
+
+	assert.True(t, s.Add(removed))
+	assert.True(t, s.Add(kept))
+	assert.False(t, s.Add(removed))
+	advanceBy(clock, 10*time.Millisecond, 1)
+	first := receive(queue, 2)
+	assert.True(t, s.Remove(removed.Id))
+	assert.False(t, s.Remove(removed.Id))
+	advanceBy(clock, 10*time.Millisecond, 2)
+	rest := receive(queue, 2)
+
+	assert.Equal(t, []primitive.ObjectID{removed.Id, kept.Id}, []primitive.ObjectID{first[0].Id, first[1].Id})
+	assert.Equal(t, []primitive.ObjectID{kept.Id, kept.Id}, []primitive.ObjectID{rest[0].Id, rest[1].Id})
+	assert.False(t, s.Has(removed.Id))
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestScheduler_Update_GivenNewValue_DeviceKeepsItsSchedule(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	device := Device{Id: primitive.NewObjectID(), Interval: 10}
+	s.Add(device)
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, 5*time.Millisecond, 1)
+	device.Value = 42
+	assert.True(t, s.Update(device))
+	advanceBy(clock, 5*time.Millisecond, 1)
+	measurement := <-queue.C()
+
+	assert.Equal(t, device.measurement(schedulerEpoch.Add(10*time.Millisecond)), measurement)
+	assert.False(t, s.Update(Device{Id: primitive.NewObjectID()}))
+}
+
+func TestScheduler_Update_GivenNewInterval_ScheduleStartsOver(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	device := Device{Id: primitive.NewObjectID(), Interval: 10}
+	s.Add(device)
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, 5*time.Millisecond, 1)
+	device.Interval = 20
+	s.Update(device)
+	advanceBy(clock, 5*time.Millisecond, 4)
+	measurement := <-queue.C()
+
+	assert.Equal(t, schedulerEpoch.Add(25*time.Millisecond), measurement.Timestamp)
+}
+
+func TestScheduler_GivenPhase_FirstTickIsDelayedByIt(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	s.Add(Device{Id: primitive.NewObjectID(), Interval: 1000, Phase: 250})
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, 250*time.Millisecond, 9)
+	measurements := receive(queue, 2)
+
+	assert.Equal(t, schedulerEpoch.Add(1250*time.Millisecond), measurements[0].Timestamp)
+	assert.Equal(t, schedulerEpoch.Add(2250*time.Millisecond), measurements[1].Timestamp)
+}
+
+func TestScheduler_GivenJitter_TicksAreDelayedWithinTheirShareOfTheInterval(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	s.random = rand.New(rand.NewSource(1))
+	s.Add(Device{Id: primitive.NewObjectID(), Interval: 1000, Jitter: 20})
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, time.Millisecond, 5000)
+	measurements := receive(queue, 4)
+
+	delayed := false
+	for i, measurement := range measurements {
+		due := schedulerEpoch.Add(time.Duration(i+1) * time.Second)
+		delay := measurement.Timestamp.Sub(due)
+		assert.True(t, delay >= 0 && delay < 200*time.Millisecond, "tick %d delayed by %s", i, delay)
+		delayed = delayed || delay > 0
+	}
+	assert.True(t, delayed)
+	assert.Equal(t, uint64(0), s.Skipped())
+}
+
+func TestScheduler_GivenCron_TicksFollowTheExpression(t *testing.T) {
+	// a Friday afternoon
+	start := time.Date(2019, 11, 29, 17, 40, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	queue := NewMeasurementQueue(16, Block)
+	s := NewScheduler(queue, 1, clock)
+	s.Add(Device{Id: primitive.NewObjectID(), Cron: "CRON_TZ=UTC */5 9-17 * * 1-5"})
+	s.Start()
+	defer s.Stop()
+
+	advanceBy(clock, 5*time.Minute, 4)
+	// straight over the weekend to Monday morning
+	advanceBy(clock, time.Date(2019, 12, 2, 9, 0, 0, 0, time.UTC).Sub(start.Add(20*time.Minute)), 1)
+	measurements := receive(queue, 4)
+
+	var timestamps []time.Time
+	for _, measurement := range measurements {
+		timestamps = append(timestamps, measurement.Timestamp)
+	}
+	assert.Equal(t, []time.Time{
+		time.Date(2019, 11, 29, 17, 45, 0, 0, time.UTC),
+		time.Date(2019, 11, 29, 17, 50, 0, 0, time.UTC),
+		time.Date(2019, 11, 29, 17, 55, 0, 0, time.UTC),
+		time.Date(2019, 12, 2, 9, 0, 0, 0, time.UTC),
+	}, timestamps)
+	assert.Equal(t, uint64(0), s.Skipped())
+}
+
+func TestScheduler_PopDue_GivenNoDevices_WaitIsNegative(t *testing.T) {
+	s := NewScheduler(NewMeasurementQueue(1, Block), 1, NewFakeClock(schedulerEpoch))
+
+	due, wait := s.popDue(schedulerEpoch)
+
+	assert.Empty(t, due)
+	assert.True(t, wait < 0)
+}
@@ -4,12 +4,66 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"strings"
 )
 
 type DevicePayload struct {
-	Name     string  `json:"name" validate:"required,min=2,max=30"`
-	Interval int     `json:"interval,string" validate:"gt=0,numeric"`
-	Value    float64 `json:"value,string" validate:"numeric"`
+	Id       string            `json:"id,omitempty" validate:"omitempty,len=24,hexadecimal"`
+	Name     string            `json:"name" validate:"required,min=2,max=30"`
+	Interval int               `json:"interval,string" validate:"required_without=Cron,gte=0,numeric"`
+	Value    float64           `json:"value,string" validate:"numeric"`
+	Unit     string            `json:"unit,omitempty" validate:"max=16"`
+	Labels   map[string]string `json:"labels,omitempty" validate:"max=32,dive,keys,labelname,endkeys,labelvalue"`
+	Groups   []string          `json:"groups,omitempty" validate:"max=16,dive,labelname"`
+	Jitter   int               `json:"jitter,string,omitempty" validate:"min=0,max=100"`
+	Phase    int               `json:"phase,string,omitempty" validate:"min=0"`
+	Cron     string            `json:"cron,omitempty" validate:"omitempty,max=128,cron"`
+	// the value is where the generator starts from
+	Generator *ValueGenerator `json:"generator,omitempty"`
+}
+
+// toDevice keeps the id from the payload when it has one, otherwise the given one is used
+func (p *DevicePayload) toDevice(id primitive.ObjectID) Device {
+	if p.Id != "" {
+		if payloadID, err := stringIDToObjectID(p.Id); err == nil {
+			id = payloadID
+		}
+	}
+	return Device{
+		Id:        id,
+		Name:      p.Name,
+		Value:     p.Value,
+		Interval:  p.Interval,
+		Unit:      p.Unit,
+		Labels:    p.Labels,
+		Groups:    p.Groups,
+		Jitter:    p.Jitter,
+		Phase:     p.Phase,
+		Cron:      p.Cron,
+		Generator: p.Generator,
+	}
+}
+
+// newDevicePayload is the inverse of toDevice, so that whatever is exported can be imported back
+func newDevicePayload(device *Device, withId bool) DevicePayload {
+	payload := DevicePayload{
+		Name:      device.Name,
+		Value:     device.Value,
+		Interval:  device.Interval,
+		Unit:      device.Unit,
+		Labels:    device.Labels,
+		Groups:    device.Groups,
+		Jitter:    device.Jitter,
+		Phase:     device.Phase,
+		Cron:      device.Cron,
+		Generator: device.Generator,
+	}
+	if withId {
+		payload.Id = device.Id.Hex()
+	}
+	return payload
 }
 
 type Service struct {
@@ -18,16 +72,19 @@ type Service struct {
 }
 
 func NewService(dao DeviceDao) *Service {
+	validate := validator.New()
+	_ = validate.RegisterValidation("labelname", validateLabelName)
+	_ = validate.RegisterValidation("labelvalue", validateLabelValue)
+	_ = validate.RegisterValidation("cron", validateCron)
+	validate.RegisterStructValidation(validateDeviceSchedule, DevicePayload{})
 	return &Service{
 		Dao:       dao,
-		validator: validator.New(),
+		validator: validate,
 	}
 }
 
 func (s *Service) AddDevice(payload *DevicePayload, ctx context.Context) (*Device, error) {
-	if payload.Interval == 0 {
-		payload.Interval = 1000
-	}
+	setDevicePayloadDefaults(payload)
 	if err := s.validateDevicePayload(payload); err != nil {
 		return nil, err
 	}
@@ -36,12 +93,97 @@ func (s *Service) AddDevice(payload *DevicePayload, ctx context.Context) (*Devic
 		return nil, err
 	}
 
-	return &Device{
-		Id:       id,
-		Name:     payload.Name,
-		Value:    payload.Value,
-		Interval: payload.Interval,
-	}, nil
+	device := payload.toDevice(id)
+	return &device, nil
+}
+
+// AddDevices validates and inserts all the payloads reporting the outcome for every one of them.
+// In atomic mode nothing is stored unless every device is valid and gets written,
+// in which case the result is returned along with the error explaining the rejection
+func (s *Service) AddDevices(payloads []DevicePayload, atomic bool, ctx context.Context) (*BulkResult, error) {
+	result := &BulkResult{Items: make([]BulkItemResult, len(payloads))}
+	valid := make([]*DevicePayload, 0, len(payloads))
+	positions := make([]int, 0, len(payloads))
+	for i := range payloads {
+		result.Items[i].Index = i
+		setDevicePayloadDefaults(&payloads[i])
+		if err := s.validateDevicePayload(&payloads[i]); err != nil {
+			result.Items[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, &payloads[i])
+		positions = append(positions, i)
+	}
+
+	if atomic && len(valid) < len(payloads) {
+		rejectRemaining(result)
+		return result, ErrValidation("the batch contains invalid devices")
+	}
+	if len(valid) == 0 {
+		result.Failed = len(payloads)
+		return result, nil
+	}
+
+	ids, err := s.Dao.AddDevices(valid, atomic, ctx)
+	failed, isBulkErr := err.(ErrBulkWrite)
+	if err != nil && !isBulkErr {
+		if atomic {
+			s.rollbackDevices(ids, ctx)
+		}
+		return nil, err
+	}
+	if atomic && isBulkErr {
+		inserted := make([]primitive.ObjectID, 0, len(ids))
+		for i, id := range ids {
+			if _, ok := failed[i]; !ok {
+				inserted = append(inserted, id)
+			}
+		}
+		s.rollbackDevices(inserted, ctx)
+		for i, reason := range failed {
+			result.Items[positions[i]].Error = reason
+		}
+		rejectRemaining(result)
+		return result, failed
+	}
+
+	for i, id := range ids {
+		item := &result.Items[positions[i]]
+		if reason, ok := failed[i]; ok {
+			item.Error = reason
+			continue
+		}
+		device := valid[i].toDevice(id)
+		item.Device = &device
+	}
+	for _, item := range result.Items {
+		if item.Error == "" {
+			result.Created++
+		} else {
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+func (s *Service) rollbackDevices(ids []primitive.ObjectID, ctx context.Context) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := s.Dao.DeleteDevices(ids, ctx); err != nil {
+		log.Printf("could not roll back %d devices: %s", len(ids), err.Error())
+	}
+}
+
+// rejectRemaining marks the items without an error as skipped
+func rejectRemaining(result *BulkResult) {
+	for i := range result.Items {
+		if result.Items[i].Error == "" {
+			result.Items[i].Error = "skipped, the batch was rejected"
+		}
+	}
+	result.Created = 0
+	result.Failed = len(result.Items)
 }
 
 func (s *Service) GetDevice(id string, ctx context.Context) (*Device, error) {
@@ -52,21 +194,124 @@ func (s *Service) GetDevice(id string, ctx context.Context) (*Device, error) {
 	return s.Dao.GetDevice(objectID, ctx)
 }
 
-func (s *Service) GetPaginatedDevices(limit, page int, ctx context.Context) ([]Device, error) {
-	return s.Dao.GetPaginatedDevices(limit, page, ctx)
+// SetDeviceValue stores the new value and returns the device as it is after the update
+func (s *Service) SetDeviceValue(id string, value float64, ctx context.Context) (*Device, error) {
+	objectID, err := stringIDToObjectID(id)
+	if err != nil {
+		return nil, ErrValidation("")
+	}
+	return s.Dao.UpdateDeviceValue(objectID, value, ctx)
+}
+
+// SetDeviceFaults validates and stores the faults, nil clears them
+func (s *Service) SetDeviceFaults(id string, faults *DeviceFaults, ctx context.Context) (*Device, error) {
+	objectID, err := stringIDToObjectID(id)
+	if err != nil {
+		return nil, ErrValidation("")
+	}
+	if faults != nil {
+		if err = s.validateStruct(faults); err != nil {
+			return nil, err
+		}
+	}
+	return s.Dao.UpdateDeviceFaults(objectID, faults, ctx)
+}
+
+// GetPaginatedDevices returns the requested page along with the total number of devices matching the query
+func (s *Service) GetPaginatedDevices(limit, page int, query *DeviceQuery, ctx context.Context) ([]Device, int64, error) {
+	devices, err := s.Dao.GetPaginatedDevices(limit, page, query, ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.Dao.CountDevices(query, ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return devices, total, nil
+}
+
+// GetDevicesByCursor returns up to limit devices following (or preceding) the position encoded in the token,
+// an empty token starts from the beginning
+func (s *Service) GetDevicesByCursor(query *DeviceQuery, token string, limit int, ctx context.Context) (*DeviceCursorPage, error) {
+	if limit <= 0 {
+		return nil, ErrValidation("limit must be positive when paginating with a cursor")
+	}
+	// the cursor only ever walks the ids upwards, any other order would be silently lost
+	if (query.SortBy != "" && query.SortBy != "id") || query.SortDesc {
+		return nil, ErrValidation("cursor pagination is always ordered by ascending id")
+	}
+	cursor, err := decodeCursor(token)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := s.Dao.GetDevicesByCursor(query, cursor, limit, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(devices) > limit
+	if hasMore {
+		devices = devices[:limit]
+	}
+	backwards := cursor != nil && cursor.Before
+	if backwards {
+		for i, j := 0, len(devices)-1; i < j; i, j = i+1, j-1 {
+			devices[i], devices[j] = devices[j], devices[i]
+		}
+	}
+
+	page := &DeviceCursorPage{Data: devices}
+	if len(devices) == 0 {
+		return page, nil
+	}
+	// going backwards there's always the page we came from ahead of us and vice versa,
+	// unless we've just started at the beginning
+	if backwards || hasMore {
+		page.Next = encodeCursor(DeviceCursor{Id: devices[len(devices)-1].Id})
+	}
+	if (backwards && hasMore) || (!backwards && cursor != nil) {
+		page.Prev = encodeCursor(DeviceCursor{Id: devices[0].Id, Before: true})
+	}
+	return page, nil
+}
+
+// ExportDevices calls fn with every device matching the query, one at a time
+func (s *Service) ExportDevices(query *DeviceQuery, fn func(*Device) error, ctx context.Context) error {
+	return s.Dao.StreamDevices(query, fn, ctx)
+}
+
+func (s *Service) GetDevicesInGroup(group string, ctx context.Context) ([]Device, error) {
+	devices := make([]Device, 0)
+	err := s.Dao.StreamDevices(&DeviceQuery{Group: group}, func(device *Device) error {
+		devices = append(devices, *device)
+		return nil
+	}, ctx)
+	return devices, err
 }
 
 func (s *Service) GetAllDevices(ctx context.Context) ([]Device, error) {
 	return s.Dao.GetAllDevices(ctx)
 }
 
+func setDevicePayloadDefaults(payload *DevicePayload) {
+	if payload.Interval == 0 && payload.Cron == "" {
+		payload.Interval = 1000
+	}
+}
+
 func (s *Service) validateDevicePayload(payload *DevicePayload) error {
-	validationErrors := s.validator.Struct(payload)
+	return s.validateStruct(payload)
+}
+
+func (s *Service) validateStruct(value interface{}) error {
+	validationErrors := s.validator.Struct(value)
 	if validationErrors != nil {
+		messages := make([]string, 0)
 		for _, err := range validationErrors.(validator.ValidationErrors) {
-			fmt.Println(err)
+			messages = append(messages, fmt.Sprintf("%s failed on the '%s' rule", err.Field(), err.Tag()))
 		}
-		return ErrValidation("")
+		return ErrValidation(strings.Join(messages, "; "))
 	}
 	return nil
 }
@@ -13,6 +13,9 @@ type mockDao struct {
 	calledTimes int
 	device      *Device
 	data        []Device
+	query       *DeviceQuery
+	cursor      *DeviceCursor
+	deleted     []primitive.ObjectID
 }
 
 func (m *mockDao) AddDevice(device *DevicePayload, ctx context.Context) (primitive.ObjectID, error) {
@@ -20,14 +23,66 @@ func (m *mockDao) AddDevice(device *DevicePayload, ctx context.Context) (primiti
 	return m.returnValue, m.returnErr
 }
 
+func (m *mockDao) AddDevices(devices []*DevicePayload, ordered bool, ctx context.Context) ([]primitive.ObjectID, error) {
+	m.calledTimes++
+	ids := make([]primitive.ObjectID, len(devices))
+	for i := range ids {
+		ids[i] = primitive.NewObjectID()
+	}
+	return ids, m.returnErr
+}
+
+func (m *mockDao) DeleteDevices(ids []primitive.ObjectID, ctx context.Context) error {
+	m.deleted = append(m.deleted, ids...)
+	return nil
+}
+
 func (m *mockDao) GetDevice(id primitive.ObjectID, ctx context.Context) (*Device, error) {
 	return m.device, m.returnErr
 }
 
-func (m *mockDao) GetPaginatedDevices(limit, page int, ctx context.Context) ([]Device, error) {
+func (m *mockDao) UpdateDeviceValue(id primitive.ObjectID, value float64, ctx context.Context) (*Device, error) {
+	if m.device != nil {
+		m.device.Value = value
+	}
+	return m.device, m.returnErr
+}
+
+func (m *mockDao) UpdateDeviceFaults(id primitive.ObjectID, faults *DeviceFaults, ctx context.Context) (*Device, error) {
+	if m.device != nil {
+		m.device.Faults = faults
+	}
+	return m.device, m.returnErr
+}
+
+func (m *mockDao) GetPaginatedDevices(limit, page int, query *DeviceQuery, ctx context.Context) ([]Device, error) {
+	m.query = query
 	return m.data, m.returnErr
 }
 
+func (m *mockDao) CountDevices(query *DeviceQuery, ctx context.Context) (int64, error) {
+	return int64(len(m.data)), m.returnErr
+}
+
+func (m *mockDao) GetDevicesByCursor(query *DeviceQuery, cursor *DeviceCursor, limit int, ctx context.Context) ([]Device, error) {
+	m.query = query
+	m.cursor = cursor
+	return m.data, m.returnErr
+}
+
+func (m *mockDao) StreamDevices(query *DeviceQuery, fn func(*Device) error, ctx context.Context) error {
+	if m.returnErr != nil {
+		return m.returnErr
+	}
+	m.query = query
+	for i := range m.data {
+		if err := fn(&m.data[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *mockDao) GetAllDevices(ctx context.Context) ([]Device, error) {
 	return m.data, m.returnErr
 }
@@ -112,18 +167,19 @@ func TestService_GetDevice_GivenIdThatDoesntExist_ServiceReturnsNil(t *testing.T
 func TestService_GetPaginatedDevices_GivenList_ServiceReturnsList(t *testing.T) {
 	out := NewService(&mockDao{data: []Device{{Name: "test name"}}})
 
-	devices, err := out.GetPaginatedDevices(0, 0, context.TODO())
+	devices, total, err := out.GetPaginatedDevices(0, 0, &DeviceQuery{}, context.TODO())
 
 	expected := []Device{{Name: "test name"}}
 
 	assert.NoError(t, err)
 	assert.Equal(t, expected, devices)
+	assert.Equal(t, int64(1), total)
 }
 
 func TestService_GetPaginatedDevices_GivenDaoError_ServiceReturnsError(t *testing.T) {
 	out := NewService(&mockDao{returnErr: ErrDao("")})
 
-	_, err := out.GetPaginatedDevices(1, 0, context.TODO())
+	_, _, err := out.GetPaginatedDevices(1, 0, &DeviceQuery{}, context.TODO())
 
 	assert.Equal(t, ErrDao(""), err)
 }
@@ -135,3 +191,223 @@ func TestService_GetAllDevices_GivenDaoError_ServiceReturnsError(t *testing.T) {
 
 	assert.Error(t, ErrDao(""), err)
 }
+
+func TestService_GetDevicesByCursor_GivenFirstPageWithMore_ServiceReturnsOnlyNextCursor(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	dao := &mockDao{data: []Device{{Id: ids[0]}, {Id: ids[1]}, {Id: ids[2]}}}
+	out := NewService(dao)
+
+	page, err := out.GetDevicesByCursor(&DeviceQuery{}, "", 2, context.TODO())
+
+	assert.NoError(t, err)
+	assert.Nil(t, dao.cursor)
+	assert.Equal(t, []Device{{Id: ids[0]}, {Id: ids[1]}}, page.Data)
+	assert.Equal(t, encodeCursor(DeviceCursor{Id: ids[1]}), page.Next)
+	assert.Empty(t, page.Prev)
+}
+
+func TestService_GetDevicesByCursor_GivenLastPage_ServiceReturnsOnlyPrevCursor(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID()}
+	dao := &mockDao{data: []Device{{Id: ids[0]}, {Id: ids[1]}}}
+	out := NewService(dao)
+	token := encodeCursor(DeviceCursor{Id: primitive.NewObjectID()})
+
+	page, err := out.GetDevicesByCursor(&DeviceQuery{}, token, 2, context.TODO())
+
+	assert.NoError(t, err)
+	assert.False(t, dao.cursor.Before)
+	assert.Empty(t, page.Next)
+	assert.Equal(t, encodeCursor(DeviceCursor{Id: ids[0], Before: true}), page.Prev)
+}
+
+func TestService_GetDevicesByCursor_GivenPrevCursor_ServiceReturnsDevicesInAscendingOrder(t *testing.T) {
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	// the dao walks backwards so it hands the devices over in descending order
+	dao := &mockDao{data: []Device{{Id: ids[2]}, {Id: ids[1]}, {Id: ids[0]}}}
+	out := NewService(dao)
+	token := encodeCursor(DeviceCursor{Id: primitive.NewObjectID(), Before: true})
+
+	page, err := out.GetDevicesByCursor(&DeviceQuery{}, token, 2, context.TODO())
+
+	assert.NoError(t, err)
+	assert.True(t, dao.cursor.Before)
+	assert.Equal(t, []Device{{Id: ids[1]}, {Id: ids[2]}}, page.Data)
+	assert.Equal(t, encodeCursor(DeviceCursor{Id: ids[2]}), page.Next)
+	assert.Equal(t, encodeCursor(DeviceCursor{Id: ids[1], Before: true}), page.Prev)
+}
+
+func TestService_GetDevicesByCursor_GivenInvalidInput_ServiceReturnsErrValidation(t *testing.T) {
+	tests := map[string]struct {
+		query *DeviceQuery
+		token string
+		limit int
+	}{
+		"malformed token":   {query: &DeviceQuery{}, token: "abc", limit: 1},
+		"zero limit":        {query: &DeviceQuery{}, token: "", limit: 0},
+		"sorted by a name":  {query: &DeviceQuery{SortBy: "name"}, token: "", limit: 1},
+		"sorted by id desc": {query: &DeviceQuery{SortBy: "id", SortDesc: true}, token: "", limit: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewService(&mockDao{}).GetDevicesByCursor(tc.query, tc.token, tc.limit, context.TODO())
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
+
+func TestService_AddDevices_GivenSomeInvalidPayloads_ServiceAddsTheValidOnes(t *testing.T) {
+	dao := &mockDao{}
+	out := NewService(dao)
+	payloads := []DevicePayload{{Name: "first"}, {Name: "x"}, {Name: "third", Interval: 10}}
+
+	result, err := out.AddDevices(payloads, false, context.TODO())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dao.calledTimes)
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, "first", result.Items[0].Device.Name)
+	assert.Equal(t, 1000, result.Items[0].Device.Interval)
+	assert.Nil(t, result.Items[1].Device)
+	assert.NotEmpty(t, result.Items[1].Error)
+	assert.Equal(t, 10, result.Items[2].Device.Interval)
+}
+
+func TestService_AddDevices_GivenInvalidPayloadInAtomicMode_ServiceAddsNothing(t *testing.T) {
+	dao := &mockDao{}
+	out := NewService(dao)
+	payloads := []DevicePayload{{Name: "first"}, {Name: "x"}}
+
+	result, err := out.AddDevices(payloads, true, context.TODO())
+
+	assert.IsType(t, ErrValidation(""), err)
+	assert.Equal(t, 0, dao.calledTimes)
+	assert.Equal(t, 0, result.Created)
+	assert.Equal(t, 2, result.Failed)
+	assert.NotEmpty(t, result.Items[0].Error)
+}
+
+func TestService_AddDevices_GivenBulkWriteErrorInAtomicMode_ServiceRollsBackInsertedDevices(t *testing.T) {
+	dao := &mockDao{returnErr: ErrBulkWrite{1: "duplicate key"}}
+	out := NewService(dao)
+	payloads := []DevicePayload{{Name: "first"}, {Name: "second"}, {Name: "third"}}
+
+	result, err := out.AddDevices(payloads, true, context.TODO())
+
+	assert.IsType(t, ErrBulkWrite{}, err)
+	assert.Len(t, dao.deleted, 2)
+	assert.Equal(t, 3, result.Failed)
+	assert.Equal(t, "duplicate key", result.Items[1].Error)
+}
+
+func TestService_AddDevices_GivenBulkWriteError_ServiceReportsFailedItems(t *testing.T) {
+	dao := &mockDao{returnErr: ErrBulkWrite{0: "duplicate key"}}
+	out := NewService(dao)
+	payloads := []DevicePayload{{Name: "x"}, {Name: "second"}, {Name: "third"}}
+
+	result, err := out.AddDevices(payloads, false, context.TODO())
+
+	assert.NoError(t, err)
+	assert.Empty(t, dao.deleted)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 2, result.Failed)
+	assert.Equal(t, "duplicate key", result.Items[1].Error)
+	assert.Equal(t, "third", result.Items[2].Device.Name)
+}
+
+func TestService_AddDevices_GivenDaoError_ServiceReturnsError(t *testing.T) {
+	out := NewService(&mockDao{returnErr: ErrDao("")})
+
+	_, err := out.AddDevices([]DevicePayload{{Name: "first"}}, false, context.TODO())
+
+	assert.Equal(t, ErrDao(""), err)
+}
+
+func TestDevicePayload_ToDevice_GivenPayloadWithId_FuncKeepsPayloadId(t *testing.T) {
+	id := primitive.NewObjectID()
+	payload := DevicePayload{Id: id.Hex(), Name: "name", Value: 1.5, Interval: 10}
+
+	device := payload.toDevice(primitive.NewObjectID())
+
+	assert.Equal(t, Device{Id: id, Name: "name", Value: 1.5, Interval: 10}, device)
+}
+
+func TestService_AddDevice_GivenMalformedId_ServiceFails(t *testing.T) {
+	out := NewService(&mockDao{})
+
+	_, err := out.AddDevice(&DevicePayload{Id: "abc", Name: "name"}, context.TODO())
+
+	assert.IsType(t, ErrValidation(""), err)
+}
+
+func TestService_AddDevice_GivenInvalidLabelsOrGroups_ServiceFails(t *testing.T) {
+	tests := map[string]*DevicePayload{
+		"dot in label key":    {Name: "name", Labels: map[string]string{"a.b": "c"}},
+		"empty label value":   {Name: "name", Labels: map[string]string{"a": ""}},
+		"comma in label":      {Name: "name", Labels: map[string]string{"a": "b,c"}},
+		"space in group name": {Name: "name", Groups: []string{"floor 1"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewService(&mockDao{}).AddDevice(tc, context.TODO())
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
+
+func TestService_AddDevice_GivenLabelsAndGroups_ServiceReturnsThemWithDevice(t *testing.T) {
+	out := NewService(&mockDao{})
+	payload := &DevicePayload{Name: "name", Labels: map[string]string{"site": "lab 1"}, Groups: []string{"floor-1"}}
+
+	dev, err := out.AddDevice(payload, context.TODO())
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"site": "lab 1"}, dev.Labels)
+	assert.Equal(t, []string{"floor-1"}, dev.Groups)
+}
+
+func TestService_AddDevice_GivenInvalidSchedule_ServiceFails(t *testing.T) {
+	tests := map[string]*DevicePayload{
+		"jitter above 100":      {Name: "name", Jitter: 101},
+		"negative jitter":       {Name: "name", Jitter: -1},
+		"negative phase":        {Name: "name", Phase: -1},
+		"malformed cron":        {Name: "name", Cron: "every five minutes"},
+		"cron and the interval": {Name: "name", Cron: "*/5 * * * *", Interval: 1000},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewService(&mockDao{}).AddDevice(tc, context.TODO())
+
+			assert.IsType(t, ErrValidation(""), err)
+		})
+	}
+}
+
+func TestService_AddDevice_GivenCron_ServiceDoesNotDefaultInterval(t *testing.T) {
+	out := NewService(&mockDao{})
+	payload := &DevicePayload{Name: "name", Cron: "*/5 9-17 * * 1-5", Jitter: 10, Phase: 500}
+
+	dev, err := out.AddDevice(payload, context.TODO())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dev.Interval)
+	assert.Equal(t, "*/5 9-17 * * 1-5", dev.Cron)
+	assert.Equal(t, 10, dev.Jitter)
+	assert.Equal(t, 500, dev.Phase)
+}
+
+func TestService_GetDevicesInGroup_GivenGroup_ServiceQueriesByGroup(t *testing.T) {
+	dao := &mockDao{data: []Device{{Name: "test name"}}}
+	out := NewService(dao)
+
+	devices, err := out.GetDevicesInGroup("floor-1", context.TODO())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Device{{Name: "test name"}}, devices)
+	assert.Equal(t, &DeviceQuery{Group: "floor-1"}, dao.query)
+}
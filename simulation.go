@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SimulationConfig makes the pipeline run on virtual time from Start to End
+type SimulationConfig struct {
+	Start time.Time
+	// zero End lets a simulation with a speed run forever
+	End time.Time
+	// Speed is how many times faster than the wall clock the virtual time goes, zero goes as fast as possible
+	Speed float64
+}
+
+type SimulationStatus struct {
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+	Speed    float64    `json:"speed,omitempty"`
+	Now      time.Time  `json:"now"`
+	Finished bool       `json:"finished"`
+}
+
+// simulationConfigFromEnv reads SIMULATION_START, SIMULATION_END (both RFC 3339) and SIMULATION_SPEED
+// (a multiplier or max, which is the default), there is no simulation without SIMULATION_START
+func simulationConfigFromEnv() *SimulationConfig {
+	startStr := os.Getenv("SIMULATION_START")
+	if startStr == "" {
+		return nil
+	}
+	var config SimulationConfig
+	var err error
+	if config.Start, err = time.Parse(time.RFC3339, startStr); err != nil {
+		log.Panicf("incorrect simulation start: %s", startStr)
+	}
+	if endStr := os.Getenv("SIMULATION_END"); endStr != "" {
+		if config.End, err = time.Parse(time.RFC3339, endStr); err != nil || !config.End.After(config.Start) {
+			log.Panicf("incorrect simulation end: %s", endStr)
+		}
+	}
+	if speedStr := os.Getenv("SIMULATION_SPEED"); speedStr != "" && speedStr != "max" {
+		if config.Speed, err = strconv.ParseFloat(speedStr, 64); err != nil || config.Speed <= 0 {
+			log.Panicf("incorrect simulation speed: %s", speedStr)
+		}
+	}
+	if config.Speed == 0 && config.End.IsZero() {
+		log.Panicf("a simulation running as fast as possible needs SIMULATION_END")
+	}
+	return &config
+}
+
+// Simulation is the clock of the virtual time, which stays at the start until the simulation begins.
+// As fast as possible it jumps straight to the next timer whenever everybody is waiting for one
+type Simulation struct {
+	config SimulationConfig
+	// drives the virtual time when going as fast as possible
+	fake *FakeClock
+
+	mutex     sync.Mutex
+	realStart time.Time
+	finished  bool
+}
+
+func NewSimulation(config SimulationConfig) *Simulation {
+	s := &Simulation{config: config}
+	if config.Speed == 0 {
+		s.fake = NewFakeClock(config.Start)
+	}
+	return s
+}
+
+func (s *Simulation) Now() time.Time {
+	if s.fake != nil {
+		return s.fake.Now()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.realStart.IsZero() {
+		return s.config.Start
+	}
+	elapsed := float64(time.Since(s.realStart)) * s.config.Speed
+	return s.config.Start.Add(time.Duration(elapsed))
+}
+
+// NewTimer waits the given virtual time, the time sent on a sped up timer's channel is the wall clock's
+func (s *Simulation) NewTimer(d time.Duration) Timer {
+	if s.fake != nil {
+		return s.fake.NewTimer(d)
+	}
+	return &scaledTimer{systemTimer: systemTimer{time.NewTimer(s.scale(d))}, simulation: s}
+}
+
+// scale turns virtual time into wall clock time, what doesn't fit into a duration (like the idle wait
+// of a scheduler without devices at a speed of 1 or less) waits as long as a duration can
+func (s *Simulation) scale(d time.Duration) time.Duration {
+	scaled := float64(d) / s.config.Speed
+	if scaled >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(scaled)
+}
+
+// Begin sets the virtual time going, end is called once it gets to the end of the simulation
+func (s *Simulation) Begin(end func()) {
+	s.mutex.Lock()
+	s.realStart = time.Now()
+	s.mutex.Unlock()
+
+	finish := func() {
+		s.mutex.Lock()
+		s.finished = true
+		s.mutex.Unlock()
+		log.Printf("simulation got to its end at %s", s.config.End.Format(time.RFC3339))
+		end()
+	}
+	if s.fake != nil {
+		go s.drive(finish)
+	} else if !s.config.End.IsZero() {
+		time.AfterFunc(s.scale(s.config.End.Sub(s.config.Start)), finish)
+	}
+}
+
+// drive moves the virtual time to the next timer as soon as the scheduler is waiting for it,
+// the scheduler waits only once it has handed all the due ticks over so a slow sink slows the simulation down
+func (s *Simulation) drive(finish func()) {
+	for {
+		s.fake.BlockUntil(1)
+		next, ok := s.fake.NextDeadline()
+		if !ok {
+			continue
+		}
+		if next.After(s.config.End) {
+			finish()
+			return
+		}
+		s.fake.Advance(next.Sub(s.fake.Now()))
+	}
+}
+
+func (s *Simulation) Status() SimulationStatus {
+	status := SimulationStatus{Start: s.config.Start, Speed: s.config.Speed, Now: s.Now()}
+	if !s.config.End.IsZero() {
+		end := s.config.End
+		status.End = &end
+	}
+	s.mutex.Lock()
+	status.Finished = s.finished
+	s.mutex.Unlock()
+	return status
+}
+
+type scaledTimer struct {
+	systemTimer
+	simulation *Simulation
+}
+
+func (t *scaledTimer) Reset(d time.Duration) bool {
+	return t.Timer.Reset(t.simulation.scale(d))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSimulation_GivenMaxSpeed_DevicesTickThroughTheWholeRangeOnVirtualTime(t *testing.T) {
+	simulation := NewSimulation(SimulationConfig{Start: schedulerEpoch, End: schedulerEpoch.Add(24 * time.Hour)})
+	ts := newTestTickerService(simulation)
+	device := Device{Id: primitive.NewObjectID(), Interval: 60000}
+	queue := NewMeasurementQueue(16, Block)
+	done := make(chan struct{})
+
+	ts.Start([]Device{device}, queue)
+	simulation.Begin(func() {
+		ts.Finish()
+		close(done)
+	})
+	var measurements []Measurement
+	for len(measurements) < 24*60 {
+		measurements = append(measurements, <-queue.C())
+	}
+	<-done
+
+	for i, measurement := range measurements {
+		assert.Equal(t, schedulerEpoch.Add(time.Duration(i+1)*time.Minute), measurement.Timestamp)
+	}
+	assert.Len(t, queue.C(), 0)
+	assert.Equal(t, uint64(0), ts.SkippedTicks())
+	assert.True(t, simulation.Status().Finished)
+}
+
+func TestSimulation_GivenFullQueueAtTheEnd_PendingTicksAreStillPushed(t *testing.T) {
+	// 16 ticks fill the queue, the worker holds the 17th and the 18th waits for the worker
+	simulation := NewSimulation(SimulationConfig{Start: schedulerEpoch, End: schedulerEpoch.Add(18*time.Minute + 30*time.Second)})
+	ts := newTestTickerService(simulation)
+	queue := NewMeasurementQueue(16, Block)
+	ending := make(chan struct{})
+	done := make(chan struct{})
+
+	ts.Start([]Device{{Id: primitive.NewObjectID(), Interval: 60000}}, queue)
+	simulation.Begin(func() {
+		close(ending)
+		ts.Finish()
+		close(done)
+	})
+	<-ending
+	received := 0
+	for received < 18 {
+		select {
+		case <-queue.C():
+			received++
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "ticks were lost at the end of the simulation")
+			return
+		}
+	}
+	<-done
+
+	assert.Len(t, queue.C(), 0)
+}
+
+func TestSimulation_GivenMaxSpeedWithoutDevices_SimulationGetsToItsEnd(t *testing.T) {
+	simulation := NewSimulation(SimulationConfig{Start: schedulerEpoch, End: schedulerEpoch.Add(time.Hour)})
+	ts := newTestTickerService(simulation)
+	done := make(chan struct{})
+
+	ts.Start(nil, NewMeasurementQueue(1, Block))
+	simulation.Begin(func() {
+		ts.Finish()
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the simulation has not ended")
+	}
+	assert.True(t, simulation.Status().Finished)
+}
+
+func TestSimulation_GivenSpeed_VirtualTimeGoesThatMuchFaster(t *testing.T) {
+	end := schedulerEpoch.Add(time.Hour)
+	simulation := NewSimulation(SimulationConfig{Start: schedulerEpoch, End: end, Speed: 36000})
+	ts := newTestTickerService(simulation)
+	queue := NewMeasurementQueue(16, DropNewest)
+	done := make(chan struct{})
+	before := simulation.Now()
+
+	ts.Start([]Device{{Id: primitive.NewObjectID(), Interval: 60000}}, queue)
+	started := time.Now()
+	simulation.Begin(func() {
+		ts.Stop()
+		close(done)
+	})
+	first := <-queue.C()
+	<-done
+
+	// an hour of virtual time takes a tenth of a second
+	assert.True(t, time.Since(started) >= 100*time.Millisecond)
+	assert.Equal(t, schedulerEpoch, before)
+	assert.Equal(t, schedulerEpoch.Add(time.Minute), first.Timestamp)
+	assert.True(t, simulation.Status().Finished)
+	assert.False(t, simulation.Now().Before(end))
+}
+
+// countingClock counts how often the timers are set, a timing loop spinning without waiting keeps setting them
+type countingClock struct {
+	Clock
+	set int32
+}
+
+func (c *countingClock) NewTimer(d time.Duration) Timer {
+	atomic.AddInt32(&c.set, 1)
+	return &countingTimer{Timer: c.Clock.NewTimer(d), clock: c}
+}
+
+type countingTimer struct {
+	Timer
+	clock *countingClock
+}
+
+func (t *countingTimer) Reset(d time.Duration) bool {
+	atomic.AddInt32(&t.clock.set, 1)
+	return t.Timer.Reset(d)
+}
+
+func TestSimulation_GivenSlowSpeedWithoutDevices_SchedulerWaits(t *testing.T) {
+	for _, speed := range []float64{1, 0.5} {
+		clock := &countingClock{Clock: NewSimulation(SimulationConfig{Start: schedulerEpoch, Speed: speed})}
+		s := NewScheduler(NewMeasurementQueue(1, DropNewest), 1, clock)
+
+		s.Start()
+		time.Sleep(50 * time.Millisecond)
+		s.Stop()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&clock.set), "speed %v", speed)
+	}
+}
+
+func TestSimulation_Status_GivenConfig_StatusReportsIt(t *testing.T) {
+	end := schedulerEpoch.Add(time.Hour)
+	simulation := NewSimulation(SimulationConfig{Start: schedulerEpoch, End: end, Speed: 2})
+
+	status := simulation.Status()
+
+	assert.Equal(t, SimulationStatus{Start: schedulerEpoch, End: &end, Speed: 2, Now: schedulerEpoch}, status)
+}
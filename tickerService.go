@@ -1,15 +1,125 @@
 package main
 
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// TickerService keeps the started devices ticking, each of them can be stopped and started again on its own
 type TickerService struct {
-	stopDevices chan bool
+	mutex     sync.Mutex
+	scheduler *Scheduler
+	workers   int
+	clock     Clock
+}
+
+// NewTickerService reads the size of the worker pool from TICKER_WORKERS, it defaults to the number of CPUs
+func NewTickerService(clock Clock) *TickerService {
+	workers := runtime.NumCPU()
+	if workersStr := os.Getenv("TICKER_WORKERS"); workersStr != "" {
+		var err error
+		if workers, err = convertToPositiveInteger(workersStr); err != nil || workers == 0 {
+			log.Panicf("incorrect number of ticker workers: %s", workersStr)
+		}
+	}
+	return &TickerService{workers: workers, clock: clock}
+}
+
+func (t *TickerService) Start(allDevices []Device, queue *MeasurementQueue) {
+	t.mutex.Lock()
+	t.scheduler = NewScheduler(queue, t.workers, t.clock)
+	t.scheduler.Start()
+	t.mutex.Unlock()
+
+	_, _ = t.StartDevices(allDevices)
+}
+
+// Stop stops all the devices, the service can be started again afterwards
+func (t *TickerService) Stop() {
+	t.mutex.Lock()
+	scheduler := t.scheduler
+	t.scheduler = nil
+	t.mutex.Unlock()
+
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+}
+
+// Finish stops all the devices once the ticks which were due have been pushed, a simulation ends with it
+func (t *TickerService) Finish() {
+	if scheduler := t.getScheduler(); scheduler != nil {
+		scheduler.Drain()
+	}
+	t.Stop()
+}
+
+// StartDevices starts the devices which aren't ticking yet and returns how many of them were started
+func (t *TickerService) StartDevices(devices []Device) (int, error) {
+	scheduler := t.getScheduler()
+	if scheduler == nil {
+		return 0, ErrPipelineNotRunning("")
+	}
+
+	started := 0
+	for i := range devices {
+		if scheduler.Add(devices[i]) {
+			started++
+		}
+	}
+	return started, nil
+}
+
+// StopDevices stops the given devices and returns how many of them were running
+func (t *TickerService) StopDevices(ids []primitive.ObjectID) int {
+	scheduler := t.getScheduler()
+	if scheduler == nil {
+		return 0
+	}
+
+	stopped := 0
+	for _, id := range ids {
+		if scheduler.Remove(id) {
+			stopped++
+		}
+	}
+	return stopped
 }
 
-func NewTickerService() *TickerService {
-	return &TickerService{stopDevices: make(chan bool)}
+func (t *TickerService) IsRunning(id primitive.ObjectID) bool {
+	scheduler := t.getScheduler()
+	return scheduler != nil && scheduler.Has(id)
 }
 
-func (t *TickerService) Start(allDevices []Device, publish chan<- Measurement) {
-	for i := range allDevices {
-		go allDevices[i].deviceTicker(publish, t.stopDevices)
+// RestartDevice picks up the changes of a running device, a device which isn't running is left alone
+func (t *TickerService) RestartDevice(device Device) error {
+	if scheduler := t.getScheduler(); scheduler != nil {
+		scheduler.Update(device)
 	}
+	return nil
+}
+
+// Ticking tells how many devices are ticking
+func (t *TickerService) Ticking() int {
+	if scheduler := t.getScheduler(); scheduler != nil {
+		return scheduler.Len()
+	}
+	return 0
+}
+
+// SkippedTicks tells how many ticks were lost because the devices couldn't keep up with their intervals
+func (t *TickerService) SkippedTicks() uint64 {
+	if scheduler := t.getScheduler(); scheduler != nil {
+		return scheduler.Skipped()
+	}
+	return 0
+}
+
+func (t *TickerService) getScheduler() *Scheduler {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.scheduler
 }
@@ -2,19 +2,106 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"testing"
+	"time"
 )
 
-func TestTickerService_Start_StopChannelWorksProperly(t *testing.T) {
-	ts := NewTickerService()
-	devices := []Device{{Name: "test", Interval: 1}, {Name: "test", Interval: 1}}
-	publish := make(chan Measurement)
-	defer close(publish)
-	defer close(ts.stopDevices)
+// newTestTickerService runs a single worker so that the measurements are published in the order of their ticks
+func newTestTickerService(clock Clock) *TickerService {
+	ts := NewTickerService(clock)
+	ts.workers = 1
+	return ts
+}
+
+func TestTickerService_Start_GivenDevices_MeasurementsArePublishedInOrderOfTheirTicks(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	ts := newTestTickerService(clock)
+	first := Device{Id: primitive.NewObjectID(), Name: "first", Interval: 1000, Value: 1}
+	second := Device{Id: primitive.NewObjectID(), Name: "second", Interval: 1500, Value: 2}
+	queue := NewMeasurementQueue(16, Block)
+
+	ts.Start([]Device{first, second}, queue)
+	advanceBy(clock, 500*time.Millisecond, 6)
+	measurements := receive(queue, 5)
+
+	at := func(ms int) time.Time { return schedulerEpoch.Add(time.Duration(ms) * time.Millisecond) }
+	assert.Equal(t, []Measurement{
+		first.measurement(at(1000)),
+		second.measurement(at(1500)),
+		first.measurement(at(2000)),
+		first.measurement(at(3000)),
+		second.measurement(at(3000)),
+	}, measurements)
+}
+
+func TestTickerService_StopDevices_StoppedDevicesAreNotRunning(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	ts := newTestTickerService(clock)
+	stoppedDevice := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	runningDevice := Device{Id: primitive.NewObjectID(), Interval: 1000}
+	queue := NewMeasurementQueue(16, Block)
+
+	ts.Start([]Device{stoppedDevice, runningDevice}, queue)
+	advanceBy(clock, time.Second, 1)
+	before := receive(queue, 2)
+	stopped := ts.StopDevices([]primitive.ObjectID{stoppedDevice.Id, primitive.NewObjectID()})
+	advanceBy(clock, time.Second, 2)
+	after := receive(queue, 2)
+
+	assert.Equal(t, 1, stopped)
+	assert.Equal(t, stoppedDevice.Id, before[0].Id)
+	assert.Equal(t, runningDevice.Id, before[1].Id)
+	assert.Equal(t, runningDevice.measurement(schedulerEpoch.Add(2*time.Second)), after[0])
+	assert.Equal(t, runningDevice.measurement(schedulerEpoch.Add(3*time.Second)), after[1])
+	assert.False(t, ts.IsRunning(stoppedDevice.Id))
+	assert.True(t, ts.IsRunning(runningDevice.Id))
+}
+
+func TestTickerService_RestartDevice_GivenRunningDevice_NextMeasurementCarriesNewValue(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	ts := newTestTickerService(clock)
+	device := Device{Id: primitive.NewObjectID(), Interval: 1000, Value: 1}
+	queue := NewMeasurementQueue(16, Block)
+
+	ts.Start([]Device{device}, queue)
+	advanceBy(clock, time.Second, 1)
+	before := <-queue.C()
+	device.Value = 2
+	assert.NoError(t, ts.RestartDevice(device))
+	advanceBy(clock, time.Second, 1)
+	after := <-queue.C()
+
+	assert.Equal(t, 1.0, before.Value)
+	assert.Equal(t, device.measurement(schedulerEpoch.Add(2*time.Second)), after)
+}
+
+func TestTickerService_StartDevices_GivenNotStartedService_ServiceReturnsErrPipelineNotRunning(t *testing.T) {
+	ts := NewTickerService(NewFakeClock(schedulerEpoch))
+
+	started, err := ts.StartDevices([]Device{{Id: primitive.NewObjectID(), Interval: 1}})
+
+	assert.Equal(t, ErrPipelineNotRunning(""), err)
+	assert.Equal(t, 0, started)
+}
+
+func TestTickerService_StartDevices_GivenRunningDevice_ServiceDoesNotStartItTwice(t *testing.T) {
+	ts := NewTickerService(NewFakeClock(schedulerEpoch))
+	device := Device{Id: primitive.NewObjectID(), Interval: 1}
+	other := Device{Id: primitive.NewObjectID(), Interval: 1}
+
+	ts.Start([]Device{device}, NewMeasurementQueue(1, Block))
+	started, err := ts.StartDevices([]Device{device, other})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, started)
+	assert.True(t, ts.IsRunning(other.Id))
+}
+
+func TestTickerService_StopDevices_GivenDeviceThatIsNotRunning_ServiceIgnoresIt(t *testing.T) {
+	ts := NewTickerService(NewFakeClock(schedulerEpoch))
 
-	ts.Start(devices, publish)
-	ts.stopDevices <- true
+	stopped := ts.StopDevices([]primitive.ObjectID{primitive.NewObjectID()})
 
-	assert.Empty(t, publish)
-	assert.Empty(t, ts.stopDevices)
+	assert.Equal(t, 0, stopped)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the certificate files are checked for changes, at most
+const tlsReloadInterval = 10 * time.Second
+
+// tlsClientCAFromEnv is the CA the client certificates have to be signed by, mutual TLS is off when it is empty
+func tlsClientCAFromEnv() string {
+	return os.Getenv("TLS_CLIENT_CA_FILE")
+}
+
+// tlsConfigFromEnv returns nil when TLS_CERT_FILE and TLS_KEY_FILE aren't set, the server stays on plain HTTP then.
+// TLS_CLIENT_CA_FILE turns mutual TLS on, every client has to come with a certificate signed by that CA.
+// It can't be set without them, the clients would otherwise be let in on plain HTTP without any certificate
+func tlsConfigFromEnv() *tls.Config {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		if tlsClientCAFromEnv() != "" {
+			log.Panicf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		log.Panicf("TLS_CERT_FILE and TLS_KEY_FILE have to be set together")
+	}
+	reloader, err := NewCertReloader(certFile, keyFile, SystemClock{})
+	if err != nil {
+		log.Panicf("could not load the TLS certificate: %s", err.Error())
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if caFile := tlsClientCAFromEnv(); caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			log.Panicf("could not load the client CA: %s", err.Error())
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrValidation("no certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// CertReloader serves the certificate from the files and loads it again once the files change,
+// so that a renewed certificate is picked up without a restart. A certificate which can't be loaded is
+// logged and the previous one is kept
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	clock    Clock
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func NewCertReloader(certFile, keyFile string, clock Clock) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, clock: clock}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.clock.Now()
+	if now.Sub(r.checked) < tlsReloadInterval {
+		return r.cert, nil
+	}
+	r.checked = now
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Printf("could not check the TLS certificate: %s", err.Error())
+		return r.cert, nil
+	}
+	if !modTime.Equal(r.modTime) {
+		if err := r.load(modTime); err != nil {
+			log.Printf("could not reload the TLS certificate, keeping the previous one: %s", err.Error())
+		} else {
+			log.Printf("TLS certificate reloaded from %s", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+// load requires the mutex to be held, or the reloader not to be shared yet
+func (r *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = r.clock.Now()
+	return nil
+}
+
+// latestModTime is when either of the files was changed last
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certificatePrincipal turns the verified client certificate into a principal, nil if there's none.
+// The identity is the common name of the subject and the organizational units which are scopes are its scopes
+func certificatePrincipal(state *tls.ConnectionState) *Principal {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	subject := state.VerifiedChains[0][0].Subject
+	name := subject.CommonName
+	if name == "" {
+		name = subject.String()
+	}
+	scopes := make([]string, 0)
+	for _, unit := range subject.OrganizationalUnit {
+		if knownScopes[unit] {
+			scopes = append(scopes, unit)
+		}
+	}
+	return &Principal{Name: "cert:" + name, Scopes: scopes}
+}
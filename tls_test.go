@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCertificate is self-signed when there's no parent
+func newTestCertificate(t *testing.T, subject pkix.Name, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func (c *testCertificate) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertReloader_GetCertificate_GivenChangedFiles_NewCertificateIsServed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	first := newTestCertificate(t, pkix.Name{CommonName: "first"}, nil, false)
+	second := newTestCertificate(t, pkix.Name{CommonName: "second"}, nil, false)
+	certFile, keyFile := first.write(t, dir, "server")
+	clock := NewFakeClock(time.Now())
+	reloader, err := NewCertReloader(certFile, keyFile, clock)
+	assert.NoError(t, err)
+
+	second.write(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	beforeCheck, _ := reloader.GetCertificate(nil)
+	clock.Advance(tlsReloadInterval)
+	afterCheck, _ := reloader.GetCertificate(nil)
+
+	assert.Equal(t, first.der, beforeCheck.Certificate[0])
+	assert.Equal(t, second.der, afterCheck.Certificate[0])
+}
+
+func TestCertReloader_GetCertificate_GivenBrokenFiles_PreviousCertificateIsKept(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	first := newTestCertificate(t, pkix.Name{CommonName: "first"}, nil, false)
+	certFile, keyFile := first.write(t, dir, "server")
+	clock := NewFakeClock(time.Now())
+	reloader, _ := NewCertReloader(certFile, keyFile, clock)
+
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	clock.Advance(tlsReloadInterval)
+	cert, err := reloader.GetCertificate(nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, first.der, cert.Certificate[0])
+}
+
+func Test_TlsConfigFromEnv_GivenClientCAWithoutCertificate_Panics(t *testing.T) {
+	os.Setenv("TLS_CLIENT_CA_FILE", "ca.pem")
+	defer os.Unsetenv("TLS_CLIENT_CA_FILE")
+
+	assert.Panics(t, func() { tlsConfigFromEnv() })
+}
+
+func TestAuthenticator_Middleware_GivenClientCertificate_SubjectIsThePrincipal(t *testing.T) {
+	ca := newTestCertificate(t, pkix.Name{CommonName: "test ca"}, nil, true)
+	server := newTestCertificate(t, pkix.Name{CommonName: "localhost"}, ca, false)
+	reader := newTestCertificate(t, pkix.Name{CommonName: "dashboard", OrganizationalUnit: []string{scopeDevicesRead, "ops"}}, ca, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	a := NewAuthenticator(&mockApiKeyDao{}, "")
+	a.certificates = true
+	mockServer := httptest.NewUnstartedServer(newRouter(&Controller{mainService: NewService(&mockDao{}), auth: a}))
+	mockServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	mockServer.StartTLS()
+	defer mockServer.Close()
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+	}
+	url := strings.Replace(mockServer.URL, "127.0.0.1", "localhost", 1)
+
+	read, readErr := client(reader.tlsCertificate()).Get(url + "/devices")
+	write, writeErr := client(reader.tlsCertificate()).Post(url+"/devices", "application/json", strings.NewReader(`{"name": "test"}`))
+	_, anonymousErr := client().Get(url + "/devices")
+
+	assert.NoError(t, readErr)
+	assert.Equal(t, http.StatusOK, read.StatusCode)
+	assert.NoError(t, writeErr)
+	assert.Equal(t, http.StatusForbidden, write.StatusCode)
+	assert.Error(t, anonymousErr)
+}
+
+func Test_CertificatePrincipal_GivenVerifiedChain_KeepsOnlyKnownScopes(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "platform", OrganizationalUnit: []string{scopeDevicesWrite, "ops"}}}
+
+	principal := certificatePrincipal(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}})
+	none := certificatePrincipal(&tls.ConnectionState{})
+
+	assert.Equal(t, &Principal{Name: "cert:platform", Scopes: []string{scopeDevicesWrite}}, principal)
+	assert.Nil(t, none)
+}
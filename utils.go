@@ -30,6 +30,14 @@ func readIntFromQueryParameter(url *url.URL, param string, defaultValue int) (in
 	return convertToPositiveInteger(valueStr)
 }
 
+func readBoolFromQueryParameter(url *url.URL, param string) (bool, error) {
+	valueStr := url.Query().Get(param)
+	if valueStr == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(valueStr)
+}
+
 func stringIDToObjectID(id string) (primitive.ObjectID, error) {
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
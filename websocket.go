@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxMessage = 4096
+)
+
+// message types sent by the client
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsStart       = "start"
+	wsStop        = "stop"
+	wsSetValue    = "setValue"
+)
+
+// message types sent by the server
+const (
+	wsMeasurement = "measurement"
+	wsAck         = "ack"
+	wsError       = "error"
+)
+
+// WsRequest is what the client sends, Ids are used by (un)subscribe, Id and Value by the device commands.
+// RequestId is echoed back in the response so that the client can match them
+type WsRequest struct {
+	Type      string   `json:"type"`
+	RequestId string   `json:"requestId,omitempty"`
+	Ids       []string `json:"ids,omitempty"`
+	Id        string   `json:"id,omitempty"`
+	Value     *float64 `json:"value,omitempty"`
+}
+
+type WsResponse struct {
+	Type        string       `json:"type"`
+	RequestId   string       `json:"requestId,omitempty"`
+	Action      string       `json:"action,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Device      *Device      `json:"device,omitempty"`
+	Measurement *Measurement `json:"measurement,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsConnection serves a single client, only the write loop writes to the socket
+type wsConnection struct {
+	controller *Controller
+	conn       *websocket.Conn
+	sub        *Subscription
+	responses  chan WsResponse
+	// closed once the write loop has given up
+	writerDone chan struct{}
+
+	mutex sync.Mutex
+	ids   map[primitive.ObjectID]bool
+}
+
+// WebSocketHandler lets the client subscribe to devices and control them over a single connection
+func (he *HandlersEnvironment) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied with an error
+		return
+	}
+
+	wc := &wsConnection{
+		controller: he.controller,
+		conn:       conn,
+		responses:  make(chan WsResponse, 16),
+		writerDone: make(chan struct{}),
+		ids:        make(map[primitive.ObjectID]bool),
+	}
+	wc.sub = he.controller.hub.Subscribe(wc.isSubscribed)
+	defer he.controller.Unsubscribe(wc.sub)
+
+	done := make(chan struct{})
+	go wc.writeLoop(done)
+	wc.readLoop(r.Context())
+	close(done)
+}
+
+func (wc *wsConnection) isSubscribed(measurement Measurement) bool {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	return wc.ids[measurement.Id]
+}
+
+func (wc *wsConnection) readLoop(ctx context.Context) {
+	defer wc.conn.Close()
+	wc.conn.SetReadLimit(wsMaxMessage)
+	_ = wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	wc.conn.SetPongHandler(func(string) error {
+		return wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var request WsRequest
+		if err := wc.conn.ReadJSON(&request); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				log.Printf("websocket read failed: %s", err.Error())
+			}
+			return
+		}
+		response := wc.handle(&request, ctx)
+		response.RequestId = request.RequestId
+		select {
+		case wc.responses <- response:
+		case <-wc.writerDone:
+			return
+		}
+	}
+}
+
+func (wc *wsConnection) handle(request *WsRequest, ctx context.Context) WsResponse {
+	var err error
+	var device *Device
+	if request.Type == wsStart || request.Type == wsStop || request.Type == wsSetValue {
+		if !principalFrom(ctx).Can(scopeDevicesWrite) {
+			return WsResponse{Type: wsError, Action: request.Type, Error: ErrForbidden(scopeDevicesWrite).Error()}
+		}
+	}
+	switch request.Type {
+	case wsSubscribe, wsUnsubscribe:
+		err = wc.updateSubscriptions(request.Ids, request.Type == wsSubscribe)
+	case wsStart:
+		err = wc.controller.StartDevice(request.Id, ctx)
+	case wsStop:
+		err = wc.controller.StopDevice(request.Id)
+	case wsSetValue:
+		if request.Value == nil {
+			err = ErrValidation("value is required")
+			break
+		}
+		device, err = wc.controller.SetDeviceValue(request.Id, *request.Value, ctx)
+	default:
+		err = ErrValidation("unknown message type: " + request.Type)
+	}
+	if err != nil {
+		return WsResponse{Type: wsError, Action: request.Type, Error: err.Error()}
+	}
+	return WsResponse{Type: wsAck, Action: request.Type, Device: device}
+}
+
+func (wc *wsConnection) updateSubscriptions(ids []string, subscribe bool) error {
+	objectIDs := make([]primitive.ObjectID, len(ids))
+	for i, id := range ids {
+		objectID, err := stringIDToObjectID(id)
+		if err != nil {
+			return ErrValidation("invalid id: " + id)
+		}
+		objectIDs[i] = objectID
+	}
+
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	for _, id := range objectIDs {
+		if subscribe {
+			wc.ids[id] = true
+		} else {
+			delete(wc.ids, id)
+		}
+	}
+	return nil
+}
+
+// writeLoop sends the responses, measurements and pings until the read loop is done
+// or the hub drops the subscription for being too slow
+func (wc *wsConnection) writeLoop(done <-chan struct{}) {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	defer close(wc.writerDone)
+	defer wc.conn.Close()
+
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case response := <-wc.responses:
+			err = wc.write(response)
+		case measurement, ok := <-wc.sub.C:
+			if !ok {
+				_ = wc.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"),
+					time.Now().Add(wsWriteWait))
+				return
+			}
+			err = wc.write(WsResponse{Type: wsMeasurement, Measurement: &measurement})
+		case <-ping.C:
+			err = wc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (wc *wsConnection) write(response WsResponse) error {
+	_ = wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return wc.conn.WriteJSON(response)
+}
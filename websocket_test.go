@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func dialWebSocket(t *testing.T, c *Controller) *websocket.Conn {
+	mockServer := httptest.NewServer(newRouter(c))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(mockServer.URL, "http")+"/ws", nil)
+	assert.NoError(t, err)
+	return conn
+}
+
+func roundTrip(t *testing.T, conn *websocket.Conn, request WsRequest) WsResponse {
+	assert.NoError(t, conn.WriteJSON(request))
+	var response WsResponse
+	assert.NoError(t, conn.ReadJSON(&response))
+	return response
+}
+
+func TestWebSocket_GivenSubscription_ClientReceivesOnlySubscribedMeasurements(t *testing.T) {
+	hub := NewMeasurementHub(4, DropMeasurements)
+	conn := dialWebSocket(t, &Controller{mainService: NewService(&mockDao{}), hub: hub})
+	defer conn.Close()
+	id := primitive.NewObjectID()
+
+	response := roundTrip(t, conn, WsRequest{Type: wsSubscribe, RequestId: "1", Ids: []string{id.Hex()}})
+	assert.Equal(t, WsResponse{Type: wsAck, RequestId: "1", Action: wsSubscribe}, response)
+
+	hub.Publish(Measurement{Id: primitive.NewObjectID(), Value: 1})
+	hub.Publish(Measurement{Id: id, Value: 2})
+
+	var measurement WsResponse
+	assert.NoError(t, conn.ReadJSON(&measurement))
+	assert.Equal(t, wsMeasurement, measurement.Type)
+	assert.Equal(t, id, measurement.Measurement.Id)
+	assert.Equal(t, 2.0, measurement.Measurement.Value)
+
+	response = roundTrip(t, conn, WsRequest{Type: wsUnsubscribe, RequestId: "2", Ids: []string{id.Hex()}})
+	assert.Equal(t, wsAck, response.Type)
+
+	hub.Publish(Measurement{Id: id, Value: 3})
+	response = roundTrip(t, conn, WsRequest{Type: wsSubscribe, RequestId: "3"})
+	assert.Equal(t, "3", response.RequestId)
+}
+
+func TestWebSocket_GivenSetValueCommand_ClientReceivesUpdatedDevice(t *testing.T) {
+	id := primitive.NewObjectID()
+	c := &Controller{mainService: NewService(&mockDao{device: &Device{Id: id}}), tickerService: NewTickerService(SystemClock{}), hub: NewMeasurementHub(1, DropMeasurements)}
+	conn := dialWebSocket(t, c)
+	defer conn.Close()
+	value := 42.5
+
+	response := roundTrip(t, conn, WsRequest{Type: wsSetValue, RequestId: "1", Id: id.Hex(), Value: &value})
+
+	assert.Equal(t, wsAck, response.Type)
+	assert.Equal(t, &Device{Id: id, Value: 42.5}, response.Device)
+}
+
+func TestWebSocket_GivenInvalidRequests_ClientReceivesErrors(t *testing.T) {
+	c := &Controller{mainService: NewService(&mockDao{device: &Device{Id: primitive.NewObjectID()}}), tickerService: NewTickerService(SystemClock{}), hub: NewMeasurementHub(1, DropMeasurements)}
+	conn := dialWebSocket(t, c)
+	defer conn.Close()
+	tests := map[string]WsRequest{
+		"unknown type":         {Type: "reboot"},
+		"invalid subscription": {Type: wsSubscribe, Ids: []string{"abc"}},
+		"missing value":        {Type: wsSetValue, Id: primitive.NewObjectID().Hex()},
+		"invalid stop id":      {Type: wsStop, Id: "abc"},
+		"pipeline not running": {Type: wsStart, Id: primitive.NewObjectID().Hex()},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			response := roundTrip(t, conn, tc)
+
+			assert.Equal(t, wsError, response.Type)
+			assert.Equal(t, tc.Type, response.Action)
+			assert.NotEmpty(t, response.Error)
+		})
+	}
+}
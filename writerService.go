@@ -3,63 +3,150 @@ package main
 import (
 	"github.com/influxdata/influxdb1-client/v2"
 	"log"
+	"os"
 	"time"
 )
 
+const (
+	defaultMeasurementName = "deviceValues"
+	defaultPrecision       = "ns"
+	// the most points sent with a single write
+	maxWriteBatch     = 500
+	influxPingTimeout = 5 * time.Second
+)
+
+// precisions understood by influx
+var influxPrecisions = map[string]bool{"ns": true, "u": true, "ms": true, "s": true, "m": true, "h": true}
+
+type InfluxConfig struct {
+	Address         string
+	Database        string
+	MeasurementName string
+	Precision       string
+}
+
+func influxConfigFromEnv() InfluxConfig {
+	return InfluxConfig{
+		Address:         os.Getenv("INFLUXDB_URL"),
+		Database:        os.Getenv("INFLUXDB_NAME"),
+		MeasurementName: os.Getenv("INFLUXDB_MEASUREMENT"),
+		Precision:       os.Getenv("INFLUXDB_PRECISION"),
+	}
+}
+
+func (c *InfluxConfig) setDefaults() {
+	if c.MeasurementName == "" {
+		c.MeasurementName = defaultMeasurementName
+	}
+	if c.Precision == "" {
+		c.Precision = defaultPrecision
+	}
+}
+
 type MeasurementsWriterService struct {
-	db           string
-	writerClient client.Client
+	db              string
+	measurementName string
+	precision       string
+	writerClient    client.Client
+	clock           Clock
 }
 
-func NewMeasurementsWriterService(dbAddress, dbName string) *MeasurementsWriterService {
+func NewMeasurementsWriterService(config InfluxConfig, clock Clock) *MeasurementsWriterService {
+	config.setDefaults()
+	if !influxPrecisions[config.Precision] {
+		log.Panicf("unknown influx precision: %s", config.Precision)
+	}
 	clt, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr: dbAddress,
+		Addr: config.Address,
 	})
 	if err != nil {
 		log.Panicf("could not initialize influx connection: %s", err.Error())
 	}
 	return &MeasurementsWriterService{
-		db:           dbName,
-		writerClient: clt,
+		db:              config.Database,
+		measurementName: config.MeasurementName,
+		precision:       config.Precision,
+		writerClient:    clt,
+		clock:           clock,
 	}
 }
 
+// Start writes whatever comes from publish until it gets closed, the client stays open until Close
 func (mws *MeasurementsWriterService) Start(publish <-chan Measurement) error {
-	defer mws.closeClient()
-
-	batchPoints, err := mws.batchPointsModel()
-	if err != nil {
+	if _, err := mws.batchPointsModel(); err != nil {
 		return err
 	}
 
 	go func() {
 		for measurement := range publish {
-			mws.dbWrite(batchPoints, measurement)
+			mws.dbWrite(collectBatch(measurement, publish, maxWriteBatch))
 		}
 	}()
 
 	return nil
 }
 
-func (mws *MeasurementsWriterService) dbWrite(batchPoints client.BatchPoints, measurement Measurement) {
-	point, err := client.NewPoint(
-		"deviceValues",
-		map[string]string{"deviceId": measurement.Id.String()},
-		map[string]interface{}{"value": measurement.Value},
-		time.Now())
+// collectBatch takes whatever has piled up behind the first measurement without waiting for more,
+// so that a slow write is followed by a bigger one instead of the queue growing
+func collectBatch(first Measurement, publish <-chan Measurement, max int) []Measurement {
+	batch := []Measurement{first}
+	for len(batch) < max {
+		select {
+		case measurement, ok := <-publish:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, measurement)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (mws *MeasurementsWriterService) dbWrite(measurements []Measurement) {
+	if err := mws.WriteBatch(measurements); err != nil {
+		log.Printf("Could not write %d measurements: %s", len(measurements), err.Error())
+	}
+}
+
+// WriteBatch writes the measurements with a single request, the ones which can't become points are skipped
+func (mws *MeasurementsWriterService) WriteBatch(measurements []Measurement) error {
+	// every write gets a fresh batch, otherwise all the previous points would be sent again
+	batchPoints, err := mws.batchPointsModel()
 	if err != nil {
-		log.Printf("Could not save %+v: %s", measurement, err.Error())
+		return err
+	}
+	for _, measurement := range measurements {
+		point, err := mws.newPoint(measurement)
+		if err != nil {
+			log.Printf("Could not save %+v: %s", measurement, err.Error())
+			continue
+		}
+		batchPoints.AddPoint(point)
 	}
-	batchPoints.AddPoint(point)
-	if err = mws.writerClient.Write(batchPoints); err != nil {
-		log.Printf("Could not write %+v: %s", measurement, err.Error())
+	if len(batchPoints.Points()) == 0 {
+		return nil
 	}
+	return mws.writerClient.Write(batchPoints)
+}
+
+func (mws *MeasurementsWriterService) newPoint(measurement Measurement) (*client.Point, error) {
+	timestamp := measurement.Timestamp
+	if timestamp.IsZero() {
+		timestamp = mws.clock.Now()
+	}
+	return client.NewPoint(
+		mws.measurementName,
+		measurementTags(measurement),
+		map[string]interface{}{"value": measurement.Value},
+		timestamp)
 }
 
 func (mws *MeasurementsWriterService) batchPointsModel() (client.BatchPoints, error) {
 	batchPoints, err := client.NewBatchPoints(client.BatchPointsConfig{
 		Database:  mws.db,
-		Precision: "s",
+		Precision: mws.precision,
 	})
 	if err != nil {
 		log.Println(err)
@@ -69,10 +156,33 @@ func (mws *MeasurementsWriterService) batchPointsModel() (client.BatchPoints, er
 	return batchPoints, nil
 }
 
-func (mws *MeasurementsWriterService) closeClient() error {
+// Ping tells whether influx can be reached
+func (mws *MeasurementsWriterService) Ping() error {
+	_, _, err := mws.writerClient.Ping(influxPingTimeout)
+	return err
+}
+
+// Close releases the client, nothing can be written afterwards
+func (mws *MeasurementsWriterService) Close() error {
 	if err := mws.writerClient.Close(); err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
+
+// labels become tags, the device's own tags always take precedence over labels with the same name
+func measurementTags(measurement Measurement) map[string]string {
+	tags := make(map[string]string, len(measurement.Labels)+3)
+	for key, value := range measurement.Labels {
+		tags[key] = value
+	}
+	tags["deviceId"] = measurement.Id.Hex()
+	if measurement.Name != "" {
+		tags["deviceName"] = measurement.Name
+	}
+	if measurement.Unit != "" {
+		tags["unit"] = measurement.Unit
+	}
+	return tags
+}
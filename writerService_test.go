@@ -1,12 +1,147 @@
 package main
 
 import (
+	"github.com/influxdata/influxdb1-client/v2"
 	assert2 "github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"testing"
+	"time"
 )
 
 func TestNewMeasurementsWriterService_GivenWrongAddressServicePanics(t *testing.T) {
 	writerService := NewMeasurementsWriterService
 
-	assert2.Panics(t, func() { writerService("abc", "123") })
+	assert2.Panics(t, func() { writerService(InfluxConfig{Address: "abc", Database: "123"}, SystemClock{}) })
+}
+
+func TestNewMeasurementsWriterService_GivenUnknownPrecisionServicePanics(t *testing.T) {
+	writerService := NewMeasurementsWriterService
+
+	assert2.Panics(t, func() { writerService(InfluxConfig{Address: "http://localhost:8086", Precision: "d"}, SystemClock{}) })
+}
+
+func TestMeasurementsWriterService_NewPoint_GivenMeasurement_PointCarriesTagsAndTimestamp(t *testing.T) {
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086", MeasurementName: "temperatures"}, SystemClock{})
+	id := primitive.NewObjectID()
+	timestamp := time.Date(2019, 12, 1, 10, 0, 0, 123456789, time.UTC)
+	measurement := Measurement{
+		Id:        id,
+		Name:      "thermo",
+		Unit:      "C",
+		Value:     21.5,
+		Labels:    map[string]string{"site": "lab1"},
+		Timestamp: timestamp,
+	}
+
+	point, err := mws.newPoint(measurement)
+	assert2.NoError(t, err)
+	fields, err := point.Fields()
+
+	assert2.NoError(t, err)
+	assert2.Equal(t, "temperatures", point.Name())
+	assert2.Equal(t, map[string]string{"deviceId": id.Hex(), "deviceName": "thermo", "unit": "C", "site": "lab1"}, point.Tags())
+	assert2.Equal(t, map[string]interface{}{"value": 21.5}, fields)
+	assert2.Equal(t, timestamp, point.Time())
+}
+
+func TestMeasurementsWriterService_NewPoint_GivenNoTimestamp_PointIsStampedWithCurrentTime(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086"}, clock)
+
+	point, err := mws.newPoint(Measurement{Id: primitive.NewObjectID()})
+
+	assert2.NoError(t, err)
+	assert2.Equal(t, defaultMeasurementName, point.Name())
+	assert2.Equal(t, schedulerEpoch, point.Time())
+}
+
+func TestMeasurementsWriterService_Start_GivenTickingDevices_PointsAreWrittenInOrderOfTheirTicks(t *testing.T) {
+	clock := NewFakeClock(schedulerEpoch)
+	influx := &mockInfluxClient{written: make(chan client.BatchPoints, 16)}
+	mws := NewMeasurementsWriterService(InfluxConfig{Address: "http://localhost:8086", Database: "devices"}, clock)
+	mws.writerClient = influx
+	ts := newTestTickerService(clock)
+	first := Device{Id: primitive.NewObjectID(), Interval: 1000, Value: 1}
+	second := Device{Id: primitive.NewObjectID(), Interval: 2000, Value: 2}
+	queue := NewMeasurementQueue(16, Block)
+
+	assert2.NoError(t, mws.Start(queue.C()))
+	ts.Start([]Device{first, second}, queue)
+	advanceBy(clock, time.Second, 2)
+	var points []*client.Point
+	for len(points) < 3 {
+		batch := <-influx.written
+		assert2.Equal(t, "devices", batch.Database())
+		points = append(points, batch.Points()...)
+	}
+
+	type written struct {
+		deviceId string
+		value    interface{}
+		time     time.Time
+	}
+	var actual []written
+	for _, point := range points {
+		fields, _ := point.Fields()
+		actual = append(actual, written{point.Tags()["deviceId"], fields["value"], point.Time()})
+	}
+	assert2.Equal(t, []written{
+		{first.Id.Hex(), 1.0, schedulerEpoch.Add(time.Second)},
+		{first.Id.Hex(), 1.0, schedulerEpoch.Add(2 * time.Second)},
+		{second.Id.Hex(), 2.0, schedulerEpoch.Add(2 * time.Second)},
+	}, actual)
+}
+
+func TestMeasurementTags_GivenMeasurementWithLabels_LabelsBecomeTags(t *testing.T) {
+	id := primitive.NewObjectID()
+	measurement := Measurement{Id: id, Labels: map[string]string{"site": "lab1", "deviceId": "spoofed"}}
+
+	tags := measurementTags(measurement)
+
+	assert2.Equal(t, map[string]string{"site": "lab1", "deviceId": id.Hex()}, tags)
+}
+
+func TestCollectBatch_GivenPendingMeasurements_FuncTakesThemUpToMax(t *testing.T) {
+	publish := make(chan Measurement, 5)
+	for i := 1; i <= 4; i++ {
+		publish <- Measurement{Value: float64(i)}
+	}
+
+	batch := collectBatch(Measurement{Value: 0}, publish, 3)
+
+	assert2.Equal(t, []Measurement{{Value: 0}, {Value: 1}, {Value: 2}}, batch)
+	assert2.Len(t, publish, 2)
+}
+
+func TestCollectBatch_GivenNothingPending_FuncReturnsImmediately(t *testing.T) {
+	publish := make(chan Measurement)
+
+	batch := collectBatch(Measurement{Value: 0}, publish, 3)
+
+	assert2.Equal(t, []Measurement{{Value: 0}}, batch)
+}
+
+// mockInfluxClient hands every written batch over to the test, pingErr fails the pings until it is taken
+type mockInfluxClient struct {
+	client.Client
+	written chan client.BatchPoints
+	pingErr chan error
+}
+
+func (m *mockInfluxClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	select {
+	case err := <-m.pingErr:
+		return 0, "", err
+	default:
+		return 0, "", nil
+	}
+}
+
+func (m *mockInfluxClient) Write(bp client.BatchPoints) error {
+	m.written <- bp
+	return nil
+}
+
+func (m *mockInfluxClient) Close() error {
+	return nil
 }